@@ -6,6 +6,11 @@ export function http_get(url, type = "json", params) {
         xhr.open("GET", url, true);
         xhr.withCredentials = true;
         xhr.setRequestHeader("X-Requested-With", "XmlHttpRequest");
+        if (params && params.headers) {
+            Object.keys(params.headers).forEach((key) => {
+                xhr.setRequestHeader(key, params.headers[key]);
+            });
+        }
         xhr.onerror = function() {
             handle_error_response(xhr, err);
         };
@@ -18,6 +23,9 @@ export function http_get(url, type = "json", params) {
                 handle_error_response(xhr, err);
                 return;
             }
+            if (params && params.response) {
+                params.response(xhr);
+            }
 
             if (type !== "json") {
                 done(xhr.responseText);
@@ -51,6 +59,11 @@ export function http_post(url, data, type = "json", params) {
         xhr.open("POST", url, true);
         xhr.withCredentials = true;
         xhr.setRequestHeader("X-Requested-With", "XmlHttpRequest");
+        if (params && params.headers) {
+            Object.keys(params.headers).forEach((key) => {
+                xhr.setRequestHeader(key, params.headers[key]);
+            });
+        }
         if (data && type === "json") {
             data = JSON.stringify(data);
             xhr.setRequestHeader("Content-Type", "application/json");
@@ -70,6 +83,9 @@ export function http_post(url, data, type = "json", params) {
                 handle_error_response(xhr, err);
                 return;
             }
+            if (params && params.response) {
+                params.response(xhr);
+            }
             try {
                 const data = JSON.parse(xhr.responseText);
                 if (data.status !== "ok") {
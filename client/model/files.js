@@ -12,6 +12,8 @@ class FileSystem {
     constructor() {
         this.obs = null;
         this.current_path = null;
+        // version of the files we've opened, so saving them can't overwrite someone else's work
+        this.etags = {};
     }
 
     ls(path, show_hidden = false) {
@@ -150,8 +152,8 @@ class FileSystem {
     }
 
     cat(path) {
-        const url = appendShareToUrl("/api/files/cat?path=" + prepare(path));
-        return http_get(url, "raw")
+        const url = appendShareToUrl("/api/files/cat?etag=true&path=" + prepare(path));
+        return http_get(url, "raw", { response: (xhr) => this._etag(path, xhr) })
             .then((res) => {
                 if (this.is_binary(res) === true) {
                     return Promise.reject({ code: "BINARY_FILE" });
@@ -205,9 +207,12 @@ class FileSystem {
     }
 
     save(path, file) {
-        const url = appendShareToUrl("/api/files/cat?path=" + prepare(path));
+        const url = appendShareToUrl("/api/files/cat?etag=true&path=" + prepare(path));
         return this._replace(path, "loading")
-            .then(() => http_post(url, file, "blob"))
+            .then(() => http_post(url, file, "blob", {
+                headers: this.etags[path] ? { "If-Match": this.etags[path] } : {},
+                response: (xhr) => this._etag(path, xhr),
+            }))
             .then(() => {
                 return this._saveFileToCache(path, file)
                     .then(() => this._replace(path, null, "loading"))
@@ -405,6 +410,12 @@ class FileSystem {
         });
     }
 
+    _etag(path, xhr) {
+        const etag = xhr.getResponseHeader("Etag");
+        if (etag) this.etags[path] = etag;
+        else delete this.etags[path];
+    }
+
     _saveFileToCache(path, file) {
         if (!file) return update_cache("");
         return new Promise((done, err) => {
@@ -5,5 +5,6 @@ export { Config, Backend, Middleware } from "./config";
 export { Log } from "./log";
 export { Admin } from "./admin";
 export { Audit } from "./audit";
+export { Indexer } from "./indexer";
 export { Tags } from "./tags";
 export { Chromecast } from "./chromecast";
@@ -0,0 +1,27 @@
+import { http_get, http_post, http_delete } from "../helpers/";
+
+class IndexerManager {
+    list() {
+        return http_get("/admin/api/search").then((res) => res.results);
+    }
+
+    pause(id) {
+        return http_post("/admin/api/search/" + encodeURIComponent(id) + "/pause");
+    }
+
+    resume(id) {
+        return http_post("/admin/api/search/" + encodeURIComponent(id) + "/resume");
+    }
+
+    reindex(id, path = "/") {
+        const url = "/admin/api/search/" + encodeURIComponent(id) + "/reindex" +
+              "?path=" + encodeURIComponent(path);
+        return http_post(url);
+    }
+
+    remove(id) {
+        return http_delete("/admin/api/search/" + encodeURIComponent(id));
+    }
+}
+
+export const Indexer = new IndexerManager();
@@ -9,7 +9,7 @@ import { notify } from "../helpers/";
 import { t } from "../locales/";
 
 import {
-    HomePage, BackendPage, SettingsPage, AboutPage, LogPage, SetupPage, LoginPage,
+    HomePage, BackendPage, SettingsPage, AboutPage, LogPage, SearchPage, SetupPage, LoginPage,
 } from "./adminpage/";
 
 function AdminOnly(WrappedComponent) {
@@ -62,6 +62,9 @@ export default ErrorPage(AdminOnly((props) => {
                         path={match.url + "/settings"}
                         render={()=> <SettingsPage isSaving={setIsSaving}/>}
                     />
+                    <Route
+                        path={match.url + "/search"}
+                        render={() => <SearchPage />} />
                     <Route
                         path={match.url + "/logs"}
                         render={() => <LogPage isSaving={setIsSaving}/>} />
@@ -112,6 +115,11 @@ function SideMenu(props) {
                         Settings
                     </NavLink>
                 </li>
+                <li>
+                    <NavLink activeClassName="active" to={props.url + "/search"}>
+                        Search
+                    </NavLink>
+                </li>
                 <li>
                     <NavLink activeClassName="active" to={props.url + "/logs"}>
                         Logs
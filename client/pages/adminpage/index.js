@@ -3,6 +3,7 @@ export { BackendPage } from "./backend";
 export { SettingsPage } from "./settings";
 export { AboutPage } from "./about";
 export { LogPage } from "./logger";
+export { SearchPage } from "./search";
 
 export { SetupPage } from "./setup";
 export { LoginPage } from "./loginpage";
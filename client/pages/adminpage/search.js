@@ -0,0 +1,136 @@
+import React, { useState, useEffect } from "react";
+import { Loader, Button } from "../../components/";
+import { Indexer } from "../../model/";
+import { notify, prompt } from "../../helpers/";
+import { t } from "../../locales/";
+
+import "./search.scss";
+
+export function SearchPage() {
+    const [indexers, setIndexers] = useState(null);
+    const [error, setError] = useState(null);
+
+    const refresh = () => {
+        Indexer.list().then((list) => {
+            setIndexers(list);
+            setError(null);
+        }).catch((err) => {
+            setError(err && err.message || t("Oops"));
+        });
+    };
+    const onError = (err) => notify.send(err && err.message || t("Oops"), "error");
+    const onPause = (idx) => {
+        (idx.paused ? Indexer.resume(idx.id) : Indexer.pause(idx.id))
+            .then(refresh)
+            .catch(onError);
+    };
+    const onReindex = (idx) => {
+        prompt.now(
+            t("Path to reindex"),
+            (path) => Indexer.reindex(idx.id, path || "/").then(() => {
+                notify.send(t("The index will be rebuilt"), "success");
+                refresh();
+            }).catch(onError),
+            () => {/* click on cancel */},
+        );
+    };
+    const onDelete = (idx) => {
+        prompt.now(
+            t("Confirm by typing") + " \"remove\"",
+            (answer) => {
+                if (answer !== "remove") {
+                    return Promise.resolve();
+                }
+                return Indexer.remove(idx.id).then(refresh).catch(onError);
+            },
+            () => {/* click on cancel */},
+        );
+    };
+
+    useEffect(() => {
+        refresh();
+        const id = setInterval(refresh, 5000);
+        return () => clearInterval(id);
+    }, []);
+
+    return (
+        <div className="component_searchpage sticky">
+            <h2>Search Indexers</h2>
+            {
+                error ? (
+                    <p className="error">{ error }</p>
+                ) : indexers === null ? (
+                    <Loader />
+                ) : indexers.length === 0 ? (
+                    <p className="nothing">{ t("There's no index yet") }</p>
+                ) : (
+                    <table>
+                        <thead>
+                            <tr>
+                                <th>backend</th>
+                                <th>phase</th>
+                                <th>files</th>
+                                <th>queue</th>
+                                <th>size</th>
+                                <th>last error</th>
+                                <th></th>
+                            </tr>
+                        </thead>
+                        <tbody>
+                            {
+                                indexers.map((idx) => (
+                                    <tr key={idx.id}>
+                                        <td title={idx.id}>
+                                            { idx.backend || idx.id.substring(0, 8) }
+                                        </td>
+                                        <td>{ displayPhase(idx) }</td>
+                                        <td>{ idx.files_indexed } / { idx.files }</td>
+                                        <td>{ idx.queue_size }</td>
+                                        <td>{ displaySize(idx.db_size) }</td>
+                                        <td className="last_error">{ idx.last_error }</td>
+                                        <td className="actions">
+                                            {
+                                                idx.loaded && (
+                                                    <React.Fragment>
+                                                        <Button onClick={() => onPause(idx)}>
+                                                            { idx.paused ? t("resume") : t("pause") }
+                                                        </Button>
+                                                        <Button onClick={() => onReindex(idx)}>
+                                                            { t("reindex") }
+                                                        </Button>
+                                                    </React.Fragment>
+                                                )
+                                            }
+                                            <Button onClick={() => onDelete(idx)}>
+                                                { t("delete") }
+                                            </Button>
+                                        </td>
+                                    </tr>
+                                ))
+                            }
+                        </tbody>
+                    </table>
+                )
+            }
+        </div>
+    );
+}
+
+function displayPhase(idx) {
+    if (idx.loaded === false) return "idle";
+    else if (idx.paused) return "paused";
+    switch (idx.phase) {
+    case "PHASE_EXPLORE": return "exploring";
+    case "PHASE_INDEXING": return "indexing";
+    case "PHASE_MAINTAIN": return "maintaining";
+    default: return "waiting";
+    }
+}
+
+function displaySize(bytes) {
+    if (Number.isNaN(bytes) || bytes < 0) return "";
+    else if (bytes < 1024) return bytes + "B";
+    else if (bytes < 1048576) return Math.round(bytes / 1024 * 10) / 10 + "KB";
+    else if (bytes < 1073741824) return Math.round(bytes / (1024 * 1024) * 10) / 10 + "MB";
+    return Math.round(bytes / (1024 * 1024 * 1024) * 10) / 10 + "GB";
+}
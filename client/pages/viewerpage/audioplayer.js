@@ -36,7 +36,10 @@ export function AudioPlayer({ filename, data }) {
         });
         window.wavesurfer = {};
 
-        wavesurfer.current.load(data);
+        if (!window.overrides["audio-map-source"]) {
+            window.overrides["audio-map-source"] = (s) => (s);
+        }
+        wavesurfer.current.load(window.overrides["audio-map-source"](data, filename));
         wavesurfer.current.on("ready", () => {
             setPurcentLoading(100);
             setIsLoading(false);
@@ -11,7 +11,6 @@ require (
 	github.com/gorilla/websocket v1.4.1
 	github.com/h2non/bimg v1.1.5
 	github.com/hirochachacha/go-smb2 v1.1.0
-	github.com/mattn/go-sqlite3 v1.14.18
 	github.com/mickael-kerjean/net v0.0.0-20191120063050-2457c043ba06
 	github.com/mitchellh/hashstructure v1.0.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
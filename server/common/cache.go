@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/mitchellh/hashstructure"
 	"github.com/patrickmn/go-cache"
+	"os"
+	"sort"
 	"sync"
 	"time"
 )
@@ -103,3 +105,91 @@ func (this *KeyValueStore) Clear() {
 	this.cache = make(map[string]interface{})
 	this.Unlock()
 }
+
+// ============================================================================
+
+/*
+ * DiskCache keeps generated files around (thumbnails, transcoded media, ...), in a folder of their
+ * own which survives restarts. The modification time of a file is when it was last used, once the
+ * folder grows past its limit the files used the least recently are removed until we're back to 80%
+ * of it
+ */
+type DiskCache struct {
+	path  string
+	limit func() int
+	mu    sync.Mutex
+	size  int64
+}
+
+// NewDiskCache creates a cache living in the given folder, limit gives its maximum size in MB
+func NewDiskCache(path string, limit func() int) *DiskCache {
+	return &DiskCache{path: path, limit: limit, size: -1}
+}
+
+func (this *DiskCache) Path(name string) string {
+	return GetAbsolutePath(this.path, name)
+}
+
+func (this *DiskCache) Get(name string) (*os.File, bool) {
+	p := this.Path(name)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return f, true
+}
+
+// Put moves a file that was just generated in the cache, it is left where it is when that fails
+func (this *DiskCache) Put(name string, tmp string) error {
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	} else if err = os.Rename(tmp, this.Path(name)); err != nil {
+		return err
+	}
+	go this.add(info.Size())
+	return nil
+}
+
+func (this *DiskCache) add(n int64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	limit := int64(this.limit()) * 1024 * 1024
+	if this.size < 0 {
+		this.size = 0
+		this.walk(func(f os.FileInfo) { this.size += f.Size() })
+	} else {
+		this.size += n
+	}
+	if this.size <= limit {
+		return
+	}
+
+	files := []os.FileInfo{}
+	this.walk(func(f os.FileInfo) { files = append(files, f) })
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, f := range files {
+		if this.size <= limit*8/10 {
+			break
+		} else if err := os.Remove(this.Path(f.Name())); err != nil {
+			continue
+		}
+		this.size -= f.Size()
+	}
+}
+
+func (this *DiskCache) walk(fn func(os.FileInfo)) {
+	entries, err := os.ReadDir(GetAbsolutePath(this.path))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && entry.IsDir() == false {
+			fn(info)
+		}
+	}
+}
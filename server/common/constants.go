@@ -14,6 +14,8 @@ const (
 	FTS_PATH          = "data/state/search/"
 	CERT_PATH         = "data/state/certs/"
 	TMP_PATH          = "data/cache/tmp/"
+	THUMBNAIL_PATH    = "data/cache/thumbnail/"
+	EXPORT_PATH       = "data/cache/export/"
 	COOKIE_NAME_AUTH  = "auth"
 	COOKIE_NAME_PROOF = "proof"
 	COOKIE_NAME_ADMIN = "admin"
@@ -27,6 +29,8 @@ func init() {
 	os.MkdirAll(filepath.Join(GetCurrentDir(), FTS_PATH), os.ModePerm)
 	os.RemoveAll(filepath.Join(GetCurrentDir(), TMP_PATH))
 	os.MkdirAll(filepath.Join(GetCurrentDir(), TMP_PATH), os.ModePerm)
+	os.MkdirAll(filepath.Join(GetCurrentDir(), THUMBNAIL_PATH), os.ModePerm)
+	os.MkdirAll(filepath.Join(GetCurrentDir(), EXPORT_PATH), os.ModePerm)
 }
 
 var (
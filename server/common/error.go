@@ -29,6 +29,8 @@ var (
 	ErrCongestion           = NewError("Traffic congestion, try again later", 500)
 	ErrTimeout              = NewError("Timeout", 500)
 	ErrInternal             = NewError("Internal Error", 500)
+	ErrInsufficientStorage  = NewError("Insufficient Storage", 507)
+	ErrPreconditionFailed   = NewError("Precondition Failed", 412)
 )
 
 func IsATranslatedError(err error) bool {
@@ -36,7 +38,8 @@ func IsATranslatedError(err error) bool {
 		err == ErrNotValid || err == ErrInvalidPassword || err == ErrNotImplemented ||
 		err == ErrNotSupported || err == ErrFilesystemError || err == ErrMissingDependency ||
 		err == ErrNotAuthorized || err == ErrAuthenticationFailed || err == ErrCongestion ||
-		err == ErrTimeout || err == ErrInternal {
+		err == ErrTimeout || err == ErrInternal || err == ErrInsufficientStorage ||
+		err == ErrPreconditionFailed {
 		return true
 	}
 	return false
@@ -88,6 +91,10 @@ func HTTPError(err error) AppError {
 		return ErrTimeout
 	case "Internal Error":
 		return ErrInternal
+	case "Insufficient Storage":
+		return ErrInsufficientStorage
+	case "Precondition Failed":
+		return ErrPreconditionFailed
 	default:
 		return NewError(err.Error(), http.StatusBadRequest)
 	}
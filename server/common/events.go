@@ -0,0 +1,85 @@
+package common
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	EVENT_FILE_SAVE    = "file.save"
+	EVENT_FILE_TOUCH   = "file.touch"
+	EVENT_FILE_MKDIR   = "file.mkdir"
+	EVENT_FILE_MV      = "file.mv"
+	EVENT_FILE_RM      = "file.rm"
+	EVENT_SHARE_CREATE = "share.create"
+	EVENT_SHARE_ACCESS = "share.access"
+)
+
+/*
+ * Event is what gets broadcasted to the listeners registered with Hooks.Register.OnEvent
+ * whenever something changes through filestash. Paths are the ones the user sees, with the chroot
+ * of their session taken out, as that's what leaves the server. The App gives listeners a way to
+ * reach the storage the event is about, StoragePath gives where a path lives on it
+ */
+type Event struct {
+	Type    string    `json:"type"`
+	Path    string    `json:"path"`
+	To      string    `json:"to,omitempty"`
+	Backend string    `json:"backend,omitempty"`
+	Session string    `json:"session,omitempty"`
+	Share   string    `json:"share,omitempty"`
+	Date    time.Time `json:"date"`
+	App     *App      `json:"-"`
+}
+
+func EmitEvent(e Event) {
+	listeners := Hooks.Get.OnEvent()
+	if len(listeners) == 0 {
+		return
+	}
+	e.Date = time.Now()
+	if e.App != nil {
+		// listeners run after the request is over, they get their own copy of what they might need
+		app := App{
+			Backend:       e.App.Backend,
+			Session:       make(map[string]string, len(e.App.Session)),
+			Share:         e.App.Share,
+			Context:       e.App.Context,
+			Authorization: e.App.Authorization,
+		}
+		for key, value := range e.App.Session {
+			app.Session[key] = value
+		}
+		e.App = &app
+		if app.Session["type"] != "" {
+			e.Backend = app.Session["type"]
+			e.Session = GenerateID(&app)
+		}
+		if e.Share == "" {
+			e.Share = app.Share.Id
+		}
+		e.Path = eventChroot(app.Session["path"], e.Path)
+		if e.To != "" {
+			e.To = eventChroot(app.Session["path"], e.To)
+		}
+	}
+	for _, fn := range listeners {
+		go fn(e)
+	}
+}
+
+// StoragePath gives where a path of the event lives on the storage, chroot included
+func (this Event) StoragePath(path string) string {
+	if this.App == nil {
+		return path
+	}
+	return strings.TrimSuffix(this.App.Session["path"], "/") + path
+}
+
+func eventChroot(chroot string, path string) string {
+	chroot = strings.TrimSuffix(chroot, "/")
+	if chroot == "" || strings.HasPrefix(path, chroot+"/") == false {
+		return path
+	}
+	return strings.TrimPrefix(path, chroot)
+}
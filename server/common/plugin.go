@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/fs"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strings"
 )
@@ -41,6 +42,87 @@ func (this Get) ProcessFileContentBeforeSend() []func(io.ReadCloser, *App, *http
 	return process_file_content_before_send
 }
 
+/*
+ * ProcessFileContentBeforeSave is the upload counterpart of ProcessFileContentBeforeSend. It is called
+ * with the path of the file being created and can either rewrite the stream or reject it by returning
+ * an error, eg:
+ * 1. virus scanning
+ * 2. validate the content type of what is being uploaded
+ * 3. block executable from being stored
+ */
+var process_file_content_before_save []func(io.Reader, *App, string) (io.Reader, error)
+
+func (this Register) ProcessFileContentBeforeSave(fn func(io.Reader, *App, string) (io.Reader, error)) {
+	process_file_content_before_save = append(process_file_content_before_save, fn)
+}
+func (this Get) ProcessFileContentBeforeSave() []func(io.Reader, *App, string) (io.Reader, error) {
+	return process_file_content_before_save
+}
+
+/*
+ * OnEvent is a hook to get notified of what's happening on the storage (files being created,
+ * moved, removed, shared links being created, ...). It is used in plugins like:
+ * 1. plg_handler_webhook to notify external services
+ * Listeners are called asynchronously, see EmitEvent
+ */
+var on_event []func(Event)
+
+func (this Register) OnEvent(fn func(Event)) {
+	on_event = append(on_event, fn)
+}
+func (this Get) OnEvent() []func(Event) {
+	return on_event
+}
+
+/*
+ * ContentExtractor converts a document into plain text for full text search purposes. The
+ * extractors that ship by default live in model/formater, others can be added by plugins
+ */
+var content_extractor map[string]func(io.ReadCloser) (io.ReadCloser, error) = make(map[string]func(io.ReadCloser) (io.ReadCloser, error))
+
+func (this Register) ContentExtractor(mType string, fn func(io.ReadCloser) (io.ReadCloser, error)) {
+	content_extractor[mType] = fn
+}
+func (this Get) ContentExtractor() map[string]func(io.ReadCloser) (io.ReadCloser, error) {
+	return content_extractor
+}
+
+/*
+ * MetadataExtractor reads what can be known about a media file: when and where a photo was taken,
+ * the camera, the duration of a video, the tags of a song, ... The pure Go extractors that ship by
+ * default live in model/metadata, plugins can add more or replace those
+ */
+var metadata_extractor map[string]func(io.Reader, *MediaMetadata) error = make(map[string]func(io.Reader, *MediaMetadata) error)
+
+func (this Register) MetadataExtractor(mType string, fn func(io.Reader, *MediaMetadata) error) {
+	metadata_extractor[mType] = fn
+}
+func (this Get) MetadataExtractor() map[string]func(io.Reader, *MediaMetadata) error {
+	return metadata_extractor
+}
+
+/*
+ * Converter turns a file from a mime type into another, it's what /api/export/{share}/{from}/{to}
+ * serves. The source can be a whole family like "image/*". Options are what came in the query
+ * string, eg: ?mode=beamer. The converters that ship by default live in model/converter
+ */
+var converter map[string]map[string]func(*App, io.Reader, io.Writer, url.Values) error = make(map[string]map[string]func(*App, io.Reader, io.Writer, url.Values) error)
+
+func (this Register) Converter(fromMime string, toMime string, fn func(*App, io.Reader, io.Writer, url.Values) error) {
+	if converter[fromMime] == nil {
+		converter[fromMime] = make(map[string]func(*App, io.Reader, io.Writer, url.Values) error)
+	}
+	converter[fromMime][toMime] = fn
+}
+func (this Get) Converter(fromMime string, toMime string) func(*App, io.Reader, io.Writer, url.Values) error {
+	if fn, ok := converter[fromMime][toMime]; ok {
+		return fn
+	} else if fn, ok := converter[strings.SplitN(fromMime, "/", 2)[0]+"/*"][toMime]; ok {
+		return fn
+	}
+	return nil
+}
+
 /*
  * HttpEndpoint is a hook that makes it possible to register new endpoint in the application.
  * It is used in plugin like:
@@ -104,6 +186,20 @@ func (this Get) Starter() []func(*mux.Router) {
 	return starter_process
 }
 
+/*
+ * BackendMiddleware makes it possible to decorate the storage a user is connected to. It
+ * is applied right after a backend gets initialised and is used in plugins like:
+ * - plg_backend_cache to keep a local copy of what lives on slow remote storages
+ */
+var backend_middleware []func(IBackend, map[string]string, *App) IBackend
+
+func (this Register) BackendMiddleware(fn func(IBackend, map[string]string, *App) IBackend) {
+	backend_middleware = append(backend_middleware, fn)
+}
+func (this Get) BackendMiddleware() []func(IBackend, map[string]string, *App) IBackend {
+	return backend_middleware
+}
+
 /*
  * AuthenticationMiddleware is what enabled us to authenticate user via different means:
  * - plg_authentication_admin to enable connection to an admin
@@ -139,7 +235,7 @@ func (this Get) AuthorisationMiddleware() []IAuthorisation {
 /*
  * Search is the pluggable search mechanism. By default, there's 2 options:
  * - plg_search_stateless which does stateless search based on filename only
- * - plg_search_statefull which does full text search with a sqlite data store
+ * - plg_search_sqlitefts which does full text search with a sqlite data store (pure go, no cgo)
  * The idea here is to enable different type of usage like leveraging elastic search or solr
  * with custom stuff around it
  */
@@ -223,6 +319,7 @@ func (this Get) CSS() string {
 }
 
 const OverrideVideoSourceMapper = "/overrides/video-transcoder.js"
+const OverrideAudioSourceMapper = "/overrides/audio-transcoder.js"
 
 var afterload []func()
 
@@ -235,4 +332,5 @@ func (this Get) Onload() []func() {
 
 func init() {
 	Hooks.Register.FrontendOverrides(OverrideVideoSourceMapper)
+	Hooks.Register.FrontendOverrides(OverrideAudioSourceMapper)
 }
@@ -0,0 +1,357 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ * SearchQuery is the parsed form of what users type in the search bar, eg:
+ *   report type:pdf size>10MB modified:2024-01..2024-06 path:/finance -draft
+ *   (invoice OR receipt) AND NOT name:"old.pdf"
+ * Search engines translate it in whatever makes sense for them: sql for the full text
+ * search engine, a filter applied on every file for the stateless engine
+ */
+type SearchQuery struct {
+	Op       string // one of: "and", "or", "not", "term"
+	Children []*SearchQuery
+	Field    string // empty for free text, otherwise one of: "type", "size", "modified", "path", "name"
+	Cmp      string // ":", "=", ">", ">=", "<", "<="
+	Value    string
+	Exact    bool // the value was quoted
+	Size     int64
+	From     time.Time // dates are a [From, To) interval
+	To       time.Time
+}
+
+const (
+	SEARCH_OP_AND  = "and"
+	SEARCH_OP_OR   = "or"
+	SEARCH_OP_NOT  = "not"
+	SEARCH_OP_TERM = "term"
+)
+
+// NewSearchQuery parses a query, making sure the path filters stay within the chroot of the user
+func NewSearchQuery(app *App, str string) (*SearchQuery, error) {
+	q, err := ParseSearchQuery(str)
+	if err != nil {
+		return nil, err
+	}
+	chroot := app.Session["path"]
+	q.Walk(func(n *SearchQuery) {
+		if n.Field != "path" {
+			return
+		}
+		// path filters are about folders, "path:/reports" shouldn't match "/reports_old/"
+		n.Value = strings.TrimSuffix(filepath.ToSlash(filepath.Join("/", chroot, n.Value)), "/") + "/"
+	})
+	return q, nil
+}
+
+func ParseSearchQuery(str string) (*SearchQuery, error) {
+	p := &searchParser{tokens: searchTokenize(str)}
+	if len(p.tokens) == 0 {
+		return &SearchQuery{Op: SEARCH_OP_AND}, nil
+	}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	} else if p.pos < len(p.tokens) {
+		return nil, NewError(fmt.Sprintf("Invalid query near '%s'", p.tokens[p.pos].value), 400)
+	}
+	return q, nil
+}
+
+// Walk visits every node of the query
+func (this *SearchQuery) Walk(fn func(*SearchQuery)) {
+	fn(this)
+	for _, c := range this.Children {
+		c.Walk(fn)
+	}
+}
+
+// Terms gives back the free text part of the query that aren't negated
+func (this *SearchQuery) Terms() []string {
+	terms := []string{}
+	switch this.Op {
+	case SEARCH_OP_NOT:
+		return terms
+	case SEARCH_OP_TERM:
+		if this.Field == "" {
+			terms = append(terms, this.Value)
+		}
+	}
+	for _, c := range this.Children {
+		terms = append(terms, c.Terms()...)
+	}
+	return terms
+}
+
+// Match evaluates the query against a file, the text function decides how free text is handled
+func (this *SearchQuery) Match(f os.FileInfo, path string, text func(term string) bool) bool {
+	switch this.Op {
+	case SEARCH_OP_AND:
+		for _, c := range this.Children {
+			if c.Match(f, path, text) == false {
+				return false
+			}
+		}
+		return true
+	case SEARCH_OP_OR:
+		for _, c := range this.Children {
+			if c.Match(f, path, text) {
+				return true
+			}
+		}
+		return false
+	case SEARCH_OP_NOT:
+		return this.Children[0].Match(f, path, text) == false
+	}
+
+	switch this.Field {
+	case "":
+		return text(this.Value)
+	case "type":
+		if this.Value == "directory" || this.Value == "folder" {
+			return f.IsDir()
+		} else if this.Value == "file" {
+			return f.IsDir() == false
+		}
+		return f.IsDir() == false && strings.ToLower(strings.TrimPrefix(filepath.Ext(f.Name()), ".")) == this.Value
+	case "name":
+		if this.Exact {
+			return strings.ToLower(f.Name()) == strings.ToLower(this.Value)
+		}
+		return strings.Contains(strings.ToLower(f.Name()), strings.ToLower(this.Value))
+	case "path":
+		return strings.HasPrefix(path, this.Value)
+	case "size":
+		switch this.Cmp {
+		case ">":
+			return f.Size() > this.Size
+		case ">=":
+			return f.Size() >= this.Size
+		case "<":
+			return f.Size() < this.Size
+		case "<=":
+			return f.Size() <= this.Size
+		}
+		return f.Size() == this.Size
+	case "modified":
+		t := f.ModTime()
+		switch this.Cmp {
+		case ">":
+			return t.Before(this.To) == false
+		case ">=":
+			return t.Before(this.From) == false
+		case "<":
+			return t.Before(this.From)
+		case "<=":
+			return t.Before(this.To)
+		}
+		return t.Before(this.From) == false && t.Before(this.To)
+	}
+	return false
+}
+
+type searchToken struct {
+	value  string
+	quoted bool
+}
+
+func searchTokenize(str string) []searchToken {
+	tokens := []searchToken{}
+	runes := []rune(str)
+	for i := 0; i < len(runes); {
+		switch c := runes[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, searchToken{value: string(c)})
+			i++
+		default:
+			var tok strings.Builder
+			quoted := false
+			for i < len(runes) && runes[i] != ' ' && runes[i] != '\t' && runes[i] != '\n' {
+				if runes[i] == ')' || (runes[i] == '(' && tok.Len() > 0) {
+					break
+				} else if runes[i] == '"' {
+					quoted = true
+					i++
+					for i < len(runes) && runes[i] != '"' {
+						tok.WriteRune(runes[i])
+						i++
+					}
+					i++
+					continue
+				}
+				tok.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, searchToken{value: tok.String(), quoted: quoted})
+		}
+	}
+	return tokens
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+}
+
+func (this *searchParser) peek() (searchToken, bool) {
+	if this.pos >= len(this.tokens) {
+		return searchToken{}, false
+	}
+	return this.tokens[this.pos], true
+}
+
+func (this *searchParser) parseOr() (*SearchQuery, error) {
+	left, err := this.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []*SearchQuery{left}
+	for {
+		t, ok := this.peek()
+		if ok == false || t.quoted || t.value != "OR" {
+			break
+		}
+		this.pos++
+		right, err := this.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	if len(children) == 1 {
+		return left, nil
+	}
+	return &SearchQuery{Op: SEARCH_OP_OR, Children: children}, nil
+}
+
+func (this *searchParser) parseAnd() (*SearchQuery, error) {
+	children := []*SearchQuery{}
+	for {
+		t, ok := this.peek()
+		if ok == false || (t.quoted == false && (t.value == "OR" || t.value == ")")) {
+			break
+		} else if t.quoted == false && t.value == "AND" {
+			this.pos++
+			continue
+		}
+		q, err := this.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, q)
+	}
+	if len(children) == 0 {
+		return nil, NewError("Invalid query: missing search term", 400)
+	} else if len(children) == 1 {
+		return children[0], nil
+	}
+	return &SearchQuery{Op: SEARCH_OP_AND, Children: children}, nil
+}
+
+func (this *searchParser) parseUnary() (*SearchQuery, error) {
+	t, ok := this.peek()
+	if ok == false {
+		return nil, NewError("Invalid query: missing search term", 400)
+	} else if t.quoted == false && t.value == "NOT" {
+		this.pos++
+		q, err := this.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &SearchQuery{Op: SEARCH_OP_NOT, Children: []*SearchQuery{q}}, nil
+	} else if t.quoted == false && t.value == "(" {
+		this.pos++
+		q, err := this.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := this.peek(); ok == false || t.value != ")" {
+			return nil, NewError("Invalid query: missing closing parenthesis", 400)
+		}
+		this.pos++
+		return q, nil
+	} else if t.quoted == false && strings.HasPrefix(t.value, "-") && len(t.value) > 1 {
+		this.tokens[this.pos].value = strings.TrimPrefix(t.value, "-")
+		q, err := this.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &SearchQuery{Op: SEARCH_OP_NOT, Children: []*SearchQuery{q}}, nil
+	}
+	this.pos++
+	return parseSearchTerm(t)
+}
+
+func parseSearchTerm(t searchToken) (*SearchQuery, error) {
+	q := &SearchQuery{Op: SEARCH_OP_TERM, Value: t.value, Exact: t.quoted}
+	for _, field := range []string{"type", "size", "modified", "path", "name"} {
+		if strings.HasPrefix(t.value, field) == false {
+			continue
+		}
+		rest := strings.TrimPrefix(t.value, field)
+		for _, cmp := range []string{">=", "<=", ":", "=", ">", "<"} {
+			if strings.HasPrefix(rest, cmp) {
+				q.Field = field
+				q.Cmp = cmp
+				q.Value = strings.TrimPrefix(rest, cmp)
+				break
+			}
+		}
+		if q.Field != "" {
+			break
+		}
+	}
+	if q.Field != "" && q.Value == "" {
+		return nil, NewError(fmt.Sprintf("Invalid query: missing value for '%s'", q.Field), 400)
+	}
+
+	switch q.Field {
+	case "type":
+		q.Value = strings.ToLower(strings.TrimPrefix(q.Value, "."))
+	case "size":
+		if q.Size = ParseSize(q.Value); q.Size < 0 {
+			return nil, NewError(fmt.Sprintf("Invalid size '%s'", q.Value), 400)
+		}
+	case "modified":
+		from, to, ok := strings.Cut(q.Value, "..")
+		if ok == false {
+			to = from
+		}
+		var err error
+		if q.From, _, err = parseSearchDate(from); err != nil {
+			return nil, err
+		}
+		if _, q.To, err = parseSearchDate(to); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// parseSearchDate gives the period covered by a date: a year, a month or a day
+func parseSearchDate(str string) (time.Time, time.Time, error) {
+	for _, layout := range []struct {
+		format string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006-01-02", 0, 0, 1},
+		{"2006-01", 0, 1, 0},
+		{"2006", 1, 0, 0},
+	} {
+		if t, err := time.ParseInLocation(layout.format, str, time.Local); err == nil {
+			return t, t.AddDate(layout.years, layout.months, layout.days), nil
+		}
+	}
+	return time.Time{}, time.Time{}, NewError(fmt.Sprintf("Invalid date '%s'", str), 400)
+}
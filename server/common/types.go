@@ -75,6 +75,10 @@ type File struct {
 	CanRename *bool  `json:"can_rename,omitempty"`
 	CanMove   *bool  `json:"can_move_directory,omitempty"`
 	CanDelete *bool  `json:"can_delete,omitempty"`
+	// full text search results: an extract of the content with the position of the matching terms
+	// given as [start, end) offsets counted in characters
+	Snippet string  `json:"snippet,omitempty"`
+	Matches [][]int `json:"matches,omitempty"`
 }
 
 func (f File) Name() string {
@@ -120,9 +124,43 @@ type Metadata struct {
 	CanShare           *bool      `json:"can_share,omitempty"`
 	HideExtension      *bool      `json:"hide_extension,omitempty"`
 	RefreshOnCreate    *bool      `json:"refresh_on_create,omitempty"`
+	QuotaUsed          *int64     `json:"quota_used,omitempty"`
+	QuotaLimit         *int64     `json:"quota_limit,omitempty"`
 	Expire             *time.Time `json:"-"`
 }
 
+/*
+ * MediaMetadata is what we know about a photo, a song or a video regardless of where it comes
+ * from: EXIF, XMP, ID3, Vorbis comments, ffprobe, ... Dates are given in UTC unless the file
+ * tells us otherwise
+ */
+type MediaMetadata struct {
+	Mime         string            `json:"mime"`
+	Width        int               `json:"width,omitempty"`
+	Height       int               `json:"height,omitempty"`
+	Orientation  int               `json:"orientation,omitempty"`
+	CaptureDate  *time.Time        `json:"capture_date,omitempty"`
+	Make         string            `json:"make,omitempty"`
+	Model        string            `json:"model,omitempty"`
+	Lens         string            `json:"lens,omitempty"`
+	ExposureTime string            `json:"exposure_time,omitempty"`
+	FNumber      float64           `json:"f_number,omitempty"`
+	ISO          int               `json:"iso,omitempty"`
+	FocalLength  float64           `json:"focal_length,omitempty"`
+	Latitude     *float64          `json:"latitude,omitempty"`
+	Longitude    *float64          `json:"longitude,omitempty"`
+	Altitude     *float64          `json:"altitude,omitempty"`
+	Duration     float64           `json:"duration,omitempty"`
+	Format       string            `json:"format,omitempty"`
+	VideoCodec   string            `json:"video_codec,omitempty"`
+	AudioCodec   string            `json:"audio_codec,omitempty"`
+	BitRate      int               `json:"bit_rate,omitempty"`
+	SampleRate   int               `json:"sample_rate,omitempty"`
+	Channels     int               `json:"channels,omitempty"`
+	Cover        bool              `json:"cover,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
 const PASSWORD_DUMMY = "{{PASSWORD}}"
 
 type Share struct {
@@ -139,6 +177,7 @@ type Share struct {
 	CanRead      bool    `json:"can_read"`
 	CanWrite     bool    `json:"can_write"`
 	CanUpload    bool    `json:"can_upload"`
+	Quota        *int64  `json:"quota,omitempty"`
 }
 
 func (s Share) IsValid() error {
@@ -171,6 +210,7 @@ func (s *Share) MarshalJSON() ([]byte, error) {
 		s.CanRead,
 		s.CanWrite,
 		s.CanUpload,
+		s.Quota,
 	}
 	return json.Marshal(p)
 }
@@ -199,6 +239,8 @@ func (s *Share) UnmarshallJSON(b []byte) error {
 			s.CanWrite = NewBoolFromInterface(value)
 		case "can_upload":
 			s.CanUpload = NewBoolFromInterface(value)
+		case "quota":
+			s.Quota = NewInt64pFromInterface(value)
 		}
 	}
 	return nil
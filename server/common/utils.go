@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"strconv"
+	"strings"
 )
 
 func NewBool(t bool) *bool {
@@ -91,3 +92,30 @@ func CookieName(idx int) string {
 	}
 	return COOKIE_NAME_AUTH + strconv.Itoa(idx)
 }
+
+// ParseSize converts sizes like "500MB" or "10GB" in bytes, -1 when there's nothing usable
+func ParseSize(str string) int64 {
+	str = strings.ToUpper(strings.TrimSpace(str))
+	if str == "" {
+		return -1
+	}
+	var unit int64 = 1
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	} {
+		if strings.HasSuffix(str, u.suffix) {
+			unit = u.size
+			str = strings.TrimSpace(strings.TrimSuffix(str, u.suffix))
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return int64(n * float64(unit))
+}
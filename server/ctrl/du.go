@@ -0,0 +1,53 @@
+package ctrl
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+)
+
+/*
+ * FileDiskUsage tells what takes space under a folder. Walking through a storage can take a while,
+ * the first calls give back the progress of the job doing the walk until the tree is available:
+ *   GET /api/files/du?path=/&depth=2           => {"status": "running", "progress": {...}}
+ *   GET /api/files/du?path=/&depth=2           => {"status": "done", "result": {"size": ..., "children": [...]}}
+ *   GET /api/files/du?path=/&refresh=true      => walk through the storage again
+ */
+func FileDiskUsage(ctx *App, res http.ResponseWriter, req *http.Request) {
+	if model.CanRead(ctx) == false {
+		Log.Debug("du::permission 'permission denied'")
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
+	if err != nil {
+		path, _ = PathBuilder(ctx, "/")
+	}
+	if path[len(path)-1:] != "/" {
+		path += "/"
+	}
+	depth, err := strconv.Atoi(req.URL.Query().Get("depth"))
+	if err != nil || depth < 0 {
+		depth = 1
+	}
+
+	job := model.DiskUsageGet(ctx, path, req.URL.Query().Get("refresh") == "true")
+	var result interface{}
+	if v, done := job.Value(); done {
+		node := v.(*model.DiskUsage).Find(path)
+		if node == nil {
+			SendErrorResult(res, ErrNotFound)
+			return
+		}
+		result = node.Prune(depth, ctx.Session["path"])
+	}
+	b, err := job.MarshalJSONWithResult(result)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, json.RawMessage(b))
+}
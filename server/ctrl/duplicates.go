@@ -0,0 +1,212 @@
+package ctrl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+)
+
+const JOB_DUPLICATES = "duplicates"
+
+/*
+ * The duplicate finder runs as a job as it has to go through the entire storage:
+ * - POST   /api/files/duplicates?path=/         => start looking for duplicates
+ * - GET    /api/files/duplicates/{id}           => progress and, once done, groups of identical files
+ * - DELETE /api/files/duplicates/{id}           => stop the job
+ * - POST   /api/files/duplicates/{id}/resolve   => delete or replace duplicates found by the job
+ */
+func DuplicatesStart(ctx *App, res http.ResponseWriter, req *http.Request) {
+	if model.CanRead(ctx) == false {
+		Log.Debug("duplicates::permission 'permission denied'")
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
+	if err != nil {
+		path, _ = PathBuilder(ctx, "/")
+	}
+	job := model.NewJob(ctx, JOB_DUPLICATES, func(app *App, job *model.Job) (interface{}, error) {
+		groups, err := model.FindDuplicates(app, job, path)
+		if err != nil {
+			return nil, err
+		}
+		// paths are given back relative to the chroot of the user
+		if chroot := app.Session["path"]; chroot != "" {
+			for i := range groups {
+				for j := range groups[i].Files {
+					groups[i].Files[j] = "/" + strings.TrimPrefix(groups[i].Files[j], chroot)
+				}
+			}
+		}
+		return groups, nil
+	})
+	SendSuccessResult(res, job)
+}
+
+func DuplicatesStatus(ctx *App, res http.ResponseWriter, req *http.Request) {
+	job, err := duplicatesJob(ctx, req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResultWithEtagAndGzip(res, req, job)
+}
+
+func DuplicatesCancel(ctx *App, res http.ResponseWriter, req *http.Request) {
+	job, err := duplicatesJob(ctx, req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	job.Cancel()
+	SendSuccessResult(res, job)
+}
+
+type duplicatesResolveRequest struct {
+	Action string `json:"action"` // "delete" or "replace"
+	Groups []struct {
+		Keep   string   `json:"keep"`
+		Remove []string `json:"remove"`
+	} `json:"groups"`
+}
+
+type duplicatesResolveResult struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+/*
+ * DuplicatesResolve gets rid of the duplicates users have picked in a group. We only touch files
+ * the job found to be identical to the one users want to keep, either:
+ * - delete: the duplicate is removed
+ * - replace: the duplicate is replaced by a shortcut to the file we keep
+ */
+func DuplicatesResolve(ctx *App, res http.ResponseWriter, req *http.Request) {
+	if model.CanEdit(ctx) == false {
+		Log.Debug("duplicates::resolve 'permission denied'")
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	job, err := duplicatesJob(ctx, req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	if _, done := job.Value(); done == false {
+		SendErrorResult(res, NewError("The search for duplicates isn't completed", 409))
+		return
+	}
+	var body duplicatesResolveRequest
+	if b, err := json.Marshal(ctx.Body); err != nil || json.Unmarshal(b, &body) != nil {
+		SendErrorResult(res, NewError("Invalid request", 400))
+		return
+	} else if body.Action != "delete" && body.Action != "replace" {
+		SendErrorResult(res, NewError("Unknown action", 400))
+		return
+	} else if body.Action == "replace" && model.CanUpload(ctx) == false {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+
+	results := []duplicatesResolveResult{}
+	for _, g := range body.Groups {
+		for _, r := range g.Remove {
+			// the duplicate is taken out of the result first so the copy we keep can't be
+			// removed in turn later on
+			found := false
+			job.Update(func(result interface{}) {
+				found = duplicatesTakeOut(result.([]model.DuplicateGroup), g.Keep, r)
+			})
+			if found == false {
+				results = append(results, duplicatesResolveResult{r, "error", "not a duplicate"})
+				continue
+			}
+			path, err := PathBuilder(ctx, r)
+			if err == nil {
+				err = duplicatesRemove(ctx, req, body.Action, g.Keep, path)
+			}
+			if err != nil {
+				Log.Debug("duplicates::resolve path[%s] err[%s]", r, err.Error())
+				results = append(results, duplicatesResolveResult{r, "error", err.Error()})
+				continue
+			}
+			results = append(results, duplicatesResolveResult{r, "ok", ""})
+		}
+	}
+	model.QuotaGet(ctx).Stale(ctx)
+	SendSuccessResults(res, results)
+}
+
+// duplicatesRemove deletes a duplicate, the file we keep is given relative to the chroot of the user
+func duplicatesRemove(ctx *App, req *http.Request, action string, keep string, path string) error {
+	shortcut := path + ".url"
+	for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+		if err := auth.Rm(ctx, path); err != nil {
+			return ErrNotAuthorized
+		}
+		if action != "replace" {
+			continue
+		} else if err := auth.Save(ctx, shortcut); err != nil {
+			return ErrNotAuthorized
+		}
+	}
+	if err := ctx.Backend.Rm(path); err != nil {
+		return err
+	}
+	EmitEvent(Event{Type: EVENT_FILE_RM, Path: path, App: ctx})
+	if action != "replace" {
+		return nil
+	}
+
+	link := "/files" + (&url.URL{Path: keep}).EscapedPath()
+	host := Config.Get("general.host").String()
+	if host == "" {
+		host = req.Host
+	}
+	scheme := "http"
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	content := fmt.Sprintf("[InternetShortcut]\r\nURL=%s://%s%s\r\n", scheme, host, link)
+	return model.FileSave(ctx, shortcut, strings.NewReader(content), int64(len(content)), "", "*")
+}
+
+// duplicatesTakeOut removes a file from the group it shares with the file we keep
+func duplicatesTakeOut(groups []model.DuplicateGroup, keep string, path string) bool {
+	if keep == path {
+		return false
+	}
+	for i := range groups {
+		hasKeep, at := false, -1
+		for j, f := range groups[i].Files {
+			if f == keep {
+				hasKeep = true
+			} else if f == path {
+				at = j
+			}
+		}
+		if hasKeep && at >= 0 {
+			groups[i].Files = append(groups[i].Files[:at], groups[i].Files[at+1:]...)
+			groups[i].Wasted = groups[i].Size * int64(len(groups[i].Files)-1)
+			return true
+		}
+	}
+	return false
+}
+
+func duplicatesJob(ctx *App, req *http.Request) (*model.Job, error) {
+	job, err := model.JobGet(ctx, mux.Vars(req)["id"])
+	if err != nil {
+		return nil, err
+	} else if job.Type != JOB_DUPLICATES {
+		return nil, ErrNotFound
+	}
+	return job, nil
+}
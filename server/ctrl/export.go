@@ -8,6 +8,7 @@ import (
 	"github.com/mickael-kerjean/filestash/server/model"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"runtime"
@@ -17,6 +18,25 @@ import (
 //go:generate sh -c "go run ../generator/emacs-el.go > export_generated.go && go fmt export_generated.go"
 var EmacsElConfig string = ""
 
+func init() {
+	// org mode documents are exported by emacs, the file it creates is named after the function used
+	for mType, export := range map[string][2]string{
+		"text/html":       {"org-html-export-to-html", "index.org.org"},
+		"application/pdf": {"org-latex-export-to-pdf", "index.pdf"},
+		"text/calendar":   {"org-icalendar-export-to-ics", "index.ics"},
+		"text/plain":      {"org-ascii-export-to-ascii", "index.txt"},
+		"text/x-latex":    {"org-latex-export-to-latex", "index.tex"},
+		"text/markdown":   {"org-md-export-to-markdown", "index.md"},
+		"application/vnd.oasis.opendocument.text": {"org-odt-export-to-odt", "index.odt"},
+	} {
+		Hooks.Register.Converter("text/org", mType, orgExport(export[0], export[1]))
+	}
+}
+
+/*
+ * FileExport gives a file converted to another format by one of the converters registered with
+ * Hooks.Register.Converter, eg: /api/export/private/application/pdf/notes.org
+ */
 func FileExport(ctx *App, res http.ResponseWriter, req *http.Request) {
 	http.SetCookie(res, &http.Cookie{
 		Name:   "download",
@@ -25,7 +45,6 @@ func FileExport(ctx *App, res http.ResponseWriter, req *http.Request) {
 		Path:   "/",
 	})
 	header := res.Header()
-	query := req.URL.Query()
 	p := mux.Vars(req)
 	mimeType := fmt.Sprintf("%s/%s", p["mtype0"], p["mtype1"])
 	path, err := PathBuilder(ctx, strings.Replace(req.URL.Path, fmt.Sprintf("/api/export/%s/%s/%s", p["share"], p["mtype0"], p["mtype1"]), "", 1))
@@ -36,16 +55,30 @@ func FileExport(ctx *App, res http.ResponseWriter, req *http.Request) {
 		SendErrorResult(res, ErrPermissionDenied)
 		return
 	}
+	options := req.URL.Query()
+	options.Del("share")
+
+	file, err := model.Export(ctx, path, mimeType, options)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	defer file.Close()
+	header.Set("Content-Type", mimeType)
+	header.Set("X-XSS-Protection", "1; mode=block")
+	if GetMimeType(path) == "text/org" {
+		header.Set("Content-Security-Policy", "script-src 'unsafe-inline' 'unsafe-eval' orgmode.org")
+	} else {
+		header.Set("Content-Security-Policy", "script-src 'none'")
+	}
+	io.Copy(res, file)
+}
 
-	var tmpPath string = GetAbsolutePath(TMP_PATH) + "/export_" + QuickString(10)
-	var cmd *exec.Cmd
-	var emacsPath string
-	var outPath string
-	reqMimeType := GetMimeType(path)
-	if reqMimeType == "text/org" {
-		if emacsPath, err = exec.LookPath("emacs"); err != nil {
-			SendErrorResult(res, ErrMissingDependency)
-			return
+func orgExport(fn string, outPath string) func(*App, io.Reader, io.Writer, url.Values) error {
+	return func(ctx *App, in io.Reader, out io.Writer, options url.Values) error {
+		emacsPath, err := exec.LookPath("emacs")
+		if err != nil {
+			return ErrMissingDependency
 		}
 		if runtime.GOOS == "darwin" {
 			// on OSX, the default emacs isn't usable so we default to the one provided by `brew`
@@ -61,126 +94,46 @@ func FileExport(ctx *App, res http.ResponseWriter, req *http.Request) {
 		// initialise the default emacs.el
 		if f, err := os.OpenFile(GetAbsolutePath(CONFIG_PATH+"emacs.el"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.ModePerm); err == nil {
 			if _, err = f.Write([]byte(EmacsElConfig)); err != nil {
-				SendErrorResult(res, ErrFilesystemError)
-				return
+				return ErrFilesystemError
 			}
 			if err = f.Close(); err != nil {
-				SendErrorResult(res, ErrFilesystemError)
-				return
+				return ErrFilesystemError
 			}
 		}
 
-		if mimeType == "text/html" {
-			cmd = exec.Command(
-				emacsPath, "--no-init-file", "--batch",
-				"--eval", "(setq org-html-extension \"org\")",
-				"--load", GetAbsolutePath(CONFIG_PATH+"emacs.el"),
-				tmpPath+"/index.org", "-f", "org-html-export-to-html",
-			)
-			outPath = "index.org.org"
-		} else if mimeType == "application/pdf" {
-			cmd = exec.Command(
-				emacsPath, "--no-init-file", "--batch",
-				"--load", GetAbsolutePath(CONFIG_PATH+"emacs.el"),
-				tmpPath+"/index.org", "-f", "org-latex-export-to-pdf",
-			)
-			if query.Get("mode") == "beamer" {
-				cmd = exec.Command(
-					emacsPath, "--no-init-file", "--batch",
-					"--load", GetAbsolutePath(CONFIG_PATH+"emacs.el"),
-					tmpPath+"/index.org", "-f", "org-beamer-export-to-pdf",
-				)
-			}
-			outPath = "index.pdf"
-		} else if mimeType == "text/calendar" {
-			cmd = exec.Command(
-				emacsPath, "--no-init-file", "--batch",
-				"--load", GetAbsolutePath(CONFIG_PATH+"emacs.el"),
-				tmpPath+"/index.org", "-f", "org-icalendar-export-to-ics",
-			)
-			outPath = "index.ics"
-		} else if mimeType == "text/plain" {
-			cmd = exec.Command(
-				emacsPath, "--no-init-file", "--batch",
-				"--load", GetAbsolutePath(CONFIG_PATH+"emacs.el"),
-				tmpPath+"/index.org", "-f", "org-ascii-export-to-ascii",
-			)
-			outPath = "index.txt"
-		} else if mimeType == "text/x-latex" {
-			cmd = exec.Command(
-				emacsPath, "--no-init-file", "--batch",
-				"--load", GetAbsolutePath(CONFIG_PATH+"emacs.el"),
-				tmpPath+"/index.org", "-f", "org-latex-export-to-latex",
-			)
-			outPath = "index.tex"
-		} else if mimeType == "text/markdown" {
-			cmd = exec.Command(
-				emacsPath, "--no-init-file", "--batch",
-				"--load", GetAbsolutePath(CONFIG_PATH+"emacs.el"),
-				tmpPath+"/index.org", "-f", "org-md-export-to-markdown",
-			)
-			outPath = "index.md"
-		} else if mimeType == "application/vnd.oasis.opendocument.text" {
-			cmd = exec.Command(
-				emacsPath, "--no-init-file", "--batch",
-				"--load", GetAbsolutePath(CONFIG_PATH+"emacs.el"),
-				tmpPath+"/index.org", "-f", "org-odt-export-to-odt",
-			)
-			outPath = "index.odt"
-		} else if mimeType == "text/org" {
-			outPath = "index.org"
-		} else {
-			SendErrorResult(res, ErrNotImplemented)
-			return
-		}
-
+		var tmpPath string = GetAbsolutePath(TMP_PATH) + "/export_" + QuickString(10)
 		os.MkdirAll(tmpPath, os.ModePerm)
 		defer os.RemoveAll(tmpPath)
 		f, err := os.OpenFile(tmpPath+"/index.org", os.O_WRONLY|os.O_CREATE, os.ModePerm)
 		if err != nil {
-			SendErrorResult(res, ErrFilesystemError)
-			return
-		}
-		file, err := ctx.Backend.Cat(path)
-		if err != nil {
-			SendErrorResult(res, err)
-			return
+			return ErrFilesystemError
 		}
-		io.Copy(f, file)
+		io.Copy(f, in)
+		f.Close()
 
-		if cmd != nil {
-			var stdout, stderr bytes.Buffer
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stderr
-			if err = cmd.Run(); err != nil {
-				Log.Error(fmt.Sprintf("stdout:%s | stderr:%s", string(stdout.Bytes()), string(stderr.Bytes())))
-				SendErrorResult(res, NewError(fmt.Sprintf("emacs has quitted: '%s'", err.Error()), 400))
-				return
-			}
+		args := []string{"--no-init-file", "--batch"}
+		export := fn
+		if fn == "org-html-export-to-html" {
+			args = append(args, "--eval", "(setq org-html-extension \"org\")")
+		} else if fn == "org-latex-export-to-pdf" && options.Get("mode") == "beamer" {
+			export = "org-beamer-export-to-pdf"
+		}
+		args = append(args, "--load", GetAbsolutePath(CONFIG_PATH+"emacs.el"), tmpPath+"/index.org", "-f", export)
+		cmd := exec.CommandContext(ctx.Context, emacsPath, args...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err = cmd.Run(); err != nil {
+			Log.Error(fmt.Sprintf("stdout:%s | stderr:%s", string(stdout.Bytes()), string(stderr.Bytes())))
+			return NewError(fmt.Sprintf("emacs has quitted: '%s'", err.Error()), 400)
 		}
 
 		f, err = os.OpenFile(tmpPath+"/"+outPath, os.O_RDONLY, os.ModePerm)
 		if err != nil {
-			SendErrorResult(res, ErrFilesystemError)
-			return
+			return ErrFilesystemError
 		}
-		header.Set("Content-Type", mimeType)
-		header.Set("X-XSS-Protection", "1; mode=block")
-		header.Set("Content-Security-Policy", "script-src 'unsafe-inline' 'unsafe-eval' orgmode.org")
-		io.Copy(res, f)
-		return
-	} else if strings.HasPrefix(reqMimeType, "image/") {
-		file, err := ctx.Backend.Cat(path)
-		if err != nil {
-			SendErrorResult(res, err)
-			return
-		}
-		header.Set("Content-Type", reqMimeType)
-		header.Set("Content-Security-Policy", "script-src 'none'")
-		io.Copy(res, file)
-		return
+		defer f.Close()
+		_, err = io.Copy(out, f)
+		return err
 	}
-
-	SendErrorResult(res, ErrNotImplemented)
-	return
 }
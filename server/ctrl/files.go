@@ -24,6 +24,7 @@ type FileInfo struct {
 	Type string `json:"type"`
 	Size int64  `json:"size"`
 	Time int64  `json:"time"`
+	ETag string `json:"etag,omitempty"`
 }
 
 var (
@@ -99,6 +100,7 @@ func FileLs(ctx *App, res http.ResponseWriter, req *http.Request) {
 			Name: name,
 			Size: entries[i].Size(),
 			Time: modTime,
+			ETag: model.FileETag(entries[i]),
 			Type: func(mode os.FileMode) string {
 				if mode.IsRegular() {
 					return "file"
@@ -129,6 +131,7 @@ func FileLs(ctx *App, res http.ResponseWriter, req *http.Request) {
 	if model.CanShare(ctx) == false {
 		perms.CanShare = NewBool(false)
 	}
+	model.QuotaGet(ctx).Metadata(&perms)
 
 	etagValue := base64.StdEncoding.EncodeToString(etagger.Sum(nil))
 	res.Header().Set("Etag", etagValue)
@@ -187,8 +190,46 @@ func FileCat(ctx *App, res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	// perform the actual `cat` if needed
+	// thumbnails are kept on disk, there's no need to generate those again until the file changes
 	mType := GetMimeType(query.Get("path"))
+	thumbnailKey := ""
+	thumbnailCached := false
+	if query.Get("thumbnail") == "true" && Hooks.Get.Thumbnailer()[mType] != nil {
+		if thumbnailKey = model.ThumbnailCacheKey(ctx, path); thumbnailKey != "" {
+			etag := "\"" + thumbnailKey + "\""
+			header.Set("Etag", etag)
+			if req.Header.Get("If-None-Match") == etag {
+				res.WriteHeader(http.StatusNotModified)
+				return
+			}
+			if f, ok := model.ThumbnailCacheGet(thumbnailKey); ok {
+				head := make([]byte, 512)
+				n, _ := f.Read(head)
+				if _, err = f.Seek(0, io.SeekStart); err == nil {
+					header.Set("Content-Type", http.DetectContentType(head[:n]))
+					header.Set("Cache-Control", "private, max-age=43200")
+					if fi, err := f.Stat(); err == nil {
+						contentLength = fi.Size()
+					}
+					file = f
+					thumbnailCached = true
+				} else {
+					f.Close()
+				}
+			}
+		}
+	}
+
+	// the version of the file the client is about to get, to send back in If-Match when saving it.
+	// It costs a listing of the parent folder so it's only given to those who ask for it
+	version := ""
+	if query.Get("etag") == "true" || req.Header.Get("If-None-Match") != "" {
+		if query.Get("thumbnail") != "true" && req.Header.Get("range") == "" {
+			version, _ = model.FileVersion(ctx, path)
+		}
+	}
+
+	// perform the actual `cat` if needed
 	if file == nil {
 		if file, err = ctx.Backend.Cat(path); err != nil {
 			Log.Debug("cat::backend '%s'", err.Error())
@@ -205,7 +246,7 @@ func FileCat(ctx *App, res http.ResponseWriter, req *http.Request) {
 	}
 
 	// plugin hooks
-	if thumb := query.Get("thumbnail"); thumb == "true" {
+	if thumb := query.Get("thumbnail"); thumb == "true" && thumbnailCached == false {
 		for plgMType, plgHandler := range Hooks.Get.Thumbnailer() {
 			if plgMType != mType {
 				continue
@@ -216,9 +257,11 @@ func FileCat(ctx *App, res http.ResponseWriter, req *http.Request) {
 				SendErrorResult(res, err)
 				return
 			}
+			file = model.ThumbnailCachePut(thumbnailKey, file, header.Get("Cache-Control"))
 			break
 		}
 	}
+	original := file
 	for _, obj := range Hooks.Get.ProcessFileContentBeforeSend() {
 		if file, err = obj(file, ctx, &res, req); err != nil {
 			Log.Debug("cat::hooks '%s'", err.Error())
@@ -226,6 +269,15 @@ func FileCat(ctx *App, res http.ResponseWriter, req *http.Request) {
 			return
 		}
 	}
+	// the version only describes the file as it is stored, not what a plugin made out of it
+	if version != "" && isCatVerbatim(original, file) {
+		header.Set("Etag", version)
+		if req.Header.Get("If-None-Match") == version {
+			file.Close()
+			res.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
 
 	// The extra complexity is to support: https://en.wikipedia.org/wiki/Progressive_download
 	// => range request requires a seeker to work, some backend support it, some don't. 2 strategies:
@@ -325,6 +377,17 @@ func FileCat(ctx *App, res http.ResponseWriter, req *http.Request) {
 	file.Close()
 }
 
+// isCatVerbatim tells if the plugins have left the content of a file untouched. Those only looking at
+// it, eg: to scan it, can say so by giving back a reader with a Verbatim method
+func isCatVerbatim(original io.ReadCloser, file io.ReadCloser) bool {
+	if file == original {
+		return true
+	} else if obj, ok := file.(interface{ Verbatim() bool }); ok {
+		return obj.Verbatim()
+	}
+	return false
+}
+
 func FileAccess(ctx *App, res http.ResponseWriter, req *http.Request) {
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
@@ -391,21 +454,22 @@ func FileSave(ctx *App, res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	for _, auth := range Hooks.Get.AuthorisationMiddleware() {
-		if err = auth.Save(ctx, path); err != nil {
-			Log.Info("save::auth '%s'", err.Error())
-			SendErrorResult(res, ErrNotAuthorized)
-			return
-		}
-	}
-
-	err = ctx.Backend.Save(path, req.Body)
+	ifMatch, ifNoneMatch := req.Header.Get("If-Match"), req.Header.Get("If-None-Match")
+	err = model.FileSave(ctx, path, req.Body, req.ContentLength, ifMatch, ifNoneMatch)
 	req.Body.Close()
 	if err != nil {
 		Log.Debug("save::backend '%s'", err.Error())
-		SendErrorResult(res, NewError(err.Error(), 403))
+		if _, ok := err.(AppError); ok == false {
+			err = NewError(err.Error(), 403)
+		}
+		SendErrorResult(res, err)
 		return
 	}
+	if ifMatch != "" || ifNoneMatch != "" || req.URL.Query().Get("etag") == "true" {
+		if etag, err := model.FileVersion(ctx, path); err == nil && etag != "" {
+			res.Header().Set("Etag", etag)
+		}
+	}
 	SendSuccessResult(res, nil)
 }
 
@@ -442,12 +506,26 @@ func FileMv(ctx *App, res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	// If-Match is about the file we move, If-None-Match about the one we might overwrite
+	unlock := model.FileLock(ctx, from, to)
+	defer unlock()
+	if err = model.FilePrecondition(ctx, from, req.Header.Get("If-Match"), ""); err != nil {
+		Log.Debug("mv::precondition::from '%s'", err.Error())
+		SendErrorResult(res, err)
+		return
+	} else if err = model.FilePrecondition(ctx, to, "", req.Header.Get("If-None-Match")); err != nil {
+		Log.Debug("mv::precondition::to '%s'", err.Error())
+		SendErrorResult(res, err)
+		return
+	}
+
 	err = ctx.Backend.Mv(from, to)
 	if err != nil {
 		Log.Debug("mv::backend '%s'", err.Error())
 		SendErrorResult(res, err)
 		return
 	}
+	EmitEvent(Event{Type: EVENT_FILE_MV, Path: from, To: to, App: ctx})
 	SendSuccessResult(res, nil)
 }
 
@@ -479,6 +557,8 @@ func FileRm(ctx *App, res http.ResponseWriter, req *http.Request) {
 		SendErrorResult(res, err)
 		return
 	}
+	model.QuotaGet(ctx).Stale(ctx)
+	EmitEvent(Event{Type: EVENT_FILE_RM, Path: path, App: ctx})
 	SendSuccessResult(res, nil)
 }
 
@@ -510,6 +590,7 @@ func FileMkdir(ctx *App, res http.ResponseWriter, req *http.Request) {
 		SendErrorResult(res, err)
 		return
 	}
+	EmitEvent(Event{Type: EVENT_FILE_MKDIR, Path: path, App: ctx})
 	SendSuccessResult(res, nil)
 }
 
@@ -535,12 +616,18 @@ func FileTouch(ctx *App, res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if err = model.QuotaGet(ctx).Check(0); err != nil {
+		Log.Debug("touch::quota '%s'", err.Error())
+		SendErrorResult(res, err)
+		return
+	}
 	err = ctx.Backend.Touch(path)
 	if err != nil {
 		Log.Debug("touch::backend '%s'", err.Error())
 		SendErrorResult(res, err)
 		return
 	}
+	EmitEvent(Event{Type: EVENT_FILE_TOUCH, Path: path, App: ctx})
 	SendSuccessResult(res, nil)
 }
 
@@ -737,6 +824,8 @@ func FileExtract(ctx *App, res http.ResponseWriter, req *http.Request) {
 				isFolderAlreadyCreated[p] = true
 				if err := ctx.Backend.Mkdir(p); err != nil {
 					Log.Debug("extract::mkdir err %s", err.Error())
+				} else {
+					EmitEvent(Event{Type: EVENT_FILE_MKDIR, Path: p, App: ctx})
 				}
 			}
 			// STEP2: create the file
@@ -751,9 +840,12 @@ func FileExtract(ctx *App, res http.ResponseWriter, req *http.Request) {
 					Log.Debug("extract::fopen %s", err.Error())
 					return err
 				}
-				err = ctx.Backend.Save(p, rc)
+				err = model.FileSave(ctx, p, rc, int64(f.UncompressedSize64), "", "")
 				rc.Close()
-				if err != nil {
+				if err == ErrInsufficientStorage || err == ErrNotAuthorized {
+					Log.Debug("extract::save %s", err.Error())
+					return err
+				} else if err != nil {
 					Log.Debug("extract::save err %s", err.Error())
 				}
 			}
@@ -0,0 +1,81 @@
+package ctrl
+
+import (
+	"net/http"
+	"strconv"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+)
+
+const GALLERY_PAGE_SIZE = 200
+
+/*
+ * The gallery shows all the photos under a folder on a timeline, based on when they were taken:
+ *   GET  /api/files/gallery?path=/photos/&group=month&offset=0  => {"total": 1200, "next": 200, "groups": [{"key": "2021-06", "count": 42, "photos": [...]}]}
+ *   POST /api/files/gallery?path=/photos/                       => look for photos that were added, changed or removed
+ * The first visit of a folder starts indexing it, the job is given back along with the timeline until
+ * it's done so clients know to come back for more
+ */
+func GalleryTimeline(ctx *App, res http.ResponseWriter, req *http.Request) {
+	path, err := galleryPath(ctx, req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	query := req.URL.Query()
+	group := query.Get("group")
+	if group == "" {
+		group = model.GALLERY_GROUP_DAY
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > GALLERY_PAGE_SIZE {
+		limit = GALLERY_PAGE_SIZE
+	}
+
+	job := model.GalleryIndex(ctx, path, false)
+	timeline, err := model.GalleryTimeline(ctx, path, group, offset, limit)
+	if err != nil {
+		Log.Debug("gallery::timeline path[%s] err[%s]", path, err.Error())
+		SendErrorResult(res, err)
+		return
+	}
+	if job.State() == model.JOB_RUNNING {
+		timeline.Job = job
+	}
+	SendSuccessResult(res, timeline)
+}
+
+func GalleryRefresh(ctx *App, res http.ResponseWriter, req *http.Request) {
+	path, err := galleryPath(ctx, req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, model.GalleryIndex(ctx, path, true))
+}
+
+func galleryPath(ctx *App, req *http.Request) (string, error) {
+	if model.CanRead(ctx) == false {
+		Log.Debug("gallery::permission 'permission denied'")
+		return "", ErrPermissionDenied
+	}
+	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
+	if err != nil {
+		path, _ = PathBuilder(ctx, "/")
+	}
+	if path[len(path)-1:] != "/" {
+		path += "/"
+	}
+	for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+		if err = auth.Ls(ctx, path); err != nil {
+			Log.Info("gallery::auth '%s'", err.Error())
+			return "", ErrNotAuthorized
+		}
+	}
+	return path, nil
+}
@@ -0,0 +1,385 @@
+package ctrl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+)
+
+var (
+	GrepMaxSize     func() int
+	GrepConcurrency func() int
+	GrepTimeout     func() int
+	GrepMaxResults  func() int
+)
+
+const (
+	GREP_LINE_MAX_SIZE = 1024 * 1024
+	GREP_LINE_PREVIEW  = 300
+)
+
+func init() {
+	GrepMaxSize = func() int {
+		return Config.Get("features.search.grep_max_size").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "grep_max_size"
+			f.Name = "grep_max_size"
+			f.Type = "number"
+			f.Description = "Files bigger than this size in bytes are skipped when searching through the content of files without an index"
+			f.Placeholder = "Default: 20MB"
+			f.Default = 20 * 1024 * 1024
+			return f
+		}).Int()
+	}
+	GrepMaxSize()
+	GrepConcurrency = func() int {
+		return Config.Get("features.search.grep_concurrency").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "grep_concurrency"
+			f.Name = "grep_concurrency"
+			f.Type = "number"
+			f.Description = "How many files are read in the same time when searching through the content of files"
+			f.Placeholder = "Default: 4"
+			f.Default = 4
+			return f
+		}).Int()
+	}
+	GrepConcurrency()
+	GrepTimeout = func() int {
+		return Config.Get("features.search.grep_timeout").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "grep_timeout"
+			f.Name = "grep_timeout"
+			f.Type = "number"
+			f.Description = "Time in seconds after which a search through the content of files is stopped"
+			f.Placeholder = "Default: 120s"
+			f.Default = 120
+			return f
+		}).Int()
+	}
+	GrepTimeout()
+	GrepMaxResults = func() int {
+		return Config.Get("features.search.grep_max_results").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "grep_max_results"
+			f.Name = "grep_max_results"
+			f.Type = "number"
+			f.Description = "Maximum number of matching lines sent back when searching through the content of files"
+			f.Placeholder = "Default: 1000"
+			f.Default = 1000
+			return f
+		}).Int()
+	}
+	GrepMaxResults()
+}
+
+/*
+ * FileGrep looks for a pattern in the content of the files found under a path, the same way grep
+ * would. There's no index involved, we walk the storage and read files through the backend so it
+ * works everywhere but can be slow. Results are streamed as server sent events while the walk
+ * progresses:
+ *   event: match     => {"path": "/logs/app.log", "line": 42, "text": "...", "matches": [[10, 15]]}
+ *   event: progress  => {"dirs": 3, "files": 120, "bytes": 102400, "matches": 1}
+ *   event: done      => same as progress with a "reason" when the search was cut short
+ */
+func FileGrep(ctx *App, res http.ResponseWriter, req *http.Request) {
+	if model.CanRead(ctx) == false {
+		Log.Debug("ctrl::grep 'can not read'")
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
+	if err != nil {
+		path, _ = PathBuilder(ctx, "/")
+	}
+	pattern := req.URL.Query().Get("q")
+	if pattern == "" {
+		SendErrorResult(res, NewError("Missing search pattern", 400))
+		return
+	}
+	if req.URL.Query().Get("regex") != "true" {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if req.URL.Query().Get("case") != "true" {
+		pattern = "(?i)" + pattern
+	}
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		SendErrorResult(res, NewError(fmt.Sprintf("Invalid pattern: %s", err.Error()), 400))
+		return
+	}
+	flusher, ok := res.(http.Flusher)
+	if ok == false {
+		SendErrorResult(res, ErrNotImplemented)
+		return
+	}
+
+	header := res.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	c, cancel := context.WithTimeout(req.Context(), time.Duration(GrepTimeout())*time.Second)
+	defer cancel()
+	g := &grep{
+		ctx:     ctx,
+		context: c,
+		cancel:  cancel,
+		pattern: r,
+		maxSize: int64(GrepMaxSize()),
+		maxRes:  int64(GrepMaxResults()),
+		send: func(event string, data interface{}) {
+			b, err := json.Marshal(data)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event, b)
+			flusher.Flush()
+		},
+	}
+	g.Run(path)
+
+	status := g.Progress()
+	if g.reason != "" {
+		status["reason"] = g.reason
+	} else if c.Err() == context.DeadlineExceeded {
+		status["reason"] = "timeout"
+	} else if c.Err() != nil {
+		return
+	}
+	g.Send("done", status)
+}
+
+type grep struct {
+	dirs    int64 // counters come first to stay 64 bits aligned for atomic operations
+	files   int64
+	bytes   int64
+	matches int64
+
+	ctx     *App
+	context context.Context
+	cancel  context.CancelFunc
+	pattern *regexp.Regexp
+	maxSize int64
+	maxRes  int64
+	send    func(event string, data interface{})
+	mu      sync.Mutex
+	reason  string
+}
+
+type grepMatch struct {
+	Path    string  `json:"path"`
+	Line    int     `json:"line"`
+	Text    string  `json:"text"`
+	Matches [][]int `json:"matches"`
+}
+
+func (this *grep) Run(root string) {
+	files := make(chan string)
+	var wg sync.WaitGroup
+	n := GrepConcurrency()
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range files {
+				this.readFile(path)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	toVisit := []string{root}
+	for len(toVisit) > 0 && this.context.Err() == nil {
+		current := toVisit[0]
+		toVisit = toVisit[1:]
+		if this.authorised(current, true) == false {
+			continue
+		}
+		entries, err := this.ctx.Backend.Ls(current)
+		if err != nil {
+			Log.Debug("ctrl::grep ls path[%s] err[%s]", current, err.Error())
+			continue
+		}
+		atomic.AddInt64(&this.dirs, 1)
+		for _, entry := range entries {
+			p := filepath.Join(current, entry.Name())
+			if entry.IsDir() {
+				toVisit = append(toVisit, p+"/")
+				continue
+			} else if entry.Size() > this.maxSize || grepSkipMime(GetMimeType(p)) {
+				continue
+			}
+			select {
+			case files <- p:
+			case <-this.context.Done():
+			}
+			select {
+			case <-ticker.C:
+				this.Send("progress", this.Progress())
+			default:
+			}
+		}
+	}
+	close(files)
+	wg.Wait()
+}
+
+func (this *grep) readFile(path string) {
+	if this.context.Err() != nil || this.authorised(path, false) == false {
+		return
+	}
+	reader, err := this.ctx.Backend.Cat(path)
+	if err != nil {
+		Log.Debug("ctrl::grep cat path[%s] err[%s]", path, err.Error())
+		return
+	}
+	defer reader.Close()
+	atomic.AddInt64(&this.files, 1)
+
+	br := bufio.NewReader(reader)
+	if head, _ := br.Peek(512); bytes.IndexByte(head, 0) != -1 {
+		return // binary file
+	}
+	displayPath := path
+	if chroot := this.ctx.Session["path"]; chroot != "" {
+		displayPath = "/" + strings.TrimPrefix(path, chroot)
+	}
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), GREP_LINE_MAX_SIZE)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if this.context.Err() != nil {
+			return
+		}
+		line := scanner.Bytes()
+		atomic.AddInt64(&this.bytes, int64(len(line)+1))
+		loc := this.pattern.FindAllIndex(line, -1)
+		if len(loc) == 0 {
+			continue
+		}
+		if atomic.AddInt64(&this.matches, 1) > this.maxRes {
+			atomic.AddInt64(&this.matches, -1)
+			this.mu.Lock()
+			this.reason = "too many results"
+			this.mu.Unlock()
+			this.cancel()
+			return
+		}
+		text, matches := grepPreview(line, loc)
+		this.Send("match", grepMatch{
+			Path:    displayPath,
+			Line:    lineNumber,
+			Text:    text,
+			Matches: matches,
+		})
+	}
+	if err = scanner.Err(); err != nil {
+		Log.Debug("ctrl::grep scan path[%s] err[%s]", path, err.Error())
+	}
+}
+
+func (this *grep) authorised(path string, isDir bool) bool {
+	for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+		var err error
+		if isDir {
+			err = auth.Ls(this.ctx, path)
+		} else {
+			err = auth.Cat(this.ctx, path)
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *grep) Send(event string, data interface{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.context.Err() != nil && event != "done" {
+		return
+	}
+	this.send(event, data)
+}
+
+func (this *grep) Progress() map[string]interface{} {
+	return map[string]interface{}{
+		"dirs":    atomic.LoadInt64(&this.dirs),
+		"files":   atomic.LoadInt64(&this.files),
+		"bytes":   atomic.LoadInt64(&this.bytes),
+		"matches": atomic.LoadInt64(&this.matches),
+	}
+}
+
+// grepPreview cuts long lines around the first match and gives back where the matches are, in characters
+func grepPreview(line []byte, loc [][]int) (string, [][]int) {
+	start, end := 0, len(line)
+	if len(line) > GREP_LINE_PREVIEW {
+		start = loc[0][0] - GREP_LINE_PREVIEW/3
+		if start < 0 {
+			start = 0
+		}
+		for start > 0 && utf8.RuneStart(line[start]) == false {
+			start--
+		}
+		end = start + GREP_LINE_PREVIEW
+		if end > len(line) {
+			end = len(line)
+		}
+		for end < len(line) && utf8.RuneStart(line[end]) == false {
+			end++
+		}
+	}
+	matches := [][]int{}
+	for _, l := range loc {
+		if l[0] < start || l[1] > end {
+			continue
+		}
+		matches = append(matches, []int{
+			utf8.RuneCount(line[start:l[0]]),
+			utf8.RuneCount(line[start:l[1]]),
+		})
+	}
+	return string(line[start:end]), matches
+}
+
+func grepSkipMime(mType string) bool {
+	for _, prefix := range []string{"image/", "video/", "audio/", "font/"} {
+		if strings.HasPrefix(mType, prefix) {
+			return true
+		}
+	}
+	switch mType {
+	case "application/zip", "application/x-tar", "application/gzip", "application/x-gzip",
+		"application/x-7z-compressed", "application/x-rar-compressed", "application/pdf":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package ctrl
+
+import (
+	"net/http"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+)
+
+/*
+ * FileMeta gives what can be known about a photo, a song or a video without downloading it:
+ *   GET /api/files/meta?path=/photos/IMG_0001.jpg  => {"mime": "image/jpeg", "width": 4032, "capture_date": ..., "make": ..., "latitude": ...}
+ *   GET /api/files/meta?path=/music/song.mp3       => {"mime": "audio/mp3", "duration": 213.4, "tags": {"title": ..., "artist": ...}}
+ *   GET /api/files/meta?path=/videos/movie.mkv     => {"mime": "video/x-matroska", "duration": 5400.2, "video_codec": "h264", ...}
+ */
+func FileMeta(ctx *App, res http.ResponseWriter, req *http.Request) {
+	if model.CanRead(ctx) == false {
+		Log.Debug("meta::permission 'permission denied'")
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
+	if err != nil {
+		Log.Debug("meta::path '%s'", err.Error())
+		SendErrorResult(res, err)
+		return
+	}
+	for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+		if err = auth.Cat(ctx, path); err != nil {
+			Log.Info("meta::auth '%s'", err.Error())
+			SendErrorResult(res, ErrNotAuthorized)
+			return
+		}
+	}
+
+	meta, err := model.MediaMetadataGet(ctx, path)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, meta)
+}
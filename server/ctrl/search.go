@@ -4,7 +4,10 @@ import (
 	. "github.com/mickael-kerjean/filestash/server/common"
 	"github.com/mickael-kerjean/filestash/server/model"
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func FileSearch(ctx *App, res http.ResponseWriter, req *http.Request) {
@@ -34,21 +37,69 @@ func FileSearch(ctx *App, res http.ResponseWriter, req *http.Request) {
 	// overwrite the path of a file according to chroot
 	if ctx.Session["path"] != "" {
 		for i := 0; i < len(searchResults); i++ {
-			searchResults[i] = File{
-				FName: searchResults[i].Name(),
-				FSize: searchResults[i].Size(),
-				FType: func() string {
-					if searchResults[i].IsDir() {
-						return "directory"
-					}
-					return "file"
-				}(),
-				FPath: "/" + strings.TrimPrefix(
-					searchResults[i].Path(),
-					ctx.Session["path"],
-				),
+			f, ok := searchResults[i].(File)
+			if ok == false {
+				f = File{
+					FName: searchResults[i].Name(),
+					FSize: searchResults[i].Size(),
+					FType: func() string {
+						if searchResults[i].IsDir() {
+							return "directory"
+						}
+						return "file"
+					}(),
+					FTime: searchResults[i].ModTime().UnixNano() / int64(time.Millisecond),
+				}
 			}
+			// what engines found out about the content of the file (snippet, ...) is kept as is
+			f.FPath = "/" + strings.TrimPrefix(
+				searchResults[i].Path(),
+				ctx.Session["path"],
+			)
+			searchResults[i] = f
 		}
 	}
-	SendSuccessResults(res, searchResults)
+	SendSuccessResultsWithMetadata(res, searchResults, map[string]interface{}{
+		"facets": searchFacets(searchResults, req.URL.Query().Get("path")),
+	})
+}
+
+// searchFacets counts the results by type, year and top level folder relative to where the search started
+func searchFacets(files []IFile, root string) map[string]map[string]int {
+	facets := map[string]map[string]int{
+		"type":   map[string]int{},
+		"year":   map[string]int{},
+		"folder": map[string]int{},
+	}
+	root = "/" + strings.Trim(root, "/") + "/"
+	if root == "//" {
+		root = "/"
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			facets["type"]["directory"] += 1
+		} else if ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(f.Name()), ".")); ext != "" {
+			facets["type"][ext] += 1
+		} else {
+			facets["type"]["file"] += 1
+		}
+
+		var t time.Time
+		if file, ok := f.(File); ok && file.FTime > 0 {
+			t = time.Unix(0, file.FTime*int64(time.Millisecond))
+		} else if ok == false {
+			t = f.ModTime()
+		}
+		if t.IsZero() == false {
+			facets["year"][strconv.Itoa(t.Year())] += 1
+		}
+
+		rel := strings.TrimPrefix(strings.TrimSuffix(f.Path(), "/"), root)
+		if i := strings.Index(rel, "/"); i > 0 {
+			facets["folder"][rel[:i]] += 1
+		} else {
+			facets["folder"]["/"] += 1
+		}
+	}
+	return facets
 }
@@ -84,12 +84,18 @@ func ShareUpsert(ctx *App, res http.ResponseWriter, req *http.Request) {
 		CanRead:      NewBoolFromInterface(ctx.Body["can_read"]),
 		CanWrite:     NewBoolFromInterface(ctx.Body["can_write"]),
 		CanUpload:    NewBoolFromInterface(ctx.Body["can_upload"]),
+		Quota:        NewInt64pFromInterface(ctx.Body["quota"]),
+	}
+	if ctx.Share.Quota != nil && (s.Quota == nil || *s.Quota > *ctx.Share.Quota) {
+		// a shared link can't be used to escape the quota of its parent
+		s.Quota = ctx.Share.Quota
 	}
 	if err := model.ShareUpsert(&s); err != nil {
 		Log.Debug("share::upsert '%s'", err.Error())
 		SendErrorResult(res, err)
 		return
 	}
+	EmitEvent(Event{Type: EVENT_SHARE_CREATE, Path: s.Path, Share: s.Id, App: ctx})
 	SendSuccessResult(res, nil)
 }
 
@@ -197,6 +203,8 @@ func ShareVerifyProof(ctx *App, res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	EmitEvent(Event{Type: EVENT_SHARE_ACCESS, Path: s.Path, Share: s.Id})
+
 	SendSuccessResult(res, struct {
 		Id        string `json:"id"`
 		Path      string `json:"path"`
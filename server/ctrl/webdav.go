@@ -40,12 +40,67 @@ func WebdavHandler(ctx *App, res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if req.Method == "PUT" {
+		path := filepath.Join(ctx.Share.Path, strings.TrimPrefix(req.URL.Path, "/s/"+ctx.Share.Id))
+		if strings.HasPrefix(path, ctx.Share.Path) == false {
+			SendErrorResult(res, ErrNotValid)
+			return
+		}
+		// the save checks those again once the upload is over, doing it here as well is to not
+		// make the client upload something that would be refused anyway
+		if err := model.FilePrecondition(ctx, path, req.Header.Get("If-Match"), req.Header.Get("If-None-Match")); err != nil {
+			Log.Debug("webdav::precondition '%s'", err.Error())
+			res.WriteHeader(http.StatusPreconditionFailed)
+			return
+		} else if err := model.QuotaGet(ctx).Check(req.ContentLength); err != nil {
+			Log.Debug("webdav::quota '%s'", err.Error())
+			SendErrorResult(res, err)
+			return
+		}
+	}
+
+	fs := model.NewWebdavFs(ctx, ctx.Backend, ctx.Share.Backend, ctx.Share.Path, req)
 	h := &webdav.Handler{
 		Prefix:     "/s/" + ctx.Share.Id,
-		FileSystem: model.NewWebdavFs(ctx.Backend, ctx.Share.Backend, ctx.Share.Path, req),
+		FileSystem: fs,
 		LockSystem: model.NewWebdavLock(),
 	}
-	h.ServeHTTP(res, req)
+	w := &webdavResponseWriter{ResponseWriter: res, fs: fs, status: http.StatusOK}
+	h.ServeHTTP(w, req)
+
+	if req.Method == "DELETE" && w.status < 300 {
+		if quotas := model.QuotaGet(ctx); len(quotas) > 0 {
+			quotas.Stale(ctx)
+		}
+	}
+}
+
+/*
+ * webdavResponseWriter is there for the webdav server to tell why a file couldn't be saved, eg: 507
+ * when an upload goes over quota. On its own it has no idea about the reason and answers 405
+ */
+type webdavResponseWriter struct {
+	http.ResponseWriter
+	fs        *model.WebdavFs
+	status    int
+	rewritten bool
+}
+
+func (this *webdavResponseWriter) WriteHeader(status int) {
+	if e, ok := this.fs.Err().(AppError); ok && status >= 400 {
+		status = e.Status()
+		this.rewritten = true
+	}
+	this.status = status
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *webdavResponseWriter) Write(b []byte) (int, error) {
+	if this.rewritten {
+		// the body is the status text of the original status
+		return len(b), nil
+	}
+	return this.ResponseWriter.Write(b)
 }
 
 /*
@@ -0,0 +1,157 @@
+package converter
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+// what spreadsheets accept as a number, things like "NaN", "0x10" or a zip code like "01234" are kept as text
+var xlsxNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+/*
+ * CsvToJson gives the rows of a csv as objects named after the header:
+ *   ?header=false  => rows are given as arrays, the first one included
+ *   ?delimiter=;   => for the csv that aren't separated with commas
+ */
+func CsvToJson(ctx *App, in io.Reader, out io.Writer, options url.Values) error {
+	r, err := csvReader(in, options)
+	if err != nil {
+		return err
+	}
+	header := []string{}
+	if options.Get("header") != "false" {
+		if header, err = r.Read(); err == io.EOF {
+			_, err = out.Write([]byte("[]"))
+			return err
+		} else if err != nil {
+			return err
+		}
+	}
+
+	out.Write([]byte("["))
+	for i := 0; ; i++ {
+		if err = ctx.Context.Err(); err != nil {
+			return err
+		}
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if i > 0 {
+			out.Write([]byte(","))
+		}
+		var b []byte
+		if len(header) == 0 {
+			b, err = json.Marshal(record)
+		} else {
+			row := make(map[string]string, len(record))
+			for j, value := range record {
+				if j < len(header) {
+					row[header[j]] = value
+				} else {
+					row[strconv.Itoa(j)] = value
+				}
+			}
+			b, err = json.Marshal(row)
+		}
+		if err != nil {
+			return err
+		} else if _, err = out.Write(b); err != nil {
+			return err
+		}
+	}
+	_, err = out.Write([]byte("]"))
+	return err
+}
+
+/*
+ * CsvToXlsx makes a spreadsheet with a single sheet out of a csv. What looks like a number is
+ * stored as one so formulas work on it, everything else is kept as text
+ */
+func CsvToXlsx(ctx *App, in io.Reader, out io.Writer, options url.Values) error {
+	r, err := csvReader(in, options)
+	if err != nil {
+		return err
+	}
+	z := zip.NewWriter(out)
+	for _, file := range [][2]string{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+	} {
+		w, err := z.Create(file[0])
+		if err != nil {
+			return err
+		} else if _, err = w.Write([]byte(file[1])); err != nil {
+			return err
+		}
+	}
+
+	w, err := z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`))
+	for i := 1; ; i++ {
+		if err = ctx.Context.Err(); err != nil {
+			return err
+		}
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, `<row r="%d">`, i)
+		for j, value := range record {
+			ref := xlsxColumn(j) + strconv.Itoa(i)
+			if xlsxNumber.MatchString(value) {
+				fmt.Fprintf(w, `<c r="%s"><v>%s</v></c>`, ref, value)
+				continue
+			}
+			fmt.Fprintf(w, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(w, []byte(value))
+			w.Write([]byte(`</t></is></c>`))
+		}
+		w.Write([]byte(`</row>`))
+	}
+	w.Write([]byte(`</sheetData></worksheet>`))
+	return z.Close()
+}
+
+func csvReader(in io.Reader, options url.Values) (*csv.Reader, error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	if d := []rune(options.Get("delimiter")); len(d) == 1 {
+		r.Comma = d[0]
+	} else if len(d) > 1 {
+		return nil, NewError("Invalid value for 'delimiter'", 400)
+	}
+	return r, nil
+}
+
+// xlsxColumn gives the name of a column the way spreadsheets show it: A, B, ..., Z, AA, AB, ...
+func xlsxColumn(i int) string {
+	name := ""
+	for i += 1; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
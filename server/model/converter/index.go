@@ -0,0 +1,17 @@
+package converter
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+func init() {
+	Hooks.Register.Converter("text/markdown", "text/html", MarkdownToHtml)
+	Hooks.Register.Converter("text/csv", "application/json", CsvToJson)
+	// xlsx is known under a shorter name than the official one
+	Hooks.Register.Converter("text/csv", "application/excel", CsvToXlsx)
+	Hooks.Register.Converter("text/csv", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", CsvToXlsx)
+	Hooks.Register.Converter("image/*", "application/pdf", ImageToPdf)
+	for mType, ext := range officeExtensions {
+		Hooks.Register.Converter(mType, "application/pdf", OfficeToPdf(ext))
+	}
+}
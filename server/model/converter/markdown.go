@@ -0,0 +1,511 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+const MARKDOWN_MAX_SIZE = 10 * 1024 * 1024
+
+var (
+	mdHeading     = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdFence       = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`]*)$")
+	mdList        = regexp.MustCompile(`^( {0,3})([-*+]|[0-9]{1,9}[.)])( +|$)`)
+	mdQuote       = regexp.MustCompile(`^ {0,3}> ?`)
+	mdSetext      = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	mdTableDelim  = regexp.MustCompile(`^ {0,3}\|?[ \t]*:?-+:?[ \t]*(\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	mdAutolink    = regexp.MustCompile(`^<((?:https?://|mailto:)[^<>\s]+)>`)
+	mdSafeLink    = regexp.MustCompile(`^(?i:https?:|mailto:|[^:]*$|[^:]*[/?#])`)
+	mdTag         = regexp.MustCompile(`<[^>]*>`)
+	mdPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+)
+
+/*
+ * MarkdownToHtml renders the common parts of markdown: headings, paragraphs, lists, quotes, code,
+ * tables, links, images and emphasis. Html found in the document is shown as text, what we send
+ * back is safe to open in the browser
+ */
+func MarkdownToHtml(ctx *App, in io.Reader, out io.Writer, options url.Values) error {
+	b, err := io.ReadAll(io.LimitReader(in, MARKDOWN_MAX_SIZE+1))
+	if err != nil {
+		return err
+	} else if len(b) > MARKDOWN_MAX_SIZE {
+		return NewError("Document is too big", 413)
+	}
+	text := strings.ReplaceAll(strings.ReplaceAll(string(b), "\r\n", "\n"), "\t", "    ")
+	lines := strings.Split(text, "\n")
+
+	title := "Document"
+	for _, line := range lines {
+		if m := mdHeading.FindStringSubmatch(line); m != nil && m[2] != "" {
+			title = m[2]
+			break
+		}
+	}
+	_, err = fmt.Fprintf(
+		out,
+		"<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n<title>%s</title>\n</head>\n<body>\n%s</body>\n</html>\n",
+		html.EscapeString(title), mdBlocks(lines, false),
+	)
+	return err
+}
+
+// mdBlocks renders a list of lines, in a tight list the paragraphs aren't wrapped in <p>
+func mdBlocks(lines []string, tight bool) string {
+	var out strings.Builder
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if strings.TrimSpace(line) == "" {
+			i++
+			continue
+		}
+
+		if m := mdFence.FindStringSubmatch(line); m != nil {
+			indent, fence := len(m[1]), m[2]
+			code := []string{}
+			for i++; i < len(lines); i++ {
+				if t := strings.TrimSpace(lines[i]); strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+					i++
+					break
+				}
+				code = append(code, strings.TrimPrefix(lines[i], strings.Repeat(" ", indent)))
+			}
+			if lang := strings.Fields(m[3]); len(lang) > 0 {
+				fmt.Fprintf(&out, "<pre><code class=\"language-%s\">", html.EscapeString(lang[0]))
+			} else {
+				out.WriteString("<pre><code>")
+			}
+			for _, c := range code {
+				out.WriteString(html.EscapeString(c) + "\n")
+			}
+			out.WriteString("</code></pre>\n")
+			continue
+		}
+
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			fmt.Fprintf(&out, "<h%d>%s</h%d>\n", len(m[1]), mdInline(m[2]), len(m[1]))
+			i++
+			continue
+		}
+
+		if mdIsRule(line) {
+			out.WriteString("<hr>\n")
+			i++
+			continue
+		}
+
+		if mdQuote.MatchString(line) {
+			quote := []string{}
+			for ; i < len(lines) && mdQuote.MatchString(lines[i]); i++ {
+				quote = append(quote, mdQuote.ReplaceAllString(lines[i], ""))
+			}
+			out.WriteString("<blockquote>\n" + mdBlocks(quote, false) + "</blockquote>\n")
+			continue
+		}
+
+		if mdList.MatchString(line) {
+			i = mdListBlock(lines, i, &out)
+			continue
+		}
+
+		if strings.HasPrefix(line, "    ") {
+			code := []string{}
+			for ; i < len(lines) && (strings.HasPrefix(lines[i], "    ") || strings.TrimSpace(lines[i]) == ""); i++ {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			out.WriteString("<pre><code>")
+			for _, c := range code {
+				out.WriteString(html.EscapeString(c) + "\n")
+			}
+			out.WriteString("</code></pre>\n")
+			continue
+		}
+
+		if strings.Contains(line, "|") && i+1 < len(lines) && mdTableDelim.MatchString(lines[i+1]) {
+			i = mdTable(lines, i, &out)
+			continue
+		}
+
+		paragraph := []string{}
+		heading := 0
+		for ; i < len(lines); i++ {
+			if strings.TrimSpace(lines[i]) == "" {
+				break
+			} else if m := mdSetext.FindStringSubmatch(lines[i]); m != nil && len(paragraph) > 0 {
+				heading = 2
+				if m[1][0] == '=' {
+					heading = 1
+				}
+				i++
+				break
+			} else if len(paragraph) > 0 && mdInterrupts(lines[i]) {
+				break
+			}
+			paragraph = append(paragraph, strings.TrimLeft(lines[i], " "))
+		}
+		text := mdInline(strings.Join(paragraph, "\n"))
+		if heading > 0 {
+			fmt.Fprintf(&out, "<h%d>%s</h%d>\n", heading, text, heading)
+		} else if tight {
+			out.WriteString(text + "\n")
+		} else {
+			out.WriteString("<p>" + text + "</p>\n")
+		}
+	}
+	return out.String()
+}
+
+// mdInterrupts tells if a line starts a new block when it follows the line of a paragraph
+func mdInterrupts(line string) bool {
+	if mdHeading.MatchString(line) || mdFence.MatchString(line) || mdQuote.MatchString(line) || mdIsRule(line) {
+		return true
+	} else if m := mdList.FindStringSubmatch(line); m != nil && strings.TrimSpace(line[len(m[0]):]) != "" {
+		return true
+	}
+	return false
+}
+
+func mdIsRule(line string) bool {
+	t := strings.ReplaceAll(strings.TrimSpace(line), " ", "")
+	if len(t) < 3 || strings.HasPrefix(line, "    ") {
+		return false
+	}
+	return strings.Trim(t, t[:1]) == "" && strings.Contains("-*_", t[:1])
+}
+
+// mdListBlock renders the list that starts at a line and gives back where it ends
+func mdListBlock(lines []string, i int, out *strings.Builder) int {
+	first := mdList.FindStringSubmatch(lines[i])
+	ordered := strings.ContainsAny(first[2], ".)")
+	kind := first[2][len(first[2])-1:]
+	items := [][]string{}
+	tight := true
+	blank := false
+	indent := 0
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if m := mdList.FindStringSubmatch(line); m != nil && (len(items) == 0 || len(m[1]) < indent) {
+			if m[2][len(m[2])-1:] != kind {
+				break
+			}
+			if blank && len(items) > 0 {
+				tight = false
+			}
+			indent = len(m[0])
+			if strings.TrimSpace(line[len(m[0]):]) == "" {
+				indent = len(m[1]) + len(m[2]) + 1
+			}
+			items = append(items, []string{line[len(m[0]):]})
+			blank = false
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			blank = true
+			items[len(items)-1] = append(items[len(items)-1], "")
+			continue
+		}
+		if strings.HasPrefix(line, strings.Repeat(" ", indent)) {
+			if blank {
+				tight = false
+			}
+			items[len(items)-1] = append(items[len(items)-1], line[indent:])
+			blank = false
+			continue
+		}
+		if blank || mdInterrupts(line) {
+			break
+		}
+		// lazy continuation of the paragraph of the last item
+		items[len(items)-1] = append(items[len(items)-1], strings.TrimLeft(line, " "))
+	}
+
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if start, _ := strconv.Atoi(strings.TrimRight(first[2], ".)")); start != 1 {
+			fmt.Fprintf(out, "<ol start=\"%d\">\n", start)
+		} else {
+			out.WriteString("<ol>\n")
+		}
+	} else {
+		out.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		out.WriteString("<li>" + mdBlocks(item, tight) + "</li>\n")
+	}
+	out.WriteString("</" + tag + ">\n")
+	// the blank lines that ended the list belong to what comes after it
+	for i > 0 && strings.TrimSpace(lines[i-1]) == "" && i < len(lines) {
+		i--
+	}
+	return i
+}
+
+func mdTable(lines []string, i int, out *strings.Builder) int {
+	header := mdTableCells(lines[i])
+	align := []string{}
+	for _, cell := range mdTableCells(lines[i+1]) {
+		switch {
+		case strings.HasPrefix(cell, ":") && strings.HasSuffix(cell, ":"):
+			align = append(align, " style=\"text-align:center\"")
+		case strings.HasSuffix(cell, ":"):
+			align = append(align, " style=\"text-align:right\"")
+		case strings.HasPrefix(cell, ":"):
+			align = append(align, " style=\"text-align:left\"")
+		default:
+			align = append(align, "")
+		}
+	}
+	row := func(cells []string, tag string) {
+		out.WriteString("<tr>")
+		for j := range header {
+			cell, a := "", ""
+			if j < len(cells) {
+				cell = cells[j]
+			}
+			if j < len(align) {
+				a = align[j]
+			}
+			fmt.Fprintf(out, "<%s%s>%s</%s>", tag, a, mdInline(cell), tag)
+		}
+		out.WriteString("</tr>\n")
+	}
+	out.WriteString("<table>\n<thead>\n")
+	row(header, "th")
+	out.WriteString("</thead>\n<tbody>\n")
+	for i += 2; i < len(lines) && strings.TrimSpace(lines[i]) != "" && strings.Contains(lines[i], "|"); i++ {
+		row(mdTableCells(lines[i]), "td")
+	}
+	out.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+func mdTableCells(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && strings.HasSuffix(line, "\\|") == false {
+		line = line[:len(line)-1]
+	}
+	cells := []string{}
+	cell := ""
+	for j := 0; j < len(line); j++ {
+		if line[j] == '\\' && j+1 < len(line) && line[j+1] == '|' {
+			cell += "|"
+			j++
+		} else if line[j] == '|' {
+			cells = append(cells, strings.TrimSpace(cell))
+			cell = ""
+		} else {
+			cell += line[j : j+1]
+		}
+	}
+	return append(cells, strings.TrimSpace(cell))
+}
+
+// mdInline renders what's inside a block: code, emphasis, links, images and line breaks
+func mdInline(s string) string {
+	var out bytes.Buffer
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(mdPunctuation, s[i+1]) >= 0:
+			out.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			out.WriteString("<br>\n")
+			i += 2
+			continue
+		case c == '`':
+			n := mdRun(s, i)
+			if end := strings.Index(s[i+n:], s[i:i+n]); end >= 0 && mdRun(s, i+n+end) == n {
+				code := strings.ReplaceAll(s[i+n:i+n+end], "\n", " ")
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+					code = code[1 : len(code)-1]
+				}
+				out.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += 2*n + end
+				continue
+			}
+			out.WriteString(s[i : i+n])
+			i += n
+			continue
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if text, dest, title, end, ok := mdLink(s, i+1); ok {
+				fmt.Fprintf(&out, "<img src=\"%s\" alt=\"%s\"%s>", html.EscapeString(mdUrl(dest)), html.EscapeString(mdPlain(text)), mdTitle(title))
+				i = end
+				continue
+			}
+		case c == '[':
+			if text, dest, title, end, ok := mdLink(s, i); ok {
+				fmt.Fprintf(&out, "<a href=\"%s\"%s>%s</a>", html.EscapeString(mdUrl(dest)), mdTitle(title), mdInline(text))
+				i = end
+				continue
+			}
+		case c == '<':
+			if m := mdAutolink.FindStringSubmatch(s[i:]); m != nil {
+				fmt.Fprintf(&out, "<a href=\"%s\">%s</a>", html.EscapeString(m[1]), html.EscapeString(m[1]))
+				i += len(m[0])
+				continue
+			}
+		case c == '*' || c == '_' || c == '~':
+			n := mdRun(s, i)
+			if inner, end, ok := mdEmphasis(s, i, n); ok {
+				switch {
+				case c == '~':
+					out.WriteString("<del>" + mdInline(inner) + "</del>")
+				case n >= 3:
+					out.WriteString("<em><strong>" + mdInline(inner) + "</strong></em>")
+				case n == 2:
+					out.WriteString("<strong>" + mdInline(inner) + "</strong>")
+				default:
+					out.WriteString("<em>" + mdInline(inner) + "</em>")
+				}
+				i = end
+				continue
+			}
+			out.WriteString(s[i : i+n])
+			i += n
+			continue
+		case c == '\n':
+			if n := len(out.Bytes()) - len(bytes.TrimRight(out.Bytes(), " ")); n >= 2 {
+				out.Truncate(out.Len() - n)
+				out.WriteString("<br>")
+			}
+			out.WriteString("\n")
+			i++
+			continue
+		}
+		out.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return out.String()
+}
+
+// mdRun gives the number of times the character at i is repeated
+func mdRun(s string, i int) int {
+	n := 1
+	for i+n < len(s) && s[i+n] == s[i] {
+		n++
+	}
+	return n
+}
+
+// mdEmphasis finds the closing delimiter of the same length as the one opened at i
+func mdEmphasis(s string, i int, n int) (string, int, bool) {
+	c := s[i]
+	if (c == '~' && n != 2) || n > 3 {
+		return "", 0, false
+	} else if i+n >= len(s) || s[i+n] == ' ' || s[i+n] == '\n' {
+		return "", 0, false
+	} else if c == '_' && i > 0 && mdIsWord(s[i-1]) {
+		return "", 0, false
+	}
+	for j := i + n; j < len(s); {
+		if s[j] == '`' {
+			// delimiters in a code span don't count
+			run := mdRun(s, j)
+			if end := strings.Index(s[j+run:], s[j:j+run]); end >= 0 {
+				j += 2*run + end
+				continue
+			}
+		}
+		if s[j] != c {
+			j++
+			continue
+		}
+		run := mdRun(s, j)
+		if run == n && j > i+n && s[j-1] != ' ' && s[j-1] != '\n' && (c != '_' || j+run >= len(s) || mdIsWord(s[j+run]) == false) {
+			return s[i+n : j], j + run, true
+		}
+		j += run
+	}
+	return "", 0, false
+}
+
+func mdIsWord(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// mdLink reads a link that starts with the '[' at i: [text](destination "title")
+func mdLink(s string, i int) (string, string, string, int, bool) {
+	depth := 0
+	closing := -1
+	for j := i; j < len(s); j++ {
+		if s[j] == '\\' {
+			j++
+		} else if s[j] == '[' {
+			depth++
+		} else if s[j] == ']' {
+			if depth--; depth == 0 {
+				closing = j
+				break
+			}
+		}
+	}
+	if closing < 0 || closing+1 >= len(s) || s[closing+1] != '(' {
+		return "", "", "", 0, false
+	}
+	depth = 0
+	end := -1
+	for j := closing + 1; j < len(s); j++ {
+		if s[j] == '\\' {
+			j++
+		} else if s[j] == '(' {
+			depth++
+		} else if s[j] == ')' {
+			if depth--; depth == 0 {
+				end = j
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return "", "", "", 0, false
+	}
+	dest, title := strings.TrimSpace(s[closing+2:end]), ""
+	if strings.HasPrefix(dest, "<") {
+		if k := strings.Index(dest, ">"); k > 0 {
+			dest, title = dest[1:k], strings.TrimSpace(dest[k+1:])
+		}
+	} else if k := strings.IndexAny(dest, " \n"); k > 0 {
+		dest, title = dest[:k], strings.TrimSpace(dest[k+1:])
+	}
+	if len(title) >= 2 && strings.Contains(`"'(`, title[:1]) {
+		title = title[1 : len(title)-1]
+	} else if title != "" {
+		return "", "", "", 0, false
+	}
+	return s[i+1 : closing], dest, title, end + 1, true
+}
+
+// mdUrl keeps links away from schemes like "javascript:"
+func mdUrl(dest string) string {
+	if mdSafeLink.MatchString(dest) == false {
+		return "#"
+	}
+	return dest
+}
+
+func mdTitle(title string) string {
+	if title == "" {
+		return ""
+	}
+	return " title=\"" + html.EscapeString(title) + "\""
+}
+
+// mdPlain gives the text of some markdown, it's what goes in the alt of an image
+func mdPlain(s string) string {
+	return html.UnescapeString(mdTag.ReplaceAllString(mdInline(s), ""))
+}
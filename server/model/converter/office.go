@@ -0,0 +1,82 @@
+package converter
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+// libreoffice guesses the format of a document from its extension before it looks at its content
+var officeExtensions = map[string]string{
+	"application/word":                                "docx",
+	"application/msword":                              "doc",
+	"application/vnd.oasis.opendocument.text":         "odt",
+	"application/rtf":                                 "rtf",
+	"text/rtf":                                        "rtf",
+	"application/excel":                               "xlsx",
+	"application/vnd.ms-excel":                        "xls",
+	"application/vnd.oasis.opendocument.spreadsheet":  "ods",
+	"application/powerpoint":                          "pptx",
+	"application/vnd.ms-powerpoint":                   "ppt",
+	"application/vnd.oasis.opendocument.presentation": "odp",
+}
+
+/*
+ * OfficeToPdf gives the converter of a kind of office document, it relies on a headless libreoffice
+ * to do the job. Every conversion gets its own profile so conversions running at the same time
+ * don't fight over it
+ */
+func OfficeToPdf(ext string) func(*App, io.Reader, io.Writer, url.Values) error {
+	return func(ctx *App, in io.Reader, out io.Writer, options url.Values) error {
+		return officeConvert(ctx, in, out, ext, "pdf")
+	}
+}
+
+func officeConvert(ctx *App, in io.Reader, out io.Writer, ext string, to string) error {
+	bin, err := exec.LookPath("soffice")
+	if err != nil {
+		if bin, err = exec.LookPath("libreoffice"); err != nil {
+			return ErrMissingDependency
+		}
+	}
+
+	tmp := GetAbsolutePath(TMP_PATH, "office_"+QuickString(10))
+	if err = os.MkdirAll(tmp, os.ModePerm); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	f, err := os.OpenFile(filepath.Join(tmp, "document."+ext), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(
+		ctx.Context, bin, "--headless", "--norestore", "--nologo",
+		"-env:UserInstallation=file://"+filepath.ToSlash(filepath.Join(tmp, "profile")),
+		"--convert-to", to, "--outdir", tmp, filepath.Join(tmp, "document."+ext),
+	)
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		Log.Debug("converter::office err[%s] stderr[%s]", err.Error(), stderr.String())
+		return err
+	}
+	f, err = os.Open(filepath.Join(tmp, "document."+to))
+	if err != nil {
+		Log.Debug("converter::office 'no output' stderr[%s]", stderr.String())
+		return NewError("libreoffice couldn't convert this document", 400)
+	}
+	defer f.Close()
+	_, err = io.Copy(out, f)
+	return err
+}
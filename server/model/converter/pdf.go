@@ -0,0 +1,147 @@
+package converter
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/url"
+	"strings"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	IMAGE_MAX_SIZE   = 200 * 1024 * 1024
+	IMAGE_MAX_PIXELS = 100 * 1000 * 1000
+	// biggest page a pdf reader is expected to open, in points
+	PDF_MAX_PAGE_SIZE = 14400
+)
+
+/*
+ * ImageToPdf makes a pdf with a single page the size of the image. Jpeg are embedded as they are
+ * since pdf knows how to read them, the other formats are stored as compressed rgb pixels. The page
+ * is turned the way the camera says the photo should be looked at
+ */
+func ImageToPdf(ctx *App, in io.Reader, out io.Writer, options url.Values) error {
+	b, err := io.ReadAll(io.LimitReader(in, IMAGE_MAX_SIZE+1))
+	if err != nil {
+		return err
+	} else if len(b) > IMAGE_MAX_SIZE {
+		return NewError("Image is too big", 413)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return ErrNotValid
+	} else if config.Width*config.Height > IMAGE_MAX_PIXELS {
+		return NewError("Image is too big", 413)
+	}
+
+	var data []byte
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /BitsPerComponent 8", config.Width, config.Height)
+	if format == "jpeg" && (config.ColorModel == color.YCbCrModel || config.ColorModel == color.GrayModel) {
+		data = b
+		dict += " /Filter /DCTDecode /ColorSpace /DeviceRGB"
+		if config.ColorModel == color.GrayModel {
+			dict = strings.Replace(dict, "/DeviceRGB", "/DeviceGray", 1)
+		}
+	} else {
+		img, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			return ErrNotValid
+		}
+		var buf bytes.Buffer
+		z := zlib.NewWriter(&buf)
+		bounds := img.Bounds()
+		row := make([]byte, bounds.Dx()*3)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			if err = ctx.Context.Err(); err != nil {
+				return err
+			}
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				// transparent pixels are shown on white, like they would on paper
+				r, g, b, a := img.At(x, y).RGBA()
+				i := (x - bounds.Min.X) * 3
+				row[i] = byte((r + (0xffff - a)) >> 8)
+				row[i+1] = byte((g + (0xffff - a)) >> 8)
+				row[i+2] = byte((b + (0xffff - a)) >> 8)
+			}
+			z.Write(row)
+		}
+		z.Close()
+		data = buf.Bytes()
+		dict += " /Filter /FlateDecode /ColorSpace /DeviceRGB"
+	}
+
+	rotate := 0
+	if extractor, ok := Hooks.Get.MetadataExtractor()["image/"+format]; ok {
+		if m := (&MediaMetadata{}); extractor(bytes.NewReader(b), m) == nil {
+			rotate = map[int]int{3: 180, 6: 90, 8: 270}[m.Orientation]
+		}
+	}
+	b = nil
+	w, h := float64(config.Width), float64(config.Height)
+	if scale := PDF_MAX_PAGE_SIZE / max(w, h); scale < 1 {
+		w, h = w*scale, h*scale
+	}
+	content := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", w, h)
+
+	pdf := &pdfWriter{w: out}
+	pdf.Write([]byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"))
+	pdf.object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	pdf.object("<< /Type /Pages /Kids [3 0 R] /Count 1 >>", nil)
+	pdf.object(fmt.Sprintf(
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Rotate %d /Resources << /XObject << /Im0 5 0 R >> >> /Contents 4 0 R >>",
+		w, h, rotate,
+	), nil)
+	pdf.object(fmt.Sprintf("<< /Length %d >>", len(content)), []byte(content))
+	pdf.object(fmt.Sprintf("<< %s /Length %d >>", dict, len(data)), data)
+	return pdf.close()
+}
+
+// pdfWriter keeps track of where each object starts, it's what goes in the cross reference table
+type pdfWriter struct {
+	w       io.Writer
+	n       int
+	offsets []int
+	err     error
+}
+
+func (this *pdfWriter) Write(p []byte) (int, error) {
+	if this.err != nil {
+		return 0, this.err
+	}
+	n, err := this.w.Write(p)
+	this.n += n
+	this.err = err
+	return n, err
+}
+
+func (this *pdfWriter) object(dict string, stream []byte) {
+	this.offsets = append(this.offsets, this.n)
+	fmt.Fprintf(this, "%d 0 obj\n%s\n", len(this.offsets), dict)
+	if stream != nil {
+		this.Write([]byte("stream\n"))
+		this.Write(stream)
+		this.Write([]byte("\nendstream\n"))
+	}
+	this.Write([]byte("endobj\n"))
+}
+
+func (this *pdfWriter) close() error {
+	xref := this.n
+	fmt.Fprintf(this, "xref\n0 %d\n0000000000 65535 f \n", len(this.offsets)+1)
+	for _, offset := range this.offsets {
+		fmt.Fprintf(this, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(this, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(this.offsets)+1, xref)
+	return this.err
+}
@@ -0,0 +1,160 @@
+package model
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+const (
+	JOB_DISK_USAGE   = "du"
+	DU_LARGEST_FILES = 10
+)
+
+var duCache AppCache
+
+func init() {
+	duCache = NewAppCache(30, 10)
+}
+
+/*
+ * DiskUsage is the size of a folder and everything under it, the same way `du` would show it. The
+ * tree is shaped to be displayed as a treemap: children are sorted from the biggest to the smallest
+ */
+type DiskUsage struct {
+	Name     string          `json:"name"`
+	Path     string          `json:"path"`
+	Size     int64           `json:"size"`
+	Files    int64           `json:"files"`
+	Folders  int64           `json:"folders"`
+	Largest  []DiskUsageFile `json:"largest,omitempty"`
+	Children []*DiskUsage    `json:"children,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+type DiskUsageFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+/*
+ * DiskUsageGet gives back the job computing the disk usage of a path. Results are cached per
+ * connection so people can explore the tree without walking through the storage every time, a
+ * completed job on a parent folder is good enough as it already knows about the path
+ */
+func DiskUsageGet(ctx *App, path string, refresh bool) *Job {
+	id := GenerateID(ctx)
+	key := id + "::" + path
+	if v, found := duCache.Cache.Get(key); found && refresh {
+		v.(*Job).Cancel()
+	} else if found {
+		if job := v.(*Job); job.State() != JOB_FAILED && job.State() != JOB_CANCELLED {
+			return job
+		}
+	}
+	for p := path; refresh == false && p != "/"; {
+		p = strings.TrimSuffix(filepath.Dir(strings.TrimSuffix(p, "/")), "/") + "/"
+		if v, found := duCache.Cache.Get(id + "::" + p); found && v.(*Job).State() == JOB_DONE {
+			return v.(*Job)
+		}
+	}
+	job := NewJob(ctx, JOB_DISK_USAGE, func(app *App, job *Job) (interface{}, error) {
+		return diskUsageWalk(app, job, path)
+	})
+	duCache.SetKey(key, job)
+	return job
+}
+
+func diskUsageWalk(app *App, job *Job, path string) (*DiskUsage, error) {
+	if err := app.Context.Err(); err != nil {
+		return nil, err
+	}
+	node := &DiskUsage{
+		Name: filepath.Base(path),
+		Path: path,
+	}
+	for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+		if err := auth.Ls(app, path); err != nil {
+			node.Error = ErrNotAuthorized.Error()
+			return node, nil
+		}
+	}
+	entries, err := app.Backend.Ls(path)
+	if err != nil {
+		Log.Debug("model::du ls path[%s] err[%s]", path, err.Error())
+		node.Error = err.Error()
+		return node, nil
+	}
+	job.AddProgress("dirs", 1)
+	for _, entry := range entries {
+		p := filepath.Join(path, entry.Name())
+		if entry.IsDir() {
+			child, err := diskUsageWalk(app, job, p+"/")
+			if err != nil {
+				return nil, err
+			}
+			node.Size += child.Size
+			node.Files += child.Files
+			node.Folders += child.Folders + 1
+			node.Largest = append(node.Largest, child.Largest...)
+			node.Children = append(node.Children, child)
+			continue
+		}
+		job.AddProgress("files", 1)
+		job.AddProgress("bytes", entry.Size())
+		node.Size += entry.Size()
+		node.Files += 1
+		node.Largest = append(node.Largest, DiskUsageFile{Path: p, Size: entry.Size()})
+	}
+	sort.SliceStable(node.Largest, func(i, j int) bool {
+		return node.Largest[i].Size > node.Largest[j].Size
+	})
+	if len(node.Largest) > DU_LARGEST_FILES {
+		node.Largest = node.Largest[:DU_LARGEST_FILES]
+	}
+	sort.SliceStable(node.Children, func(i, j int) bool {
+		return node.Children[i].Size > node.Children[j].Size
+	})
+	return node, nil
+}
+
+// Prune gives a copy of the tree down to a given depth with paths relative to a chroot
+func (this *DiskUsage) Prune(depth int, chroot string) *DiskUsage {
+	rel := func(p string) string {
+		if chroot == "" {
+			return p
+		}
+		return "/" + strings.TrimPrefix(p, chroot)
+	}
+	node := *this
+	node.Path = rel(this.Path)
+	node.Largest = make([]DiskUsageFile, len(this.Largest))
+	for i := range this.Largest {
+		node.Largest[i] = DiskUsageFile{Path: rel(this.Largest[i].Path), Size: this.Largest[i].Size}
+	}
+	node.Children = nil
+	if depth <= 0 {
+		return &node
+	}
+	for _, c := range this.Children {
+		node.Children = append(node.Children, c.Prune(depth-1, chroot))
+	}
+	return &node
+}
+
+// Find gives the node of the tree for a path
+func (this *DiskUsage) Find(path string) *DiskUsage {
+	if this.Path == path {
+		return this
+	} else if strings.HasPrefix(path, this.Path) == false {
+		return nil
+	}
+	for _, c := range this.Children {
+		if n := c.Find(path); n != nil {
+			return n
+		}
+	}
+	return nil
+}
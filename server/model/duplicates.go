@@ -0,0 +1,160 @@
+package model
+
+import (
+	"io"
+	"path/filepath"
+	"sort"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+// files smaller than this are fully hashed in the partial hash pass
+const DUPLICATE_PARTIAL_SIZE = 64 * 1024
+
+type DuplicateGroup struct {
+	Size   int64    `json:"size"`
+	Hash   string   `json:"hash"`
+	Files  []string `json:"files"`
+	Wasted int64    `json:"wasted"`
+}
+
+/*
+ * FindDuplicates walks through a path looking for files with the exact same content. To avoid
+ * reading everything, candidates are narrowed down in steps:
+ * 1. files of the same size
+ * 2. among those, files starting with the same bytes
+ * 3. among those, files with the same content
+ */
+func FindDuplicates(app *App, job *Job, root string) ([]DuplicateGroup, error) {
+	bySize := map[int64][]string{}
+	toVisit := []string{root}
+	for len(toVisit) > 0 {
+		if err := app.Context.Err(); err != nil {
+			return nil, err
+		}
+		current := toVisit[0]
+		toVisit = toVisit[1:]
+		if duplicateCanAccess(app, current, true) == false {
+			continue
+		}
+		entries, err := app.Backend.Ls(current)
+		if err != nil {
+			Log.Debug("model::duplicates ls path[%s] err[%s]", current, err.Error())
+			continue
+		}
+		job.AddProgress("dirs", 1)
+		for _, entry := range entries {
+			p := filepath.Join(current, entry.Name())
+			if entry.IsDir() {
+				toVisit = append(toVisit, p+"/")
+				continue
+			} else if entry.Size() <= 0 {
+				continue
+			}
+			job.AddProgress("files", 1)
+			bySize[entry.Size()] = append(bySize[entry.Size()], p)
+		}
+	}
+
+	groups := []DuplicateGroup{}
+	for size, paths := range bySize {
+		if len(paths) < 2 {
+			continue
+		}
+		job.AddProgress("candidates", int64(len(paths)))
+		partials, err := duplicateHash(app, job, paths, size, DUPLICATE_PARTIAL_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		for partial, samePartial := range partials {
+			if len(samePartial) < 2 {
+				continue
+			} else if size <= DUPLICATE_PARTIAL_SIZE {
+				groups = append(groups, DuplicateGroup{Size: size, Hash: partial, Files: samePartial})
+				continue
+			}
+			fulls, err := duplicateHash(app, job, samePartial, size, size)
+			if err != nil {
+				return nil, err
+			}
+			for full, sameContent := range fulls {
+				if len(sameContent) < 2 {
+					continue
+				}
+				groups = append(groups, DuplicateGroup{Size: size, Hash: full, Files: sameContent})
+			}
+		}
+	}
+	for i := range groups {
+		sort.Strings(groups[i].Files)
+		groups[i].Wasted = groups[i].Size * int64(len(groups[i].Files)-1)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Wasted == groups[j].Wasted {
+			return groups[i].Files[0] < groups[j].Files[0]
+		}
+		return groups[i].Wasted > groups[j].Wasted
+	})
+	return groups, nil
+}
+
+// duplicateHash groups files by the hash of their first n bytes. Files we couldn't read entirely
+// are left out as a truncated read would make them look like duplicates of something else
+func duplicateHash(app *App, job *Job, paths []string, size int64, n int64) (map[string][]string, error) {
+	if n > size {
+		n = size
+	}
+	hashes := map[string][]string{}
+	for _, p := range paths {
+		if err := app.Context.Err(); err != nil {
+			return nil, err
+		} else if duplicateCanAccess(app, p, false) == false {
+			continue
+		}
+		reader, err := app.Backend.Cat(p)
+		if err != nil {
+			Log.Debug("model::duplicates cat path[%s] err[%s]", p, err.Error())
+			continue
+		}
+		counter := &duplicateCounter{Reader: io.LimitReader(reader, n)}
+		h := HashStream(counter, 0)
+		reader.Close()
+		job.AddProgress("hashed", counter.n)
+		if counter.err != nil || counter.n != n {
+			Log.Debug("model::duplicates read path[%s] size[%d] read[%d]", p, n, counter.n)
+			continue
+		}
+		hashes[h] = append(hashes[h], p)
+	}
+	return hashes, nil
+}
+
+func duplicateCanAccess(app *App, path string, isDir bool) bool {
+	for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+		var err error
+		if isDir {
+			err = auth.Ls(app, path)
+		} else {
+			err = auth.Cat(app, path)
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+type duplicateCounter struct {
+	io.Reader
+	n   int64
+	err error
+}
+
+func (this *duplicateCounter) Read(p []byte) (int, error) {
+	n, err := this.Reader.Read(p)
+	this.n += int64(n)
+	if err != nil && err != io.EOF {
+		this.err = err
+	}
+	return n, err
+}
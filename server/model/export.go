@@ -0,0 +1,137 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	_ "github.com/mickael-kerjean/filestash/server/model/converter"
+)
+
+var EXPORT_TIMEOUT func() int
+
+// exports are kept around for people downloading the same thing again, not forever
+const EXPORT_CACHE_RETENTION = 24 * time.Hour
+
+func init() {
+	EXPORT_TIMEOUT = func() int {
+		return Config.Get("features.export.timeout").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "export_timeout"
+			f.Name = "timeout"
+			f.Type = "number"
+			f.Description = "Time in seconds after which we give up on converting a document when it is exported"
+			f.Placeholder = "Default: 60"
+			f.Default = 60
+			return f
+		}).Int()
+	}
+	EXPORT_TIMEOUT()
+
+	go func() {
+		for {
+			exportCacheClean()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+/*
+ * Export gives the content of a file converted to another mime type by one of the registered
+ * converters. The result is cached on disk under the modification time and the size of the file
+ * so exporting an unchanged document again doesn't run the conversion twice
+ */
+func Export(ctx *App, path string, mType string, options map[string][]string) (io.ReadCloser, error) {
+	fromMime := GetMimeType(path)
+	if fromMime == mType && (mType == "text/org" || strings.HasPrefix(mType, "image/")) {
+		// other files aren't given as they are, they would be rendered by the browser on our origin
+		return ctx.Backend.Cat(path)
+	}
+	convert := Hooks.Get.Converter(fromMime, mType)
+	if convert == nil {
+		return nil, ErrNotImplemented
+	}
+
+	key := ""
+	if f, err := FileStat(ctx, path); err == nil && f.ModTime().IsZero() == false {
+		key = Hash(fmt.Sprintf("%s %s %d %d %s %v", GenerateID(ctx), path, f.ModTime().UnixNano(), f.Size(), mType, options), 32)
+		if file, err := os.Open(GetAbsolutePath(EXPORT_PATH, key)); err == nil {
+			return file, nil
+		}
+	}
+
+	reader, err := ctx.Backend.Cat(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	tmp := GetAbsolutePath(EXPORT_PATH, "tmp_"+QuickString(20))
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, ErrFilesystemError
+	}
+
+	timeout, cancel := context.WithTimeout(ctx.Context, time.Duration(EXPORT_TIMEOUT())*time.Second)
+	defer cancel()
+	app := *ctx
+	app.Context = timeout
+	done := make(chan error, 1)
+	go func() {
+		done <- convert(&app, reader, out, options)
+	}()
+	select {
+	case err = <-done:
+	case <-timeout.Done():
+		err = timeout.Err()
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(tmp)
+		Log.Debug("model::export path[%s] mime[%s] err[%s]", path, mType, err.Error())
+		if timeout.Err() == context.DeadlineExceeded {
+			return nil, NewError("The conversion took too long", 504)
+		} else if _, ok := err.(AppError); ok {
+			return nil, err
+		}
+		return nil, NewError(fmt.Sprintf("Unable to convert this file: '%s'", err.Error()), 400)
+	}
+	if _, err = out.Seek(0, io.SeekStart); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return nil, ErrFilesystemError
+	}
+	if key != "" && os.Rename(tmp, GetAbsolutePath(EXPORT_PATH, key)) == nil {
+		return out, nil
+	}
+	return &exportFile{out, tmp}, nil
+}
+
+// exportFile is an export we couldn't cache, it's gone once it has been sent
+type exportFile struct {
+	*os.File
+	path string
+}
+
+func (this *exportFile) Close() error {
+	err := this.File.Close()
+	os.Remove(this.path)
+	return err
+}
+
+func exportCacheClean() {
+	entries, err := os.ReadDir(GetAbsolutePath(EXPORT_PATH))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > EXPORT_CACHE_RETENTION {
+			os.Remove(GetAbsolutePath(EXPORT_PATH, entry.Name()))
+		}
+	}
+}
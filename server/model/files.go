@@ -3,51 +3,64 @@ package model
 import (
 	"fmt"
 	. "github.com/mickael-kerjean/filestash/server/common"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 )
 
+// files are often looked at in bursts, eg: when a folder with many photos is open
+var lsCache AppCache = NewQuickCache(10, 20)
+
 func NewBackend(ctx *App, conn map[string]string) (IBackend, error) {
-	isAllowed := func() bool {
-		// by default, a hacker could use filestash to establish connections outside of what's
-		// define in the config file. We need to prevent this
-		possibilities := make([]map[string]interface{}, 0)
-		for i := 0; i < len(Config.Conn); i++ {
-			d := Config.Conn[i]
-			if d["type"] != conn["type"] {
+	// by default, a hacker could use filestash to establish connections outside of what's
+	// define in the config file. We need to prevent this
+	if len(ConnectionsMatching(conn)) == 0 {
+		return Backend.Get(BACKEND_NIL), ErrNotAllowed
+	}
+	b, err := Backend.Get(conn["type"]).Init(conn, ctx)
+	if err != nil {
+		return b, err
+	}
+	for _, fn := range Hooks.Get.BackendMiddleware() {
+		b = fn(b, conn, ctx)
+	}
+	return b, nil
+}
+
+// ConnectionsMatching returns the connections from the config file a session could belong to
+func ConnectionsMatching(conn map[string]string) []map[string]interface{} {
+	possibilities := make([]map[string]interface{}, 0)
+	for i := 0; i < len(Config.Conn); i++ {
+		d := Config.Conn[i]
+		if d["type"] != conn["type"] {
+			continue
+		}
+		if val, ok := d["hostname"]; ok == true {
+			if val != conn["hostname"] {
 				continue
 			}
-			if val, ok := d["hostname"]; ok == true {
-				if val != conn["hostname"] {
-					continue
-				}
-			}
-			if val, ok := d["path"]; ok == true {
-				if val == nil {
-					val = "/"
-				}
-				if configPath, ok := val.(string); ok == false {
-					continue
-				} else if strings.HasPrefix(conn["path"], configPath) == false {
-					continue
-				}
+		}
+		if val, ok := d["path"]; ok == true {
+			if val == nil {
+				val = "/"
 			}
-			if val, ok := d["url"]; ok == true {
-				if val != conn["url"] {
-					continue
-				}
+			if configPath, ok := val.(string); ok == false {
+				continue
+			} else if strings.HasPrefix(conn["path"], configPath) == false {
+				continue
 			}
-			possibilities = append(possibilities, Config.Conn[i])
 		}
-		if len(possibilities) > 0 {
-			return true
+		if val, ok := d["url"]; ok == true {
+			if val != conn["url"] {
+				continue
+			}
 		}
-		return false
-	}
-
-	if isAllowed() == false {
-		return Backend.Get(BACKEND_NIL), ErrNotAllowed
+		possibilities = append(possibilities, Config.Conn[i])
 	}
-	return Backend.Get(conn["type"]).Init(conn, ctx)
+	return possibilities
 }
 
 func GetHome(b IBackend, base string) (string, error) {
@@ -82,3 +95,274 @@ func MapStringInterfaceToMapStringString(m map[string]interface{}) map[string]st
 	}
 	return res
 }
+
+/*
+ * FileStat gives the information a backend has about a file. Backends don't have a stat method, we
+ * list the parent folder and keep the result around for a few seconds as the siblings of a file are
+ * usually the next ones we're asked about
+ */
+func FileStat(ctx *App, path string) (os.FileInfo, error) {
+	id := GenerateID(ctx)
+	parent := EnforceDirectory(filepath.Dir(path))
+	var files map[string]os.FileInfo
+	if v, found := lsCache.Cache.Get(id + parent); found {
+		files = v.(map[string]os.FileInfo)
+	} else {
+		entries, err := ctx.Backend.Ls(parent)
+		if err != nil {
+			return nil, err
+		}
+		files = make(map[string]os.FileInfo, len(entries))
+		for _, entry := range entries {
+			files[entry.Name()] = entry
+		}
+		lsCache.SetKey(id+parent, files)
+	}
+	f, ok := files[filepath.Base(path)]
+	if ok == false {
+		return nil, ErrNotFound
+	}
+	return f, nil
+}
+
+/*
+ * FileContentBeforeSave gives the content to save once it has gone through the plugins. Some of
+ * them use resources they only release when closed so the result must be closed once the save is
+ * over, whether it worked or not
+ */
+func FileContentBeforeSave(ctx *App, path string, r io.Reader) (io.ReadCloser, error) {
+	file := r
+	for _, obj := range Hooks.Get.ProcessFileContentBeforeSave() {
+		next, err := obj(file, ctx, path)
+		if err != nil {
+			if c, ok := file.(io.Closer); ok {
+				c.Close()
+			}
+			return nil, err
+		}
+		file = next
+	}
+	if c, ok := file.(io.ReadCloser); ok {
+		return c, nil
+	}
+	return io.NopCloser(file), nil
+}
+
+/*
+ * FileSave is what every way of writing a file goes through: the api, webdav and the editors. It
+ * takes care of the authorisation, the preconditions, the quotas and the plugins so they can't
+ * drift apart. Size is the expected size of the content or -1 when we don't know about it
+ */
+func FileSave(ctx *App, path string, r io.Reader, size int64, ifMatch string, ifNoneMatch string) error {
+	for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+		if err := auth.Save(ctx, path); err != nil {
+			Log.Info("model::save auth '%s'", err.Error())
+			return ErrNotAuthorized
+		}
+	}
+
+	unlock := FileLock(ctx, path)
+	defer unlock()
+	if err := FilePrecondition(ctx, path, ifMatch, ifNoneMatch); err != nil {
+		return err
+	}
+
+	quotas := QuotaGet(ctx)
+	var previousSize int64 = 0
+	existed := false
+	if len(quotas) > 0 {
+		if f, err := fileStatFresh(ctx, path); err == nil {
+			previousSize, existed = f.Size(), true
+		}
+	}
+	// what is being replaced is given back once the save is done
+	if size < 0 || size > previousSize {
+		if err := quotas.Check(size - previousSize); err != nil {
+			return err
+		}
+	}
+	file, err := FileContentBeforeSave(ctx, path, r)
+	if err != nil {
+		return err
+	}
+	// we can't tell if an overwrite will fit until it's done, it is written next to the file it
+	// replaces so the original is still there when the quota is reached
+	target := path
+	if existed {
+		dir, name := SplitPath(path)
+		target = dir + "." + name + ".upload-" + QuickString(8)
+	}
+	body := quotas.Reader(file, previousSize)
+	err = ctx.Backend.Save(target, body)
+	file.Close()
+	if body.Exceeded {
+		Log.Debug("model::save quota exceeded path[%s]", path)
+		// what made it through is only the beginning of the file, not worth keeping around
+		ctx.Backend.Rm(target)
+		quotas.Stale(ctx)
+		return ErrInsufficientStorage
+	} else if err != nil {
+		if target != path {
+			ctx.Backend.Rm(target)
+		}
+		return err
+	} else if target != path {
+		// not every storage can rename over an existing file
+		if err = ctx.Backend.Mv(target, path); err != nil {
+			if ctx.Backend.Rm(path) != nil {
+				ctx.Backend.Rm(target)
+				return err
+			} else if err = ctx.Backend.Mv(target, path); err != nil {
+				Log.Warning("model::save rename path[%s] upload[%s] err[%s]", path, target, err.Error())
+				return err
+			}
+		}
+	}
+	quotas.Add(body.N - previousSize)
+	EmitEvent(Event{Type: EVENT_FILE_SAVE, Path: path, App: ctx})
+	return nil
+}
+
+/*
+ * FileETag gives an entity tag for a file that changes whenever its content does. As we don't
+ * read the content, it's made of the modification time and the size reported by the backend, which
+ * means a backend that doesn't know when a file was changed can't give any
+ */
+func FileETag(f os.FileInfo) string {
+	if f == nil || f.IsDir() || f.ModTime().IsZero() {
+		return ""
+	}
+	// same format as the default of our webdav server so both can be used interchangeably
+	return fmt.Sprintf(`"%x%x"`, f.ModTime().UnixNano(), f.Size())
+}
+
+// FileVersion gives the current entity tag of a file
+func FileVersion(ctx *App, path string) (string, error) {
+	f, err := fileStatFresh(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	return FileETag(f), nil
+}
+
+/*
+ * FilePrecondition verifies the If-Match and If-None-Match headers of a request against the
+ * current version of a file, which is what prevents 2 people editing the same document from
+ * silently overwriting each other's changes
+ */
+func FilePrecondition(ctx *App, path string, ifMatch string, ifNoneMatch string) error {
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	etag := ""
+	f, err := fileStatFresh(ctx, path)
+	if err == nil {
+		etag = FileETag(f)
+	} else if err != ErrNotFound {
+		return err
+	}
+	if ifMatch != "" {
+		if f == nil || (etagMatch(ifMatch, etag) == false) {
+			Log.Debug("model::precondition if-match path[%s] etag[%s] expected[%s]", path, etag, ifMatch)
+			return ErrPreconditionFailed
+		}
+	}
+	if ifNoneMatch != "" && f != nil {
+		if strings.TrimSpace(ifNoneMatch) == "*" || etagMatch(ifNoneMatch, etag) {
+			Log.Debug("model::precondition if-none-match path[%s] etag[%s] expected[%s]", path, etag, ifNoneMatch)
+			return ErrPreconditionFailed
+		}
+	}
+	return nil
+}
+
+// the folder listing we might have in cache, ours or the one of the backend, can be a few seconds
+// old, not good enough to tell which version of a file is the current one
+func fileStatFresh(ctx *App, path string) (os.FileInfo, error) {
+	parent := EnforceDirectory(filepath.Dir(path))
+	lsCache.Cache.Delete(GenerateID(ctx) + parent)
+	if obj, ok := ctx.Backend.(interface{ Refresh(path string) }); ok {
+		obj.Refresh(parent)
+	}
+	return FileStat(ctx, path)
+}
+
+func etagMatch(header string, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	} else if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writes going through the same path are serialised so a precondition can't be checked by 2
+// requests before either of them has saved anything
+var (
+	fileLocks   = map[string]*fileLock{}
+	fileLocksMu sync.Mutex
+)
+
+type fileLock struct {
+	sync.Mutex
+	key string
+	n   int
+}
+
+/*
+ * FileLock serialises the writes made on some files. It is shared by everyone using the same storage,
+ * whoever they are logged in as, so 2 people saving the same document wait for one another
+ */
+func FileLock(ctx *App, paths ...string) func() {
+	keys := make([]string, len(paths))
+	for i, path := range paths {
+		keys[i] = storageID(ctx) + "::" + path
+	}
+	// always taken in the same order so 2 requests can't end up waiting for each other
+	sort.Strings(keys)
+	locks := make([]*fileLock, 0, len(keys))
+	fileLocksMu.Lock()
+	for i, key := range keys {
+		if i > 0 && keys[i-1] == key {
+			continue
+		}
+		l, ok := fileLocks[key]
+		if ok == false {
+			l = &fileLock{key: key}
+			fileLocks[key] = l
+		}
+		l.n += 1
+		locks = append(locks, l)
+	}
+	fileLocksMu.Unlock()
+
+	for _, l := range locks {
+		l.Lock()
+	}
+	return func() {
+		fileLocksMu.Lock()
+		for _, l := range locks {
+			l.Unlock()
+			if l.n -= 1; l.n == 0 {
+				delete(fileLocks, l.key)
+			}
+		}
+		fileLocksMu.Unlock()
+	}
+}
+
+// storageID identifies the storage a session is connected to, leaving aside who is connected to it
+func storageID(ctx *App) string {
+	p := ""
+	for _, key := range []string{"type", "hostname", "host", "port", "url", "endpoint", "region", "bucket", "repository"} {
+		if val := ctx.Session[key]; val != "" {
+			p += key + "=>" + val + ", "
+		}
+	}
+	return Hash(p, 20)
+}
@@ -0,0 +1,106 @@
+package formater
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+// EmlFormater extracts the headers people search on and the readable parts of an email
+func EmlFormater(r io.ReadCloser) (io.ReadCloser, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	content := bytes.NewBuffer([]byte{})
+	dec := new(mime.WordDecoder)
+	for _, key := range []string{"Subject", "From", "To", "Cc", "Date"} {
+		value := msg.Header.Get(key)
+		if value == "" {
+			continue
+		} else if decoded, err := dec.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+		content.WriteString(key + ": " + value + "\n")
+	}
+	content.WriteString("\n")
+	if err = emlPart(
+		msg.Header.Get("Content-Type"),
+		msg.Header.Get("Content-Transfer-Encoding"),
+		msg.Body,
+		content,
+	); err != nil {
+		return nil, err
+	}
+	return NewReadCloserFromReader(content), nil
+}
+
+func emlPart(contentType string, encoding string, body io.Reader, w *bytes.Buffer) error {
+	mType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mType = "text/plain"
+	}
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	if strings.HasPrefix(mType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		parts := []*bytes.Buffer{}
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			buf := bytes.NewBuffer([]byte{})
+			// NextPart already takes care of the quoted-printable encoding
+			if err = emlPart(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p, buf); err != nil {
+				return err
+			}
+			parts = append(parts, buf)
+		}
+		if mType == "multipart/alternative" {
+			// all the parts are the same content in different formats, the first one is enough
+			for _, p := range parts {
+				if p.Len() > 0 {
+					w.Write(p.Bytes())
+					return nil
+				}
+			}
+			return nil
+		}
+		for _, p := range parts {
+			w.Write(p.Bytes())
+			w.WriteString("\n")
+		}
+		return nil
+	}
+
+	switch mType {
+	case "text/plain":
+		_, err = io.Copy(w, body)
+		return err
+	case "text/html":
+		return htmlToText(body, w)
+	case "message/rfc822":
+		rc, err := EmlFormater(NewReadCloserFromReader(body))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, rc)
+		return err
+	}
+	return nil
+}
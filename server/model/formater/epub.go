@@ -0,0 +1,44 @@
+package formater
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+// EpubFormater goes through the html documents an ebook is made of
+func EpubFormater(r io.ReadCloser) (io.ReadCloser, error) {
+	z, cleanup, err := openZip(r)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	hasData := false
+	content := bytes.NewBuffer([]byte{})
+	for _, f := range z.File {
+		switch strings.ToLower(filepath.Ext(f.Name)) {
+		case ".xhtml", ".html", ".htm":
+		default:
+			continue
+		}
+		o, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = htmlToText(o, content)
+		o.Close()
+		if err != nil {
+			return nil, err
+		}
+		content.WriteString("\n")
+		hasData = true
+	}
+	if hasData == false {
+		return nil, ErrNotFound
+	}
+	return NewReadCloserFromReader(content), nil
+}
@@ -0,0 +1,59 @@
+package formater
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"golang.org/x/net/html"
+)
+
+// HtmlFormater keeps the text of a page, leaving aside the tags and what isn't meant to be read
+func HtmlFormater(r io.ReadCloser) (io.ReadCloser, error) {
+	content := bytes.NewBuffer([]byte{})
+	if err := htmlToText(r, content); err != nil {
+		return nil, err
+	}
+	return NewReadCloserFromReader(content), nil
+}
+
+func htmlToText(r io.Reader, w *bytes.Buffer) error {
+	z := html.NewTokenizer(r)
+	skip := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style", "noscript", "template", "svg":
+				skip += 1
+			case "br", "p", "div", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6":
+				w.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style", "noscript", "template", "svg":
+				if skip > 0 {
+					skip -= 1
+				}
+			case "td", "th":
+				w.WriteString(" ")
+			}
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			if txt := strings.TrimSpace(string(z.Text())); txt != "" {
+				w.WriteString(txt)
+				w.WriteString(" ")
+			}
+		}
+	}
+}
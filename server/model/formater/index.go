@@ -0,0 +1,164 @@
+package formater
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+var (
+	EXTRACTOR_MAX_SIZE  func() int
+	EXTRACTOR_TIMEOUT   func() int
+	ErrDocumentTooLarge = NewError("Document too large to be extracted", 413)
+)
+
+func init() {
+	EXTRACTOR_MAX_SIZE = func() int {
+		return Config.Get("features.search.extractor_max_size").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "extractor_max_size"
+			f.Name = "extractor_max_size"
+			f.Type = "number"
+			f.Description = "Maximum amount of data in bytes read from a document and extracted as text when indexing it"
+			f.Placeholder = "Default: 10MB"
+			f.Default = 10 * 1024 * 1024
+			return f
+		}).Int()
+	}
+	EXTRACTOR_MAX_SIZE()
+	EXTRACTOR_TIMEOUT = func() int {
+		return Config.Get("features.search.extractor_timeout").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "extractor_timeout"
+			f.Name = "extractor_timeout"
+			f.Type = "number"
+			f.Description = "Time in seconds after which we give up on extracting the text out of a document"
+			f.Placeholder = "Default: 10s"
+			f.Default = 10
+			return f
+		}).Int()
+	}
+	EXTRACTOR_TIMEOUT()
+
+	for _, mType := range []string{"text/plain", "text/org", "text/markdown", "application/x-form"} {
+		Hooks.Register.ContentExtractor(mType, TxtFormater)
+	}
+	Hooks.Register.ContentExtractor("application/pdf", PdfFormater)
+	for _, mType := range []string{
+		"application/word", "application/msword",
+		"application/powerpoint", "application/vnd.ms-powerpoint",
+		"application/excel",
+	} {
+		Hooks.Register.ContentExtractor(mType, OfficeFormater)
+	}
+	for _, mType := range []string{
+		"application/vnd.oasis.opendocument.text",
+		"application/vnd.oasis.opendocument.spreadsheet",
+		"application/vnd.oasis.opendocument.presentation",
+	} {
+		Hooks.Register.ContentExtractor(mType, OpenDocumentFormater)
+	}
+	Hooks.Register.ContentExtractor("application/epub+zip", EpubFormater)
+	Hooks.Register.ContentExtractor("text/html", HtmlFormater)
+	Hooks.Register.ContentExtractor("application/xhtml+xml", HtmlFormater)
+	Hooks.Register.ContentExtractor("application/rtf", RtfFormater)
+	Hooks.Register.ContentExtractor("text/rtf", RtfFormater)
+	Hooks.Register.ContentExtractor("message/rfc822", EmlFormater)
+}
+
+/*
+ * Extract finds the extractor registered for a mime type and runs it. Documents bigger than the
+ * configured size aren't extracted at all as most formats can't be read from a truncated copy, the
+ * text we get back is capped to the same size and the whole process has to complete within the
+ * configured timeout
+ */
+func Extract(mType string, r io.ReadCloser) (io.ReadCloser, error) {
+	fn := Hooks.Get.ContentExtractor()[mType]
+	if fn == nil {
+		return nil, ErrNotSupported
+	}
+	maxSize := int64(EXTRACTOR_MAX_SIZE())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(EXTRACTOR_TIMEOUT())*time.Second)
+	defer cancel()
+	type result struct {
+		content []byte
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				Log.Warning("formater::extract panic mime[%s] err[%v]", mType, rec)
+				done <- result{nil, ErrInternal}
+			}
+		}()
+		data, err := ioutil.ReadAll(&extractorReader{io.LimitReader(r, maxSize+1), ctx})
+		if err != nil {
+			done <- result{nil, err}
+			return
+		} else if int64(len(data)) > maxSize {
+			Log.Debug("formater::extract skip mime[%s] size[>%d]", mType, maxSize)
+			done <- result{nil, ErrDocumentTooLarge}
+			return
+		}
+		out, err := fn(&extractorReader{bytes.NewReader(data), ctx})
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(&extractorReader{out, ctx}, maxSize))
+		out.Close()
+		done <- result{content, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return NewReadCloserFromBytes(res.content), nil
+	case <-ctx.Done():
+		Log.Debug("formater::extract timeout mime[%s]", mType)
+		return nil, ErrTimeout
+	}
+}
+
+/*
+ * extractorReader is what extractors read from. It stops working once we gave up on the
+ * extraction so they don't keep going in the background, extractors which run other programs
+ * get the deadline through the Context method to stop them as well
+ */
+type extractorReader struct {
+	reader io.Reader
+	ctx    context.Context
+}
+
+func (this *extractorReader) Read(p []byte) (int, error) {
+	if err := this.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return this.reader.Read(p)
+}
+
+func (this *extractorReader) Close() error {
+	return nil
+}
+
+func (this *extractorReader) Context() context.Context {
+	return this.ctx
+}
+
+func contextOf(r io.Reader) context.Context {
+	if obj, ok := r.(interface{ Context() context.Context }); ok {
+		return obj.Context()
+	}
+	return context.Background()
+}
@@ -40,6 +40,9 @@ func OfficeFormater(r io.ReadCloser) (io.ReadCloser, error) {
 		if strings.HasPrefix(f.Name, "ppt/slides/slide") {
 			shouldExtract = true
 		}
+		if f.Name == "xl/sharedStrings.xml" || strings.HasPrefix(f.Name, "xl/worksheets/sheet") {
+			shouldExtract = true
+		}
 
 		if shouldExtract == false {
 			continue
@@ -0,0 +1,80 @@
+package formater
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"os"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+// OpenDocumentFormater handles documents from LibreOffice & co: odt, ods and odp
+func OpenDocumentFormater(r io.ReadCloser) (io.ReadCloser, error) {
+	z, cleanup, err := openZip(r)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	for _, f := range z.File {
+		if f.Name != "content.xml" {
+			continue
+		}
+		o, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer o.Close()
+		content := bytes.NewBuffer([]byte{})
+		dec := xml.NewDecoder(o)
+		for {
+			t, err := dec.Token()
+			if err != nil {
+				break
+			}
+			switch el := t.(type) {
+			case xml.CharData:
+				content.Write(el)
+			case xml.StartElement:
+				switch el.Name.Local {
+				case "s", "tab":
+					content.WriteString(" ")
+				case "line-break":
+					content.WriteString("\n")
+				}
+			case xml.EndElement:
+				switch el.Name.Local {
+				case "p", "h", "table-cell":
+					content.WriteString("\n")
+				}
+			}
+		}
+		return NewReadCloserFromReader(content), nil
+	}
+	return nil, ErrNotFound
+}
+
+// openZip gives access to an archive we only have a stream for by keeping a copy on disk
+func openZip(r io.Reader) (*zip.Reader, func(), error) {
+	f, err := os.CreateTemp(GetAbsolutePath(TMP_PATH), "formater_*.zip")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	size, err := io.Copy(f, r)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	z, err := zip.NewReader(f, size)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return z, cleanup, nil
+}
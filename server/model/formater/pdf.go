@@ -24,7 +24,7 @@ func PdfFormater(r io.ReadCloser) (io.ReadCloser, error) {
 	}
 	f.Close()
 
-	cmd := exec.Command("pdftotext", tmpName, "-")
+	cmd := exec.CommandContext(contextOf(r), "pdftotext", tmpName, "-")
 	out := bytes.NewBuffer([]byte{})
 	cmd.Stdout = out
 	err = cmd.Run()
@@ -0,0 +1,173 @@
+package formater
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"unicode/utf16"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+// groups which don't contain any of the text of the document
+var rtfIgnoredDestinations = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true, "pict": true,
+	"header": true, "footer": true, "headerl": true, "headerr": true, "footerl": true,
+	"footerr": true, "listtable": true, "listoverridetable": true, "rsidtbl": true,
+	"generator": true, "themedata": true, "colorschememapping": true, "latentstyles": true,
+	"datastore": true, "xmlnstbl": true, "object": true, "fldinst": true,
+}
+
+// RtfFormater is a small rtf reader that only cares about the text, formatting is dropped
+func RtfFormater(r io.ReadCloser) (io.ReadCloser, error) {
+	in := bufio.NewReader(r)
+	out := bytes.NewBuffer([]byte{})
+
+	type state struct {
+		ignore bool
+		uc     int // number of fallback characters that follow an unicode character
+	}
+	stack := []state{{false, 1}}
+	curr := &stack[0]
+	skipFallback := 0
+	var pendingSurrogate rune
+
+	emit := func(str string) {
+		if curr.ignore == false {
+			out.WriteString(str)
+		}
+	}
+	for {
+		c, err := in.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch c {
+		case '{':
+			stack = append(stack, *curr)
+			curr = &stack[len(stack)-1]
+			skipFallback = 0
+		case '}':
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+				curr = &stack[len(stack)-1]
+			}
+			skipFallback = 0
+		case '\r', '\n':
+		case '\\':
+			word, param, hasParam, symbol := rtfControl(in)
+			if symbol != 0 {
+				switch symbol {
+				case '*':
+					curr.ignore = true
+				case '\'':
+					hex := make([]byte, 2)
+					if _, err := io.ReadFull(in, hex); err != nil {
+						break
+					}
+					if skipFallback > 0 {
+						skipFallback -= 1
+						break
+					}
+					if b, err := strconv.ParseUint(string(hex), 16, 8); err == nil {
+						// windows-1252 is close enough to latin1 for search purposes
+						emit(string(rune(b)))
+					}
+				case '~':
+					emit(" ")
+				case '-', '_':
+				default:
+					emit(string(symbol))
+				}
+				continue
+			}
+			if rtfIgnoredDestinations[word] {
+				curr.ignore = true
+				continue
+			}
+			switch word {
+			case "par", "line", "sect", "page", "row":
+				emit("\n")
+			case "tab", "cell":
+				emit(" ")
+			case "uc":
+				if hasParam {
+					curr.uc = param
+				}
+			case "u":
+				if hasParam == false {
+					break
+				}
+				if param < 0 {
+					param += 65536
+				}
+				ch := rune(param)
+				if utf16.IsSurrogate(ch) && pendingSurrogate == 0 {
+					pendingSurrogate = ch
+				} else if pendingSurrogate != 0 {
+					emit(string(utf16.DecodeRune(pendingSurrogate, ch)))
+					pendingSurrogate = 0
+				} else {
+					emit(string(ch))
+				}
+				skipFallback = curr.uc
+			}
+		default:
+			if skipFallback > 0 {
+				skipFallback -= 1
+				continue
+			}
+			emit(string(c))
+		}
+	}
+	return NewReadCloserFromReader(out), nil
+}
+
+// rtfControl reads what comes after a backslash: either a control word with its optional
+// numeric parameter or a control symbol
+func rtfControl(in *bufio.Reader) (word string, param int, hasParam bool, symbol byte) {
+	c, err := in.ReadByte()
+	if err != nil {
+		return "", 0, false, 0
+	}
+	if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+		return "", 0, false, c
+	}
+	name := []byte{c}
+	for {
+		if c, err = in.ReadByte(); err != nil {
+			return string(name), 0, false, 0
+		}
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			name = append(name, c)
+			continue
+		}
+		break
+	}
+	num := []byte{}
+	if c == '-' || (c >= '0' && c <= '9') {
+		num = append(num, c)
+		for {
+			if c, err = in.ReadByte(); err != nil {
+				break
+			}
+			if c >= '0' && c <= '9' {
+				num = append(num, c)
+				continue
+			}
+			break
+		}
+	}
+	if err == nil && c != ' ' {
+		in.UnreadByte()
+	}
+	if len(num) > 0 {
+		if n, err := strconv.Atoi(string(num)); err == nil {
+			return string(name), n, true, 0
+		}
+	}
+	return string(name), 0, false, 0
+}
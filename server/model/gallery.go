@@ -0,0 +1,264 @@
+package model
+
+import (
+	"database/sql"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+const (
+	JOB_GALLERY         = "gallery"
+	GALLERY_GROUP_DAY   = "day"
+	GALLERY_GROUP_MONTH = "month"
+	GALLERY_GROUP_YEAR  = "year"
+)
+
+var (
+	galleryJobs   AppCache
+	galleryGroups = map[string][2]string{ // how a group is named in go and in sqlite
+		GALLERY_GROUP_DAY:   {"2006-01-02", "%Y-%m-%d"},
+		GALLERY_GROUP_MONTH: {"2006-01", "%Y-%m"},
+		GALLERY_GROUP_YEAR:  {"2006", "%Y"},
+	}
+)
+
+func init() {
+	// once the index of a folder is older than that, the next visit refreshes it
+	galleryJobs = NewAppCache(60, 10)
+}
+
+type Photo struct {
+	Path        string    `json:"path"`
+	Name        string    `json:"name"`
+	CaptureDate time.Time `json:"capture_date"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Orientation int       `json:"orientation,omitempty"`
+	Latitude    *float64  `json:"latitude,omitempty"`
+	Longitude   *float64  `json:"longitude,omitempty"`
+	Thumbnail   string    `json:"thumbnail"`
+}
+
+type PhotoGroup struct {
+	Key    string  `json:"key"`
+	Count  int     `json:"count"`
+	Photos []Photo `json:"photos"`
+}
+
+type Timeline struct {
+	Total  int          `json:"total"`
+	Next   int          `json:"next,omitempty"`
+	Groups []PhotoGroup `json:"groups"`
+	Job    *Job         `json:"job,omitempty"`
+}
+
+/*
+ * GalleryIndex gives back the job keeping the index of the photos under a path up to date. The
+ * index lives in the database so a refresh only has to read the photos that were added or changed
+ * since the last time, photos that are gone are removed from it
+ */
+func GalleryIndex(ctx *App, path string, refresh bool) *Job {
+	key := GenerateID(ctx) + "::" + path
+	if v, found := galleryJobs.Cache.Get(key); found {
+		job := v.(*Job)
+		if job.State() == JOB_RUNNING || (refresh == false && job.State() == JOB_DONE) {
+			return job
+		}
+	}
+	job := NewJob(ctx, JOB_GALLERY, func(app *App, job *Job) (interface{}, error) {
+		return nil, galleryUpdate(app, job, path)
+	})
+	galleryJobs.SetKey(key, job)
+	return job
+}
+
+func galleryUpdate(app *App, job *Job, path string) error {
+	backend := GenerateID(app)
+	known := map[string][2]int64{}
+	rows, err := DB.Query(
+		"SELECT path, mtime, size FROM Photo WHERE backend = ? AND substr(path, 1, ?) = ?",
+		backend, utf8.RuneCountInString(path), path,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var p string
+		var mtime, size int64
+		if err = rows.Scan(&p, &mtime, &size); err == nil {
+			known[p] = [2]int64{mtime, size}
+		}
+	}
+	rows.Close()
+
+	upsert, err := DB.Prepare("INSERT OR REPLACE INTO Photo(backend, path, mtime, size, capture_date, width, height, orientation, latitude, longitude) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+
+	seen := map[string]bool{}
+	unreachable := []string{}
+	var walk func(p string) error
+	walk = func(p string) error {
+		if err := app.Context.Err(); err != nil {
+			return err
+		}
+		for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+			if err := auth.Ls(app, p); err != nil {
+				return nil
+			}
+		}
+		entries, err := app.Backend.Ls(p)
+		if err != nil {
+			Log.Debug("model::gallery ls path[%s] err[%s]", p, err.Error())
+			unreachable = append(unreachable, p)
+			return nil
+		}
+		job.AddProgress("dirs", 1)
+		for _, entry := range entries {
+			fullpath := filepath.Join(p, entry.Name())
+			if entry.IsDir() {
+				if err = walk(fullpath + "/"); err != nil {
+					return err
+				}
+				continue
+			}
+			extractor, ok := Hooks.Get.MetadataExtractor()[GetMimeType(fullpath)]
+			if ok == false || strings.HasPrefix(GetMimeType(fullpath), "image/") == false {
+				continue
+			}
+			seen[fullpath] = true
+			job.AddProgress("photos", 1)
+			mtime := entry.ModTime().Unix()
+			if v, ok := known[fullpath]; ok && v[0] == mtime && v[1] == entry.Size() {
+				continue
+			}
+			m, err := mediaMetadataRead(app, fullpath, extractor, entry.Size())
+			if err != nil {
+				m = &MediaMetadata{}
+			}
+			captureDate := entry.ModTime()
+			if m.CaptureDate != nil {
+				captureDate = *m.CaptureDate
+			}
+			var lat, lon sql.NullFloat64
+			if m.Latitude != nil && m.Longitude != nil {
+				lat = sql.NullFloat64{Float64: *m.Latitude, Valid: true}
+				lon = sql.NullFloat64{Float64: *m.Longitude, Valid: true}
+			}
+			if _, err = upsert.Exec(
+				backend, fullpath, mtime, entry.Size(), captureDate.Unix(),
+				m.Width, m.Height, m.Orientation, lat, lon,
+			); err != nil {
+				return err
+			}
+			job.AddProgress("indexed", 1)
+		}
+		return nil
+	}
+	if err = walk(path); err != nil {
+		return err
+	}
+
+	// what we couldn't list might still be there, we only forget about photos we know are gone
+	for p := range known {
+		if seen[p] {
+			continue
+		}
+		gone := true
+		for _, u := range unreachable {
+			if strings.HasPrefix(p, u) {
+				gone = false
+				break
+			}
+		}
+		if gone {
+			DB.Exec("DELETE FROM Photo WHERE backend = ? AND path = ?", backend, p)
+		}
+	}
+	return nil
+}
+
+/*
+ * GalleryTimeline gives the photos under a path from the most recent to the oldest, grouped by
+ * day, month or year. Pages are made of photos, a group can be split between 2 pages in which case
+ * its count is the number of photos in the whole group
+ */
+func GalleryTimeline(ctx *App, path string, group string, offset int, limit int) (*Timeline, error) {
+	layout, ok := galleryGroups[group]
+	if ok == false {
+		return nil, ErrNotValid
+	}
+	backend := GenerateID(ctx)
+	timeline := &Timeline{Groups: []PhotoGroup{}}
+
+	counts := map[string]int{}
+	rows, err := DB.Query(
+		"SELECT strftime(?, capture_date, 'unixepoch') AS g, COUNT(*) FROM Photo WHERE backend = ? AND substr(path, 1, ?) = ? GROUP BY g",
+		layout[1], backend, utf8.RuneCountInString(path), path,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var key string
+		var n int
+		if err = rows.Scan(&key, &n); err == nil {
+			counts[key] = n
+			timeline.Total += n
+		}
+	}
+	rows.Close()
+
+	rows, err = DB.Query(
+		"SELECT path, capture_date, width, height, orientation, latitude, longitude FROM Photo WHERE backend = ? AND substr(path, 1, ?) = ? ORDER BY capture_date DESC, path LIMIT ? OFFSET ?",
+		backend, utf8.RuneCountInString(path), path, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chroot := ctx.Session["path"]
+	n := 0
+	for rows.Next() {
+		var p string
+		var captureDate int64
+		var lat, lon sql.NullFloat64
+		photo := Photo{}
+		if err = rows.Scan(&p, &captureDate, &photo.Width, &photo.Height, &photo.Orientation, &lat, &lon); err != nil {
+			return nil, err
+		}
+		n += 1
+		if chroot != "" {
+			p = "/" + strings.TrimPrefix(p, chroot)
+		}
+		photo.Path = p
+		photo.Name = filepath.Base(p)
+		photo.CaptureDate = time.Unix(captureDate, 0).UTC()
+		if lat.Valid && lon.Valid {
+			photo.Latitude, photo.Longitude = &lat.Float64, &lon.Float64
+		}
+		// thumbnails go through the same pipeline, and cache, as the ones from the file listing
+		query := url.Values{"path": []string{p}, "thumbnail": []string{"true"}}
+		if ctx.Share.Id != "" {
+			query.Set("share", ctx.Share.Id)
+		}
+		photo.Thumbnail = "/api/files/cat?" + query.Encode()
+
+		key := photo.CaptureDate.Format(layout[0])
+		if l := len(timeline.Groups); l == 0 || timeline.Groups[l-1].Key != key {
+			timeline.Groups = append(timeline.Groups, PhotoGroup{Key: key, Count: counts[key], Photos: []Photo{}})
+		}
+		timeline.Groups[len(timeline.Groups)-1].Photos = append(timeline.Groups[len(timeline.Groups)-1].Photos, photo)
+	}
+	if offset+n < timeline.Total {
+		timeline.Next = offset + n
+	}
+	return timeline, nil
+}
@@ -34,6 +34,17 @@ func init() {
 		}
 	}
 
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS Quota(id VARCHAR(64) PRIMARY KEY, used INTEGER NOT NULL DEFAULT 0, reconciled INTEGER NOT NULL DEFAULT 0)"); err == nil {
+		stmt.Exec()
+	}
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS Photo(backend VARCHAR(64), path VARCHAR(1024), mtime INTEGER, size INTEGER, capture_date INTEGER, width INTEGER, height INTEGER, orientation INTEGER, latitude REAL, longitude REAL, CONSTRAINT pk_photo PRIMARY KEY(backend, path))"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_photo ON Photo(backend, capture_date)"); err == nil {
+			stmt.Exec()
+		}
+	}
+
 	go func() {
 		autovacuum()
 	}()
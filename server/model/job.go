@@ -0,0 +1,171 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+const (
+	JOB_RUNNING   = "running"
+	JOB_DONE      = "done"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+)
+
+var jobs AppCache
+
+func init() {
+	jobs = NewAppCache(60, 10)
+}
+
+/*
+ * A Job is some work that takes too long to fit within a request, like walking through an entire
+ * storage. It runs in the background on behalf of a user who can poll its progress and fetch the
+ * result once it's done. Jobs are kept in memory for an hour and only visible from the session
+ * that started them
+ */
+type Job struct {
+	Id       string
+	Type     string
+	Status   string
+	Progress map[string]int64
+	Result   interface{}
+	Error    string
+	Started  time.Time
+	Ended    time.Time
+	owner    string
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+}
+
+func NewJob(ctx *App, jobType string, fn func(app *App, job *Job) (interface{}, error)) *Job {
+	c, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		Id:       QuickString(16),
+		Type:     jobType,
+		Status:   JOB_RUNNING,
+		Progress: map[string]int64{},
+		Started:  time.Now(),
+		owner:    GenerateID(ctx),
+		cancel:   cancel,
+	}
+	jobs.SetKey(job.Id, job)
+
+	// the job outlives the request that created it
+	app := *ctx
+	app.Context = c
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				Log.Error("model::job panic type[%s] err[%v]", jobType, r)
+				job.finish(nil, ErrInternal)
+			}
+		}()
+		result, err := fn(&app, job)
+		job.finish(result, err)
+	}()
+	return job
+}
+
+func JobGet(ctx *App, id string) (*Job, error) {
+	v, found := jobs.Cache.Get(id)
+	if found == false {
+		return nil, ErrNotFound
+	}
+	job, ok := v.(*Job)
+	if ok == false || job.owner != GenerateID(ctx) {
+		return nil, ErrNotFound
+	}
+	return job, nil
+}
+
+func (this *Job) Cancel() {
+	this.cancel()
+	this.mu.Lock()
+	if this.Status == JOB_RUNNING {
+		this.Status = JOB_CANCELLED
+		this.Ended = time.Now()
+	}
+	this.mu.Unlock()
+}
+
+func (this *Job) AddProgress(key string, n int64) {
+	this.mu.Lock()
+	this.Progress[key] += n
+	this.mu.Unlock()
+}
+
+func (this *Job) State() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.Status
+}
+
+// Value gives the result of a job that has completed
+func (this *Job) Value() (interface{}, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.Result, this.Status == JOB_DONE
+}
+
+// Update makes changes to the result of a job that has completed
+func (this *Job) Update(fn func(result interface{})) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.Status == JOB_DONE {
+		fn(this.Result)
+	}
+}
+
+func (this *Job) finish(result interface{}, err error) {
+	this.cancel()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.Status != JOB_RUNNING {
+		return
+	}
+	this.Ended = time.Now()
+	if err != nil {
+		this.Status = JOB_FAILED
+		this.Error = err.Error()
+		return
+	}
+	this.Status = JOB_DONE
+	this.Result = result
+}
+
+func (this *Job) MarshalJSON() ([]byte, error) {
+	return this.MarshalJSONWithResult(nil)
+}
+
+// MarshalJSONWithResult gives the json form of a job, with a different result than what the job
+// has found when it is set. Eg: a subset of the result
+func (this *Job) MarshalJSONWithResult(result interface{}) ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	progress := make(map[string]int64, len(this.Progress))
+	for k, v := range this.Progress {
+		progress[k] = v
+	}
+	var ended *time.Time
+	if this.Ended.IsZero() == false {
+		ended = &this.Ended
+	}
+	if result == nil {
+		result = this.Result
+	}
+	return json.Marshal(struct {
+		Id       string           `json:"id"`
+		Type     string           `json:"type"`
+		Status   string           `json:"status"`
+		Progress map[string]int64 `json:"progress"`
+		Result   interface{}      `json:"result,omitempty"`
+		Error    string           `json:"error,omitempty"`
+		Started  time.Time        `json:"started"`
+		Ended    *time.Time       `json:"ended,omitempty"`
+	}{this.Id, this.Type, this.Status, progress, result, this.Error, this.Started, ended})
+}
@@ -0,0 +1,62 @@
+package model
+
+import (
+	"fmt"
+	"io"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	_ "github.com/mickael-kerjean/filestash/server/model/metadata"
+)
+
+// extracting metadata means reading the file, what we found is kept as long as the file doesn't change
+var mediaMetadataCache AppCache = NewAppCache(60, 10)
+
+/*
+ * MediaMetadataGet gives what can be known about a media file from the extractor registered for its
+ * mime type. Results are cached under the modification time and the size of the file
+ */
+func MediaMetadataGet(ctx *App, path string) (*MediaMetadata, error) {
+	mType := GetMimeType(path)
+	extractor, ok := Hooks.Get.MetadataExtractor()[mType]
+	if ok == false {
+		return nil, ErrNotSupported
+	}
+	stat, err := FileStat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	key := ""
+	if stat.ModTime().IsZero() == false {
+		key = Hash(fmt.Sprintf("%s %s %d %d", GenerateID(ctx), path, stat.ModTime().UnixNano(), stat.Size()), 32)
+		if v, found := mediaMetadataCache.Cache.Get(key); found {
+			return v.(*MediaMetadata), nil
+		}
+	}
+
+	m, err := mediaMetadataRead(ctx, path, extractor, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		mediaMetadataCache.SetKey(key, m)
+	}
+	return m, nil
+}
+
+func mediaMetadataRead(ctx *App, path string, extractor func(io.Reader, *MediaMetadata) error, size int64) (*MediaMetadata, error) {
+	reader, err := ctx.Backend.Cat(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	m := &MediaMetadata{Mime: GetMimeType(path)}
+	if err = extractor(reader, m); err != nil {
+		Log.Debug("media::metadata path[%s] err[%s]", path, err.Error())
+		return nil, NewError("Unable to read the metadata of this file", 400)
+	}
+	// without a header telling the length of the content, the bitrate gives an estimate
+	if m.Duration == 0 && m.BitRate > 0 && size > 0 {
+		m.Duration = float64(size*8) / float64(m.BitRate)
+	}
+	return m, nil
+}
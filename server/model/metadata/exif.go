@@ -0,0 +1,234 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+const (
+	exifMake              = 0x010F
+	exifModel             = 0x0110
+	exifOrientation       = 0x0112
+	exifDateTime          = 0x0132
+	exifImageWidth        = 0x0100
+	exifImageHeight       = 0x0101
+	exifIFDPointer        = 0x8769
+	exifGPSPointer        = 0x8825
+	exifExposureTime      = 0x829A
+	exifFNumber           = 0x829D
+	exifISO               = 0x8827
+	exifDateTimeOriginal  = 0x9003
+	exifDateTimeDigitized = 0x9004
+	exifOffsetTimeOrig    = 0x9011
+	exifFocalLength       = 0x920A
+	exifPixelXDimension   = 0xA002
+	exifPixelYDimension   = 0xA003
+	exifLensModel         = 0xA434
+	gpsLatitudeRef        = 0x0001
+	gpsLatitude           = 0x0002
+	gpsLongitudeRef       = 0x0003
+	gpsLongitude          = 0x0004
+	gpsAltitudeRef        = 0x0005
+	gpsAltitude           = 0x0006
+)
+
+// size in bytes of the TIFF field types: BYTE, ASCII, SHORT, LONG, RATIONAL, SBYTE, UNDEFINED, ...
+var tiffTypeSize = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+type tiff struct {
+	b  []byte
+	bo binary.ByteOrder
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+/*
+ * Exif reads EXIF data which is a TIFF structure whatever the container is: jpeg, png, webp and
+ * most raw formats. Only what's needed to sort and display photos is kept
+ */
+func Exif(b []byte, m *MediaMetadata) error {
+	if len(b) < 8 {
+		return ErrNotValid
+	}
+	t := tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return ErrNotValid
+	}
+	// 42 for TIFF, the others are variants some raw formats use: ORF and RW2
+	if magic := t.bo.Uint16(b[2:]); magic != 42 && magic != 0x4F52 && magic != 0x5352 && magic != 0x55 {
+		return ErrNotValid
+	}
+
+	ifd0 := t.ifd(t.bo.Uint32(b[4:]))
+	var exif, gps map[uint16]tiffEntry
+	if e, ok := ifd0[exifIFDPointer]; ok {
+		exif = t.ifd(t.uint(e))
+	}
+	if e, ok := ifd0[exifGPSPointer]; ok {
+		gps = t.ifd(t.uint(e))
+	}
+
+	setString(&m.Make, t.str(ifd0[exifMake]))
+	setString(&m.Model, t.str(ifd0[exifModel]))
+	setString(&m.Lens, t.str(exif[exifLensModel]))
+	if m.Orientation == 0 {
+		m.Orientation = int(t.uint(ifd0[exifOrientation]))
+	}
+	if m.Width == 0 || m.Height == 0 {
+		if w, h := t.uint(exif[exifPixelXDimension]), t.uint(exif[exifPixelYDimension]); w > 0 && h > 0 {
+			m.Width, m.Height = int(w), int(h)
+		} else if w, h := t.uint(ifd0[exifImageWidth]), t.uint(ifd0[exifImageHeight]); w > 0 && h > 0 {
+			m.Width, m.Height = int(w), int(h)
+		}
+	}
+	if m.CaptureDate == nil {
+		offset := t.str(exif[exifOffsetTimeOrig])
+		for _, e := range []tiffEntry{exif[exifDateTimeOriginal], exif[exifDateTimeDigitized], ifd0[exifDateTime]} {
+			if d := exifDate(t.str(e), offset); d != nil {
+				m.CaptureDate = d
+				break
+			}
+		}
+	}
+	if v := t.rational(exif[exifExposureTime], 0); v > 0 && m.ExposureTime == "" {
+		if v < 1 {
+			m.ExposureTime = fmt.Sprintf("1/%d", int(math.Round(1/v)))
+		} else {
+			m.ExposureTime = fmt.Sprintf("%g", v)
+		}
+	}
+	if v := t.rational(exif[exifFNumber], 0); v > 0 && m.FNumber == 0 {
+		m.FNumber = v
+	}
+	if v := t.rational(exif[exifFocalLength], 0); v > 0 && m.FocalLength == 0 {
+		m.FocalLength = v
+	}
+	if v := t.uint(exif[exifISO]); v > 0 && m.ISO == 0 {
+		m.ISO = int(v)
+	}
+
+	if gps != nil && m.Latitude == nil {
+		lat, latOk := t.coordinate(gps[gpsLatitude], t.str(gps[gpsLatitudeRef]))
+		lon, lonOk := t.coordinate(gps[gpsLongitude], t.str(gps[gpsLongitudeRef]))
+		if latOk && lonOk {
+			m.Latitude, m.Longitude = &lat, &lon
+		}
+		if e, ok := gps[gpsAltitude]; ok {
+			alt := t.rational(e, 0)
+			if ref := gps[gpsAltitudeRef].data; len(ref) > 0 && ref[0] == 1 {
+				alt = -alt
+			}
+			m.Altitude = &alt
+		}
+	}
+	return nil
+}
+
+func (this tiff) ifd(offset uint32) map[uint16]tiffEntry {
+	entries := map[uint16]tiffEntry{}
+	if offset < 8 || int64(offset)+2 > int64(len(this.b)) {
+		return entries
+	}
+	n := uint32(this.bo.Uint16(this.b[offset:]))
+	for i := uint32(0); i < n; i++ {
+		p := offset + 2 + i*12
+		if int64(p)+12 > int64(len(this.b)) {
+			break
+		}
+		tag := this.bo.Uint16(this.b[p:])
+		e := tiffEntry{typ: this.bo.Uint16(this.b[p+2:]), count: this.bo.Uint32(this.b[p+4:])}
+		size, ok := tiffTypeSize[e.typ]
+		if ok == false || e.count > uint32(len(this.b)) {
+			continue
+		}
+		size *= e.count
+		if size <= 4 {
+			e.data = this.b[p+8 : p+8+size]
+		} else if start := this.bo.Uint32(this.b[p+8:]); int64(start)+int64(size) <= int64(len(this.b)) {
+			e.data = this.b[start : start+size]
+		} else {
+			continue
+		}
+		entries[tag] = e
+	}
+	return entries
+}
+
+func (this tiff) str(e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.data), "\x00"))
+}
+
+func (this tiff) uint(e tiffEntry) uint32 {
+	switch {
+	case e.typ == 3 && len(e.data) >= 2:
+		return uint32(this.bo.Uint16(e.data))
+	case (e.typ == 4 || e.typ == 9) && len(e.data) >= 4:
+		return this.bo.Uint32(e.data)
+	case e.typ == 1 && len(e.data) >= 1:
+		return uint32(e.data[0])
+	}
+	return 0
+}
+
+func (this tiff) rational(e tiffEntry, i int) float64 {
+	if (e.typ != 5 && e.typ != 10) || len(e.data) < (i+1)*8 {
+		return 0
+	}
+	num, den := this.bo.Uint32(e.data[i*8:]), this.bo.Uint32(e.data[i*8+4:])
+	if den == 0 {
+		return 0
+	} else if e.typ == 10 {
+		return float64(int32(num)) / float64(int32(den))
+	}
+	return float64(num) / float64(den)
+}
+
+// coordinate converts a GPS position given as degrees, minutes, seconds into decimal degrees
+func (this tiff) coordinate(e tiffEntry, ref string) (float64, bool) {
+	if e.count < 3 {
+		return 0, false
+	}
+	v := this.rational(e, 0) + this.rational(e, 1)/60 + this.rational(e, 2)/3600
+	if ref == "S" || ref == "W" {
+		v = -v
+	}
+	return v, true
+}
+
+func exifDate(s string, offset string) *time.Time {
+	if s == "" || strings.HasPrefix(s, "0000") {
+		return nil
+	}
+	loc := time.UTC
+	if o, err := time.Parse("-07:00", offset); err == nil {
+		loc = o.Location()
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", s, loc)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+func setString(dst *string, v string) {
+	if *dst == "" && v != "" {
+		*dst = v
+	}
+}
@@ -0,0 +1,125 @@
+package metadata
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+var vorbisComments = map[string]string{
+	"title":       "title",
+	"artist":      "artist",
+	"albumartist": "album_artist",
+	"album":       "album",
+	"tracknumber": "track",
+	"discnumber":  "disc",
+	"genre":       "genre",
+	"date":        "date",
+	"composer":    "composer",
+}
+
+// Flac reads the metadata blocks that are before the audio frames: STREAMINFO, VORBIS_COMMENT and PICTURE
+func Flac(r io.Reader, m *MediaMetadata) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != "fLaC" {
+		return ErrNotValid
+	}
+	m.Format = "flac"
+	m.AudioCodec = "flac"
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return nil
+		}
+		last := header[0]&0x80 != 0
+		typ := header[0] & 0x7F
+		size := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		switch typ {
+		case 0, 4: // STREAMINFO, VORBIS_COMMENT
+			data, err := readChunk(br, size)
+			if err != nil {
+				return nil
+			}
+			if typ == 0 {
+				flacStreamInfo(data, m)
+			} else {
+				vorbisComment(data, m)
+			}
+		case 6: // PICTURE
+			m.Cover = true
+			fallthrough
+		default:
+			if _, err := io.CopyN(io.Discard, br, size); err != nil {
+				return nil
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func flacStreamInfo(b []byte, m *MediaMetadata) {
+	if len(b) < 18 {
+		return
+	}
+	// 20 bits of sample rate, 3 bits of channels, 5 bits of bits per sample and 36 bits of total samples
+	v := binary.BigEndian.Uint64(b[10:])
+	m.SampleRate = int(v >> 44)
+	m.Channels = int((v>>41)&0x07) + 1
+	if samples := v & 0xFFFFFFFFF; samples > 0 && m.SampleRate > 0 {
+		m.Duration = float64(samples) / float64(m.SampleRate)
+	}
+}
+
+// vorbisComment is the tag format of flac and ogg, made of "KEY=value" strings
+func vorbisComment(b []byte, m *MediaMetadata) {
+	next := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		size := binary.LittleEndian.Uint32(b)
+		if int64(size) > int64(len(b)-4) {
+			return "", false
+		}
+		s := string(b[4 : 4+size])
+		b = b[4+size:]
+		return s, true
+	}
+	if _, ok := next(); ok == false { // vendor string
+		return
+	} else if len(b) < 4 {
+		return
+	}
+	n := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	for i := uint32(0); i < n; i++ {
+		comment, ok := next()
+		if ok == false {
+			return
+		}
+		kv := strings.SplitN(comment, "=", 2)
+		if len(kv) != 2 {
+			continue
+		} else if strings.EqualFold(kv[0], "METADATA_BLOCK_PICTURE") {
+			m.Cover = true
+			continue
+		}
+		name, ok := vorbisComments[strings.ToLower(kv[0])]
+		if ok == false || strings.TrimSpace(kv[1]) == "" {
+			continue
+		}
+		if m.Tags == nil {
+			m.Tags = map[string]string{}
+		}
+		if v, ok := m.Tags[name]; ok {
+			m.Tags[name] = v + ", " + strings.TrimSpace(kv[1])
+		} else {
+			m.Tags[name] = strings.TrimSpace(kv[1])
+		}
+	}
+}
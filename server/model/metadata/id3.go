@@ -0,0 +1,210 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+var id3Frames = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TPE2": "album_artist", "TP2": "album_artist",
+	"TALB": "album", "TAL": "album",
+	"TRCK": "track", "TRK": "track",
+	"TPOS": "disc", "TPA": "disc",
+	"TCON": "genre", "TCO": "genre",
+	"TDRC": "date", "TYER": "date", "TYE": "date",
+	"TCOM": "composer", "TCM": "composer",
+}
+
+// bitrates in kbps indexed by [version/layer][index], see http://www.mp3-tech.org/programmer/frame_header.html
+var mpegBitrates = [5][16]int{
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}, // MPEG1 layer I
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},    // MPEG1 layer II
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},     // MPEG1 layer III
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},    // MPEG2 layer I
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},         // MPEG2 layer II & III
+}
+
+var mpegSampleRates = [3]int{44100, 48000, 32000}
+
+/*
+ * Mp3 reads the ID3v2 tag at the beginning of the file and the header of the first audio frame.
+ * When the file was encoded with a VBR header, it tells us the number of frames and therefore the
+ * duration. Without it all we have is the bitrate and the duration is estimated from the file size
+ */
+func Mp3(r io.Reader, m *MediaMetadata) error {
+	br := bufio.NewReader(r)
+	if header, err := br.Peek(10); err == nil && string(header[:3]) == "ID3" {
+		br.Discard(10)
+		size := syncsafe(header[6:10])
+		if size > METADATA_MAX_SIZE {
+			// most likely a large cover art, the audio frame we're after comes after it
+			if _, err = io.CopyN(io.Discard, br, int64(size)); err != nil {
+				return ErrNotValid
+			}
+		} else {
+			tag, err := readChunk(br, int64(size))
+			if err != nil {
+				return ErrNotValid
+			}
+			id3(tag, header[3], header[5], m)
+		}
+	}
+	mpegFrame(br, m)
+	if m.Format == "" {
+		return ErrNotValid
+	}
+	return nil
+}
+
+func id3(tag []byte, version byte, flags byte, m *MediaMetadata) {
+	if flags&0x40 != 0 && len(tag) >= 4 { // extended header
+		size := binary.BigEndian.Uint32(tag)
+		if version == 4 {
+			size = syncsafe(tag[:4])
+		} else {
+			size += 4
+		}
+		if int64(size) > int64(len(tag)) {
+			return
+		}
+		tag = tag[size:]
+	}
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(tag) >= headerLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var size uint32
+		switch version {
+		case 2:
+			size = uint32(tag[3])<<16 | uint32(tag[4])<<8 | uint32(tag[5])
+		case 3:
+			size = binary.BigEndian.Uint32(tag[4:])
+		default:
+			size = syncsafe(tag[4:8])
+		}
+		if int64(size) > int64(len(tag)-headerLen) {
+			return
+		}
+		data := tag[headerLen : headerLen+int(size)]
+		tag = tag[headerLen+int(size):]
+
+		if id == "APIC" || id == "PIC" {
+			m.Cover = true
+		} else if name, ok := id3Frames[id]; ok && len(data) > 1 {
+			if v := id3Text(data[0], data[1:]); v != "" {
+				if m.Tags == nil {
+					m.Tags = map[string]string{}
+				}
+				m.Tags[name] = v
+			}
+		}
+	}
+}
+
+func id3Text(encoding byte, b []byte) string {
+	var s string
+	switch encoding {
+	case 0: // ISO-8859-1
+		r := make([]rune, len(b))
+		for i := range b {
+			r[i] = rune(b[i])
+		}
+		s = string(r)
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		var bo binary.ByteOrder = binary.BigEndian
+		if len(b) >= 2 && b[0] == 0xFF && b[1] == 0xFE {
+			bo, b = binary.LittleEndian, b[2:]
+		} else if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+			b = b[2:]
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = bo.Uint16(b[i*2:])
+		}
+		s = string(utf16.Decode(u))
+	default: // UTF-8
+		s = string(b)
+	}
+	// multiple values are separated by a null character
+	return strings.TrimSpace(strings.ReplaceAll(strings.TrimRight(s, "\x00"), "\x00", ", "))
+}
+
+func mpegFrame(br *bufio.Reader, m *MediaMetadata) {
+	// some files have padding or garbage between the tag and the first frame
+	for i := 0; i < 64*1024; i++ {
+		header, err := br.Peek(4)
+		if err != nil {
+			return
+		} else if header[0] != 0xFF || header[1]&0xE0 != 0xE0 {
+			br.Discard(1)
+			continue
+		}
+		version := (header[1] >> 3) & 0x03 // 0: MPEG2.5, 2: MPEG2, 3: MPEG1
+		layer := (header[1] >> 1) & 0x03   // 1: III, 2: II, 3: I
+		bitrateIndex := header[2] >> 4
+		sampleRateIndex := (header[2] >> 2) & 0x03
+		if version == 1 || layer == 0 || bitrateIndex == 0x0F || sampleRateIndex == 0x03 {
+			br.Discard(1)
+			continue
+		}
+
+		table := 3 - int(layer)
+		if version != 3 {
+			table = 3 + min(int(3-layer), 1)
+		}
+		m.Format = "mp3"
+		m.AudioCodec = []string{"", "mp3", "mp2", "mp1"}[layer]
+		m.BitRate = mpegBitrates[table][bitrateIndex] * 1000
+		m.SampleRate = mpegSampleRates[sampleRateIndex]
+		if version == 2 {
+			m.SampleRate /= 2
+		} else if version == 0 {
+			m.SampleRate /= 4
+		}
+		m.Channels = 2
+		if header[3]>>6 == 0x03 {
+			m.Channels = 1
+		}
+
+		samples := 1152
+		if layer == 3 {
+			samples = 384
+		} else if layer == 1 && version != 3 {
+			samples = 576
+		}
+		frame, _ := br.Peek(64)
+		sideInfo := 32
+		if version != 3 && m.Channels == 1 {
+			sideInfo = 9
+		} else if version != 3 || m.Channels == 1 {
+			sideInfo = 17
+		}
+		var frames uint32
+		if xing := frame[min(4+sideInfo, len(frame)):]; len(xing) >= 12 && (bytes.HasPrefix(xing, []byte("Xing")) || bytes.HasPrefix(xing, []byte("Info"))) {
+			if binary.BigEndian.Uint32(xing[4:])&0x01 != 0 {
+				frames = binary.BigEndian.Uint32(xing[8:])
+			}
+		} else if vbri := frame[min(4+32, len(frame)):]; len(vbri) >= 18 && bytes.HasPrefix(vbri, []byte("VBRI")) {
+			frames = binary.BigEndian.Uint32(vbri[14:])
+		}
+		if frames > 0 && m.SampleRate > 0 {
+			m.Duration = float64(frames) * float64(samples) / float64(m.SampleRate)
+			m.BitRate = 0
+		}
+		return
+	}
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
@@ -0,0 +1,197 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	_ "image/gif"
+	"io"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	_ "golang.org/x/image/bmp"
+)
+
+// metadata is at the beginning of most files, we never read more than this to find it
+const METADATA_MAX_SIZE = 32 * 1024 * 1024
+
+var (
+	jpegExif = []byte("Exif\x00\x00")
+	jpegXmp  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	pngXmp   = []byte("XML:com.adobe.xmp\x00\x00") // uncompressed
+)
+
+// Jpeg goes through the segments of the file until the image data starts
+func Jpeg(r io.Reader, m *MediaMetadata) error {
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(2); err != nil || b[0] != 0xFF || b[1] != 0xD8 {
+		return ErrNotValid
+	}
+	br.Discard(2)
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil
+		} else if c != 0xFF {
+			continue
+		}
+		marker, err := br.ReadByte()
+		for err == nil && marker == 0xFF {
+			marker, err = br.ReadByte()
+		}
+		if err != nil || marker == 0xD9 || marker == 0xDA { // end of image / start of scan
+			return nil
+		} else if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+		var length uint16
+		if err = binary.Read(br, binary.BigEndian, &length); err != nil || length < 2 {
+			return nil
+		}
+		payload := make([]byte, length-2)
+		if _, err = io.ReadFull(br, payload); err != nil {
+			return nil
+		}
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, jpegExif):
+			Exif(payload[len(jpegExif):], m)
+		case marker == 0xE1 && bytes.HasPrefix(payload, jpegXmp):
+			Xmp(payload[len(jpegXmp):], m)
+		case marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+			if len(payload) >= 5 {
+				m.Height = int(binary.BigEndian.Uint16(payload[1:]))
+				m.Width = int(binary.BigEndian.Uint16(payload[3:]))
+			}
+		}
+	}
+}
+
+// Png reads the chunks that come before the image data: IHDR, eXIf and the XMP packet
+func Png(r io.Reader, m *MediaMetadata) error {
+	br := bufio.NewReader(r)
+	sig := make([]byte, 8)
+	if _, err := io.ReadFull(br, sig); err != nil || string(sig) != "\x89PNG\r\n\x1a\n" {
+		return ErrNotValid
+	}
+	for {
+		var header struct {
+			Length uint32
+			Type   [4]byte
+		}
+		if err := binary.Read(br, binary.BigEndian, &header); err != nil {
+			return nil
+		}
+		typ := string(header.Type[:])
+		if typ == "IDAT" || typ == "IEND" || header.Length > METADATA_MAX_SIZE {
+			return nil
+		}
+		data, err := readChunk(br, int64(header.Length)+4) // + crc
+		if err != nil {
+			return nil
+		}
+		data = data[:header.Length]
+		switch typ {
+		case "IHDR":
+			if len(data) >= 8 {
+				m.Width = int(binary.BigEndian.Uint32(data))
+				m.Height = int(binary.BigEndian.Uint32(data[4:]))
+			}
+		case "eXIf":
+			Exif(data, m)
+		case "iTXt":
+			// keyword, compression flag, compression method, language, translated keyword, text
+			if bytes.HasPrefix(data, pngXmp) && len(data) > len(pngXmp) {
+				parts := bytes.SplitN(data[len(pngXmp)+1:], []byte{0}, 3)
+				if len(parts) == 3 {
+					Xmp(parts[2], m)
+				}
+			}
+		}
+	}
+}
+
+// Webp reads the chunks of the RIFF container, EXIF and XMP come after the image data
+func Webp(r io.Reader, m *MediaMetadata) error {
+	br := bufio.NewReader(io.LimitReader(r, METADATA_MAX_SIZE))
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return ErrNotValid
+	}
+	for {
+		var chunk struct {
+			Type   [4]byte
+			Length uint32
+		}
+		if err := binary.Read(br, binary.LittleEndian, &chunk); err != nil {
+			return nil
+		}
+		size := int64(chunk.Length) + int64(chunk.Length%2)
+		typ := string(chunk.Type[:])
+		if typ != "VP8X" && typ != "VP8 " && typ != "VP8L" && typ != "EXIF" && typ != "XMP " {
+			if _, err := io.CopyN(io.Discard, br, size); err != nil {
+				return nil
+			}
+			continue
+		}
+		if size > METADATA_MAX_SIZE {
+			return nil
+		}
+		data, err := readChunk(br, size)
+		if err != nil {
+			return nil
+		}
+		switch typ {
+		case "VP8X":
+			if len(data) >= 10 {
+				m.Width = int(uint32(data[4])|uint32(data[5])<<8|uint32(data[6])<<16) + 1
+				m.Height = int(uint32(data[7])|uint32(data[8])<<8|uint32(data[9])<<16) + 1
+			}
+		case "VP8 ":
+			if len(data) >= 10 && m.Width == 0 {
+				m.Width = int(binary.LittleEndian.Uint16(data[6:]) & 0x3FFF)
+				m.Height = int(binary.LittleEndian.Uint16(data[8:]) & 0x3FFF)
+			}
+		case "VP8L":
+			if len(data) >= 5 && data[0] == 0x2F && m.Width == 0 {
+				bits := binary.LittleEndian.Uint32(data[1:])
+				m.Width = int(bits&0x3FFF) + 1
+				m.Height = int((bits>>14)&0x3FFF) + 1
+			}
+		case "EXIF":
+			Exif(bytes.TrimPrefix(data, jpegExif), m)
+		case "XMP ":
+			Xmp(data, m)
+		}
+	}
+}
+
+// readChunk reads a block whose size comes from the file itself, memory is only used for the data
+// that's actually there so a header lying about its size doesn't make us allocate anything
+func readChunk(r io.Reader, size int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
+// Tiff is used for tiff images and the raw formats built on top of it
+func Tiff(r io.Reader, m *MediaMetadata) error {
+	b, err := io.ReadAll(io.LimitReader(r, METADATA_MAX_SIZE))
+	if err != nil {
+		return err
+	}
+	return Exif(b, m)
+}
+
+// Image is for formats that don't carry metadata, all we know is their size
+func Image(r io.Reader, m *MediaMetadata) error {
+	c, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+	m.Width, m.Height = c.Width, c.Height
+	return nil
+}
@@ -0,0 +1,25 @@
+package metadata
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+func init() {
+	Hooks.Register.MetadataExtractor("image/jpeg", Jpeg)
+	Hooks.Register.MetadataExtractor("image/png", Png)
+	Hooks.Register.MetadataExtractor("image/webp", Webp)
+	Hooks.Register.MetadataExtractor("image/gif", Image)
+	Hooks.Register.MetadataExtractor("image/x-ms-bmp", Image)
+	// tiff and the raw formats that are built on top of it
+	for _, mType := range []string{
+		"image/tiff", "image/x-adobe-dng", "image/x-nikon-nef", "image/x-nikon-nrw", "image/x-canon-cr2",
+		"image/x-sony-arw", "image/x-sony-sr2", "image/x-olympus-orf", "image/x-panasonic-rw2",
+		"image/x-pentax-pef", "image/x-samsung-srw", "image/x-hasselblad-3fr", "image/x-epson-erf",
+		"image/x-kodak-kdc", "image/x-kodak-dcr", "image/x-mamiya-mef", "image/x-aptus-mos",
+	} {
+		Hooks.Register.MetadataExtractor(mType, Tiff)
+	}
+	Hooks.Register.MetadataExtractor("audio/mp3", Mp3)
+	Hooks.Register.MetadataExtractor("audio/mpeg", Mp3)
+	Hooks.Register.MetadataExtractor("audio/flac", Flac)
+}
@@ -0,0 +1,252 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+// tiffFixture is a little endian TIFF structure with a make, an orientation and a capture date
+func tiffFixture() []byte {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	b.WriteString("II")
+	binary.Write(&b, le, uint16(42))
+	binary.Write(&b, le, uint32(8))
+	// IFD0 at 8: 3 entries, then the exif IFD at 50 and the strings at 68
+	binary.Write(&b, le, uint16(3))
+	for _, e := range [][4]uint32{
+		{exifMake, 2, 6, 68},
+		{exifOrientation, 3, 1, 6},
+		{exifIFDPointer, 4, 1, 50},
+	} {
+		binary.Write(&b, le, uint16(e[0]))
+		binary.Write(&b, le, uint16(e[1]))
+		binary.Write(&b, le, e[2])
+		binary.Write(&b, le, e[3])
+	}
+	binary.Write(&b, le, uint32(0))
+	// exif IFD at 50
+	binary.Write(&b, le, uint16(1))
+	binary.Write(&b, le, uint16(exifDateTimeOriginal))
+	binary.Write(&b, le, uint16(2))
+	binary.Write(&b, le, uint32(20))
+	binary.Write(&b, le, uint32(74))
+	binary.Write(&b, le, uint32(0))
+	b.WriteString("Canon\x00")
+	b.WriteString("2021:06:15 10:20:30\x00")
+	return b.Bytes()
+}
+
+func jpegFixture() []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	app1 := append(append([]byte{}, jpegExif...), tiffFixture()...)
+	b.Write([]byte{0xFF, 0xE1})
+	binary.Write(&b, binary.BigEndian, uint16(len(app1)+2))
+	b.Write(app1)
+	b.Write([]byte{0xFF, 0xC0, 0x00, 0x0B, 0x08, 0x00, 0x20, 0x00, 0x40, 0x01, 0x01, 0x11, 0x00})
+	b.Write([]byte{0xFF, 0xDA})
+	return b.Bytes()
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(len(data)))
+	b.WriteString(typ)
+	b.Write(data)
+	b.Write([]byte{0, 0, 0, 0}) // crc, not verified
+	return b.Bytes()
+}
+
+func pngFixture(itxt []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x89PNG\r\n\x1a\n")
+	b.Write(pngChunk("IHDR", []byte{0, 0, 0, 64, 0, 0, 0, 32, 8, 6, 0, 0, 0}))
+	b.Write(pngChunk("iTXt", itxt))
+	b.Write(pngChunk("IEND", nil))
+	return b.Bytes()
+}
+
+var pngXmpPacket = []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00" + `<x:xmpmeta><rdf:Description tiff:Model="EOS R5"/></x:xmpmeta>`)
+
+func webpChunk(typ string, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(typ)
+	binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	if len(data)%2 == 1 {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+func webpFixture() []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	// 64x32 stored as width-1 and height-1 on 24 bits
+	body.Write(webpChunk("VP8X", []byte{0x08, 0, 0, 0, 63, 0, 0, 31, 0, 0}))
+	body.Write(webpChunk("EXIF", tiffFixture()))
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(body.Len()))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+func mp3Fixture() []byte {
+	var b bytes.Buffer
+	frame := append([]byte("TIT2"), 0, 0, 0, 6, 0, 0, 0)
+	frame = append(frame, []byte("Hello")...)
+	b.WriteString("ID3\x03\x00\x00")
+	b.Write([]byte{0, 0, 0, byte(len(frame))})
+	b.Write(frame)
+	// MPEG1 layer III, 128kbps, 44100Hz, joint stereo
+	b.Write([]byte{0xFF, 0xFB, 0x90, 0x64})
+	b.Write(make([]byte, 64))
+	return b.Bytes()
+}
+
+func flacFixture() []byte {
+	var b bytes.Buffer
+	b.WriteString("fLaC")
+	info := make([]byte, 34)
+	// 44100Hz, 2 channels, 16 bits per sample, 441000 samples
+	binary.BigEndian.PutUint64(info[10:], uint64(44100)<<44|uint64(1)<<41|uint64(15)<<36|441000)
+	b.Write([]byte{0x00, 0, 0, 34})
+	b.Write(info)
+	var comment bytes.Buffer
+	binary.Write(&comment, binary.LittleEndian, uint32(6))
+	comment.WriteString("vendor")
+	binary.Write(&comment, binary.LittleEndian, uint32(1))
+	binary.Write(&comment, binary.LittleEndian, uint32(10))
+	comment.WriteString("TITLE=Song")
+	b.Write([]byte{0x84, 0, 0, byte(comment.Len())})
+	b.Write(comment.Bytes())
+	return b.Bytes()
+}
+
+type parser func(io.Reader, *MediaMetadata) error
+
+func exifParser(r io.Reader, m *MediaMetadata) error {
+	b, _ := io.ReadAll(r)
+	return Exif(b, m)
+}
+
+func TestMetadataValid(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		fn    parser
+		input []byte
+		check func(m MediaMetadata) bool
+	}{
+		{"exif", exifParser, tiffFixture(), func(m MediaMetadata) bool {
+			return m.Make == "Canon" && m.Orientation == 6 && m.CaptureDate != nil && m.CaptureDate.Year() == 2021
+		}},
+		{"jpeg", Jpeg, jpegFixture(), func(m MediaMetadata) bool {
+			return m.Width == 64 && m.Height == 32 && m.Make == "Canon"
+		}},
+		{"png", Png, pngFixture(pngXmpPacket), func(m MediaMetadata) bool {
+			return m.Width == 64 && m.Height == 32 && m.Model == "EOS R5"
+		}},
+		{"webp", Webp, webpFixture(), func(m MediaMetadata) bool {
+			return m.Width == 64 && m.Height == 32 && m.Make == "Canon"
+		}},
+		{"mp3", Mp3, mp3Fixture(), func(m MediaMetadata) bool {
+			return m.Format == "mp3" && m.BitRate == 128000 && m.SampleRate == 44100 && m.Tags["title"] == "Hello"
+		}},
+		{"flac", Flac, flacFixture(), func(m MediaMetadata) bool {
+			return m.SampleRate == 44100 && m.Channels == 2 && m.Duration == 10 && m.Tags["title"] == "Song"
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var m MediaMetadata
+			if err := tc.fn(bytes.NewReader(tc.input), &m); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			} else if tc.check(m) == false {
+				t.Fatalf("unexpected metadata: %+v", m)
+			}
+		})
+	}
+}
+
+// a file cut short anywhere, eg: an upload that didn't complete, must never take the server down
+func TestMetadataTruncated(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		fn    parser
+		input []byte
+	}{
+		{"exif", exifParser, tiffFixture()},
+		{"jpeg", Jpeg, jpegFixture()},
+		{"png", Png, pngFixture(pngXmpPacket)},
+		{"webp", Webp, webpFixture()},
+		{"mp3", Mp3, mp3Fixture()},
+		{"flac", Flac, flacFixture()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < len(tc.input); i++ {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Fatalf("panic with the first %d bytes: %v", i, r)
+						}
+					}()
+					var m MediaMetadata
+					tc.fn(bytes.NewReader(tc.input[:i]), &m)
+				}()
+			}
+		})
+	}
+}
+
+func TestMetadataMalformed(t *testing.T) {
+	lyingTiff := tiffFixture()
+	binary.LittleEndian.PutUint32(lyingTiff[4:], 0xFFFFFFF0) // IFD0 way past the end
+	lyingEntry := tiffFixture()
+	binary.LittleEndian.PutUint32(lyingEntry[10+4:], 0xFFFFFFFF) // count of the make entry
+	binary.LittleEndian.PutUint32(lyingEntry[10+8:], 0xFFFFFFF0) // offset of the make entry
+	hugeJpegSegment := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 'E', 'x'}
+	hugeMp3Tag := []byte("ID3\x03\x00\x00\x7F\x7F\x7F\x7F")
+	hugeId3Frame := mp3Fixture()
+	copy(hugeId3Frame[14:], []byte{0x7F, 0xFF, 0xFF, 0xFF})
+	hugeFlacBlock := []byte("fLaC\x04\xFF\xFF\xFF")
+	flacComments := []byte("fLaC\x84\x00\x00\x0C\x06\x00\x00\x00vendor\xFF\xFF")
+
+	for _, tc := range []struct {
+		name  string
+		fn    parser
+		input []byte
+	}{
+		{"exif/empty", exifParser, nil},
+		{"exif/ifd out of range", exifParser, lyingTiff},
+		{"exif/entry out of range", exifParser, lyingEntry},
+		{"jpeg/not a jpeg", Jpeg, []byte("GIF89a")},
+		{"jpeg/segment bigger than file", Jpeg, hugeJpegSegment},
+		{"jpeg/segment length under 2", Jpeg, []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01}},
+		{"png/xmp keyword only", Png, pngFixture([]byte("XML:com.adobe.xmp\x00\x00"))},
+		{"png/xmp without text", Png, pngFixture([]byte("XML:com.adobe.xmp\x00\x00\x00"))},
+		{"png/short ihdr", Png, append([]byte("\x89PNG\r\n\x1a\n"), pngChunk("IHDR", []byte{1, 2})...)},
+		{"png/chunk bigger than file", Png, []byte("\x89PNG\r\n\x1a\n\x7F\xFF\xFF\xFFtEXt")},
+		{"webp/chunk bigger than file", Webp, []byte("RIFF\x00\x00\x00\x00WEBPEXIF\xFF\xFF\xFF\xFF")},
+		{"webp/short vp8l", Webp, append([]byte("RIFF\x00\x00\x00\x00WEBP"), webpChunk("VP8L", []byte{0x2F, 1})...)},
+		{"mp3/tag bigger than file", Mp3, hugeMp3Tag},
+		{"mp3/frame bigger than tag", Mp3, hugeId3Frame},
+		{"mp3/extended header bigger than tag", Mp3, []byte("ID3\x03\x00\x40\x00\x00\x00\x04\xFF\xFF\xFF\xFF")},
+		{"flac/block bigger than file", Flac, hugeFlacBlock},
+		{"flac/comment count lying", Flac, flacComments},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("panic: %v", r)
+				}
+			}()
+			var m MediaMetadata
+			tc.fn(bytes.NewReader(tc.input), &m)
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package metadata
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+/*
+ * Xmp reads the handful of properties we care about from an XMP packet. It's an RDF document
+ * where a property can either be an attribute or an element, we look for both without going
+ * through a full XML parser as packets are often slightly off
+ */
+func Xmp(b []byte, m *MediaMetadata) error {
+	get := func(name string) string {
+		for _, r := range []*regexp.Regexp{
+			regexp.MustCompile(regexp.QuoteMeta(name) + `="([^"]*)"`),
+			regexp.MustCompile(`<` + regexp.QuoteMeta(name) + `>([^<]*)</`),
+		} {
+			if match := r.FindSubmatch(b); match != nil {
+				return strings.TrimSpace(string(match[1]))
+			}
+		}
+		return ""
+	}
+
+	setString(&m.Make, get("tiff:Make"))
+	setString(&m.Model, get("tiff:Model"))
+	setString(&m.Lens, get("aux:Lens"))
+	setString(&m.Lens, get("exifEX:LensModel"))
+	if m.Orientation == 0 {
+		m.Orientation, _ = strconv.Atoi(get("tiff:Orientation"))
+	}
+	if m.CaptureDate == nil {
+		for _, name := range []string{"exif:DateTimeOriginal", "photoshop:DateCreated", "xmp:CreateDate"} {
+			if d := xmpDate(get(name)); d != nil {
+				m.CaptureDate = d
+				break
+			}
+		}
+	}
+	if m.Latitude == nil {
+		lat, latOk := xmpCoordinate(get("exif:GPSLatitude"))
+		lon, lonOk := xmpCoordinate(get("exif:GPSLongitude"))
+		if latOk && lonOk {
+			m.Latitude, m.Longitude = &lat, &lon
+		}
+	}
+	return nil
+}
+
+func xmpDate(s string) *time.Time {
+	if s == "" {
+		return nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04Z07:00", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// xmpCoordinate converts a GPS position given as "DDD,MM,SSk" or "DDD,MM.mmk" into decimal degrees
+func xmpCoordinate(s string) (float64, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	ref := s[len(s)-1:]
+	parts := strings.Split(s[:len(s)-1], ",")
+	v := 0.0
+	for i, div := range []float64{1, 60, 3600} {
+		if i >= len(parts) {
+			break
+		}
+		n, err := strconv.ParseFloat(parts[i], 64)
+		if err != nil {
+			return 0, false
+		}
+		v += n / div
+	}
+	switch strings.ToUpper(ref) {
+	case "S", "W":
+		return -v, true
+	case "N", "E":
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,222 @@
+package model
+
+import (
+	"database/sql"
+	"io"
+	"sync"
+	"time"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+var (
+	QUOTA_ATTRIBUTE func() string
+	QUOTA_RECONCILE func() int
+	quotaRunning    sync.Map
+)
+
+func init() {
+	QUOTA_ATTRIBUTE = func() string {
+		return Config.Get("features.quota.attribute").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "attribute"
+			f.Type = "text"
+			f.Description = "Name of the user attribute holding a storage limit, eg: '10GB'. It is only used when users are authenticated through an identity provider and the attribute comes from the attribute mapping"
+			f.Placeholder = "Default: quota"
+			f.Default = "quota"
+			return f
+		}).String()
+	}
+	QUOTA_ATTRIBUTE()
+	QUOTA_RECONCILE = func() int {
+		return Config.Get("features.quota.reconcile_time").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "reconcile_time"
+			f.Type = "number"
+			f.Description = "Time in hours after which the storage usage is recalculated by walking through the entire storage"
+			f.Placeholder = "Default: 24h"
+			f.Default = 24
+			return f
+		}).Int()
+	}
+	QUOTA_RECONCILE()
+}
+
+/*
+ * A Quota is a storage limit that applies to what a user is doing. Limits come from:
+ * 1. the connection in the config file, eg: { "type": "ftp", "quota": "10GB" }
+ * 2. an attribute of the user, set through the attribute mapping of an identity provider
+ * 3. a shared link
+ * Usage is updated as files get created and reconciled from time to time by walking
+ * through the storage
+ */
+type Quota struct {
+	Id    string
+	Root  string
+	Limit int64
+	Used  int64
+}
+
+type Quotas []*Quota
+
+func QuotaGet(ctx *App) Quotas {
+	quotas := Quotas{}
+	if ctx.Share.Id != "" && ctx.Share.Quota != nil {
+		quotas = append(quotas, quotaLoad(ctx, "share_"+ctx.Share.Id, ctx.Share.Path, *ctx.Share.Quota))
+	}
+
+	var limit int64 = -1
+	for _, conn := range ConnectionsMatching(ctx.Session) {
+		if l := ParseSize(NewStringFromInterface(conn["quota"])); l >= 0 && (limit == -1 || l < limit) {
+			limit = l
+		}
+	}
+	if attr := QUOTA_ATTRIBUTE(); attr != "" && Config.Get("middleware.identity_provider.type").String() != "" {
+		if l := ParseSize(ctx.Session[attr]); l >= 0 && (limit == -1 || l < limit) {
+			limit = l
+		}
+	}
+	if limit >= 0 {
+		root := ""
+		if ctx.Share.Id == "" {
+			// within a shared link, the session path is the shared folder, not the root of
+			// the storage which is what the connection quota is about
+			root = EnforceDirectory(ctx.Session["path"])
+		}
+		quotas = append(quotas, quotaLoad(ctx, "conn_"+GenerateID(ctx), root, limit))
+	}
+	return quotas
+}
+
+// Check verifies there's enough room left to store n more bytes
+func (this Quotas) Check(n int64) error {
+	if n < 0 {
+		n = 0
+	}
+	for _, q := range this {
+		if q.Used+n > q.Limit || (n == 0 && q.Used >= q.Limit) {
+			return ErrInsufficientStorage
+		}
+	}
+	return nil
+}
+
+// Add is how usage gets tracked incrementally after a change was made on the storage
+func (this Quotas) Add(n int64) {
+	for _, q := range this {
+		q.Used += n
+		if q.Used < 0 {
+			q.Used = 0
+		}
+		if _, err := DB.Exec("UPDATE Quota SET used = used + ? WHERE id = ?", n, q.Id); err != nil {
+			Log.Warning("model::quota add '%s'", err.Error())
+		}
+	}
+}
+
+// Stale forces the usage to be recalculated, it's what happen after something got removed
+// as we don't know how much space was freed
+func (this Quotas) Stale(ctx *App) {
+	for _, q := range this {
+		DB.Exec("UPDATE Quota SET reconciled = 0 WHERE id = ?", q.Id)
+		go quotaReconcile(ctx, q)
+	}
+}
+
+// Reader stops the stream as soon as it would go over the limit. The credit is what the content
+// replaces, eg: the previous version of a file being overwritten
+func (this Quotas) Reader(r io.Reader, credit int64) *QuotaReader {
+	return &QuotaReader{Reader: r, quotas: this, credit: credit}
+}
+
+// Metadata gives the limit which is the closest to be reached
+func (this Quotas) Metadata(m *Metadata) {
+	var q *Quota
+	for i := range this {
+		if q == nil || this[i].Limit-this[i].Used < q.Limit-q.Used {
+			q = this[i]
+		}
+	}
+	if q == nil {
+		return
+	}
+	used, limit := q.Used, q.Limit
+	m.QuotaUsed = &used
+	m.QuotaLimit = &limit
+}
+
+type QuotaReader struct {
+	io.Reader
+	quotas   Quotas
+	credit   int64
+	N        int64
+	Exceeded bool
+}
+
+func (this *QuotaReader) Read(p []byte) (int, error) {
+	n, err := this.Reader.Read(p)
+	this.N += int64(n)
+	if this.N > this.credit && this.quotas.Check(this.N-this.credit) != nil {
+		this.Exceeded = true
+		return n, ErrInsufficientStorage
+	}
+	return n, err
+}
+
+func quotaLoad(ctx *App, id string, root string, limit int64) *Quota {
+	q := &Quota{Id: id, Root: root, Limit: limit}
+	var reconciled int64
+	err := DB.QueryRow("SELECT used, reconciled FROM Quota WHERE id = ?", id).Scan(&q.Used, &reconciled)
+	if err == sql.ErrNoRows {
+		DB.Exec("INSERT INTO Quota(id, used, reconciled) VALUES(?, 0, 0)", id)
+	} else if err != nil {
+		Log.Warning("model::quota load '%s'", err.Error())
+		return q
+	}
+	if time.Since(time.Unix(reconciled, 0)) > time.Duration(QUOTA_RECONCILE())*time.Hour {
+		go quotaReconcile(ctx, q)
+	}
+	return q
+}
+
+func quotaReconcile(ctx *App, q *Quota) {
+	if q.Root == "" || ctx.Backend == nil {
+		return
+	} else if _, running := quotaRunning.LoadOrStore(q.Id, true); running {
+		return
+	}
+	defer quotaRunning.Delete(q.Id)
+
+	var used int64
+	var walk func(path string) error
+	walk = func(path string) error {
+		files, err := ctx.Backend.Ls(path)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				if err = walk(path + f.Name() + "/"); err != nil {
+					return err
+				}
+				continue
+			}
+			used += f.Size()
+		}
+		return nil
+	}
+	if err := walk(q.Root); err != nil {
+		Log.Debug("model::quota reconcile id[%s] err[%s]", q.Id, err.Error())
+		return
+	}
+	if _, err := DB.Exec(
+		"UPDATE Quota SET used = ?, reconciled = ? WHERE id = ?",
+		used, time.Now().Unix(), q.Id,
+	); err != nil {
+		Log.Warning("model::quota reconcile '%s'", err.Error())
+	}
+}
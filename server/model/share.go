@@ -105,6 +105,7 @@ func ShareUpsert(p *Share) error {
 		CanRead      bool    `json:"can_read"`
 		CanWrite     bool    `json:"can_write"`
 		CanUpload    bool    `json:"can_upload"`
+		Quota        *int64  `json:"quota,omitempty"`
 	}{
 		Password:     p.Password,
 		Users:        p.Users,
@@ -115,6 +116,7 @@ func ShareUpsert(p *Share) error {
 		CanRead:      p.CanRead,
 		CanWrite:     p.CanWrite,
 		CanUpload:    p.CanUpload,
+		Quota:        p.Quota,
 	})
 	_, err = stmt.Exec(p.Id, p.Backend, p.Path, j, p.Auth)
 	return err
@@ -0,0 +1,94 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+var (
+	THUMBNAIL_CACHE_SIZE func() int
+	thumbnailCache       = NewDiskCache(THUMBNAIL_PATH, func() int { return THUMBNAIL_CACHE_SIZE() })
+)
+
+// thumbnails bigger than that aren't worth keeping around
+const THUMBNAIL_MAX_SIZE = 5 * 1024 * 1024
+
+func init() {
+	THUMBNAIL_CACHE_SIZE = func() int {
+		return Config.Get("features.image.thumbnail_cache_size").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "thumbnail_cache_size"
+			f.Name = "thumbnail_cache_size"
+			f.Type = "number"
+			f.Description = "Size in MB of the disk cache where generated thumbnails are kept. The least recently used ones are removed first. Set to 0 to disable the cache"
+			f.Placeholder = "Default: 500MB"
+			f.Default = 500
+			return f
+		}).Int()
+	}
+	THUMBNAIL_CACHE_SIZE()
+}
+
+/*
+ * ThumbnailCacheKey identifies the thumbnail of a file, it is built from the backend, the path, the
+ * modification time and the size of the file so any change made to the file invalidates what was
+ * cached. An empty key means we can't tell when the file changes and shouldn't cache its thumbnail
+ */
+func ThumbnailCacheKey(ctx *App, path string) string {
+	if THUMBNAIL_CACHE_SIZE() <= 0 {
+		return ""
+	}
+	f, err := FileStat(ctx, path)
+	if err != nil || f.ModTime().IsZero() {
+		return ""
+	}
+	return Hash(fmt.Sprintf("%s %s %d %d", GenerateID(ctx), path, f.ModTime().UnixNano(), f.Size()), 32)
+}
+
+func ThumbnailCacheGet(key string) (*os.File, bool) {
+	return thumbnailCache.Get(key)
+}
+
+/*
+ * ThumbnailCachePut keeps a copy of a thumbnail as it is sent to the user. Generating thumbnails
+ * can fail in which case thumbnailers send a placeholder with a short lived cache control which we
+ * know not to keep
+ */
+func ThumbnailCachePut(key string, r io.ReadCloser, cacheControl string) io.ReadCloser {
+	if key == "" {
+		return r
+	} else if strings.Contains(cacheControl, "no-store") {
+		return r
+	} else if _, v, ok := strings.Cut(cacheControl, "max-age="); ok {
+		if maxAge, err := strconv.Atoi(strings.Split(v, ",")[0]); err == nil && maxAge < 60 {
+			return r
+		}
+	}
+	b, err := io.ReadAll(io.LimitReader(r, THUMBNAIL_MAX_SIZE+1))
+	if err != nil {
+		r.Close()
+		return NewReadCloserFromReader(&bytes.Buffer{})
+	} else if len(b) > THUMBNAIL_MAX_SIZE {
+		return NewReadCloserFromReader(io.MultiReader(bytes.NewReader(b), r))
+	}
+	r.Close()
+
+	tmp := thumbnailCache.Path(key) + ".tmp" + QuickString(6)
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		Log.Debug("model::thumbnail write '%s'", err.Error())
+		return NewReadCloserFromBytes(b)
+	} else if err = thumbnailCache.Put(key, tmp); err != nil {
+		Log.Debug("model::thumbnail rename '%s'", err.Error())
+		os.Remove(tmp)
+		return NewReadCloserFromBytes(b)
+	}
+	return NewReadCloserFromBytes(b)
+}
@@ -39,6 +39,7 @@ func init() {
 }
 
 type WebdavFs struct {
+	app        *App
 	req        *http.Request
 	backend    IBackend
 	path       string
@@ -47,8 +48,9 @@ type WebdavFs struct {
 	webdavFile *WebdavFile
 }
 
-func NewWebdavFs(b IBackend, primaryKey string, chroot string, req *http.Request) *WebdavFs {
+func NewWebdavFs(app *App, b IBackend, primaryKey string, chroot string, req *http.Request) *WebdavFs {
 	return &WebdavFs{
+		app:     app,
 		backend: b,
 		id:      primaryKey,
 		chroot:  chroot,
@@ -60,7 +62,11 @@ func (this WebdavFs) Mkdir(ctx context.Context, name string, perm os.FileMode) e
 	if name = this.fullpath(name); name == "" {
 		return os.ErrNotExist
 	}
-	return this.backend.Mkdir(name)
+	if err := this.backend.Mkdir(name); err != nil {
+		return err
+	}
+	EmitEvent(Event{Type: EVENT_FILE_MKDIR, Path: name, App: this.app})
+	return nil
 }
 
 func (this *WebdavFs) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
@@ -83,6 +89,8 @@ func (this *WebdavFs) OpenFile(ctx context.Context, name string, flag int, perm
 		return nil, os.ErrNotExist
 	}
 	this.webdavFile = &WebdavFile{
+		app:     this.app,
+		req:     this.req,
 		path:    name,
 		backend: this.backend,
 		cache:   cachePath,
@@ -95,7 +103,11 @@ func (this WebdavFs) RemoveAll(ctx context.Context, name string) error {
 	if name = this.fullpath(name); name == "" {
 		return os.ErrNotExist
 	}
-	return this.backend.Rm(name)
+	if err := this.backend.Rm(name); err != nil {
+		return err
+	}
+	EmitEvent(Event{Type: EVENT_FILE_RM, Path: name, App: this.app})
+	return nil
 }
 
 func (this WebdavFs) Rename(ctx context.Context, oldName, newName string) error {
@@ -104,12 +116,15 @@ func (this WebdavFs) Rename(ctx context.Context, oldName, newName string) error
 	} else if newName = this.fullpath(newName); newName == "" {
 		return os.ErrNotExist
 	}
-	return this.backend.Mv(oldName, newName)
+	if err := this.backend.Mv(oldName, newName); err != nil {
+		return err
+	}
+	EmitEvent(Event{Type: EVENT_FILE_MV, Path: oldName, To: newName, App: this.app})
+	return nil
 }
 
 func (this *WebdavFs) Stat(ctx context.Context, name string) (os.FileInfo, error) {
 	if this.webdavFile != nil {
-		this.webdavFile.push_to_remote_if_needed()
 		return this.webdavFile.Stat()
 	}
 	fullname := this.fullpath(name)
@@ -117,6 +132,8 @@ func (this *WebdavFs) Stat(ctx context.Context, name string) (os.FileInfo, error
 		return nil, os.ErrNotExist
 	}
 	this.webdavFile = &WebdavFile{
+		app:     this.app,
+		req:     this.req,
 		path:    fullname,
 		backend: this.backend,
 		cache:   fmt.Sprintf("%stmp_%s", cachePath, Hash(this.id+name, 20)),
@@ -124,6 +141,14 @@ func (this *WebdavFs) Stat(ctx context.Context, name string) (os.FileInfo, error
 	return this.webdavFile.Stat()
 }
 
+// Err is the reason the file sent by the client couldn't be saved, if any
+func (this *WebdavFs) Err() error {
+	if this.webdavFile == nil {
+		return nil
+	}
+	return this.webdavFile.err
+}
+
 func (this WebdavFs) fullpath(path string) string {
 	p := filepath.Join(this.chroot, path)
 	if strings.HasSuffix(path, "/") == true && strings.HasSuffix(p, "/") == false {
@@ -139,12 +164,16 @@ func (this WebdavFs) fullpath(path string) string {
  * Implement a webdav.File and os.Stat : https://godoc.org/golang.org/x/net/webdav#File
  */
 type WebdavFile struct {
+	app     *App
+	req     *http.Request
 	path    string
 	backend IBackend
 	cache   string
 	fread   *os.File
 	fwrite  *os.File
 	files   []os.FileInfo
+	info    os.FileInfo
+	err     error
 }
 
 func (this *WebdavFile) Read(p []byte) (n int, err error) {
@@ -202,7 +231,9 @@ func (this *WebdavFile) Readdir(count int) ([]os.FileInfo, error) {
 }
 
 func (this *WebdavFile) Stat() (os.FileInfo, error) {
-	this.push_to_remote_if_needed()
+	if err := this.push_to_remote_if_needed(); err != nil {
+		return nil, err
+	}
 	if strings.HasSuffix(this.path, "/") {
 		_, err := this.Readdir(0)
 		if err != nil {
@@ -215,14 +246,14 @@ func (this *WebdavFile) Stat() (os.FileInfo, error) {
 	if err != nil {
 		return nil, os.ErrNotExist
 	}
-	found := false
+	this.info = nil
 	for i := range files {
 		if files[i].Name() == baseDir {
-			found = true
+			this.info = files[i]
 			break
 		}
 	}
-	if found == false {
+	if this.info == nil {
 		return nil, os.ErrNotExist
 	}
 	return this, nil
@@ -268,15 +299,27 @@ func (this *WebdavFile) push_to_remote_if_needed() error {
 	if err != nil {
 		return err
 	}
-	err = this.backend.Save(this.path, f)
-	if err == nil {
-		if err = os.Rename(this.cache+"_writer", this.cache+"_reader"); err == nil {
-			this.fwrite = nil
-			webdavCache.SetKey(this.cache+"_reader", nil)
-		}
+	defer f.Close()
+	var size int64 = -1
+	if s, err := f.Stat(); err == nil {
+		size = s.Size()
+	}
+	err = FileSave(this.app, this.path, f, size, this.req.Header.Get("If-Match"), this.req.Header.Get("If-None-Match"))
+	if err != nil {
+		// trying again with the same content would fail for the same reason
+		Log.Debug("webdav::save '%s'", err.Error())
+		this.fwrite = nil
+		this.err = err
+		os.Remove(this.cache + "_writer")
+		return err
+	}
+	this.fwrite = nil
+	if err = os.Rename(this.cache+"_writer", this.cache+"_reader"); err != nil {
+		os.Remove(this.cache + "_writer")
+		return nil
 	}
-	f.Close()
-	return err
+	webdavCache.SetKey(this.cache+"_reader", nil)
+	return nil
 }
 
 func (this WebdavFile) Name() string {
@@ -315,10 +358,13 @@ func (this WebdavFile) Sys() interface{} {
 
 func (this WebdavFile) ETag(ctx context.Context) (string, error) {
 	// Building an etag can be an expensive call if the data isn't available locally.
-	// => 2 etags strategies:
+	// => 3 etags strategies:
+	// - use what the backend told us about the file when it was last stat, as the rest of the app does
 	// - use a legit etag value when the data is already in our cache
 	// - use a dummy value that's changing all the time when we don't have much info
-
+	if etag := FileETag(this.info); etag != "" {
+		return etag, nil
+	}
 	etag := Hash(fmt.Sprintf("%d%s", this.ModTime().UnixNano(), this.path), 20)
 	if this.fread != nil {
 		if s, err := this.fread.Stat(); err == nil {
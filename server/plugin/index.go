@@ -2,6 +2,7 @@ package plugin
 
 import (
 	. "github.com/mickael-kerjean/filestash/server/common"
+	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_audio_transcoder"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_authenticate_admin"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_authenticate_htpasswd"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_authenticate_ldap"
@@ -10,6 +11,7 @@ import (
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_authenticate_saml"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_backend_artifactory"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_backend_backblaze"
+	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_backend_cache"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_backend_dav"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_backend_dropbox"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_backend_ftp"
@@ -28,11 +30,16 @@ import (
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_backend_tmp"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_backend_webdav"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_editor_onlyoffice"
+	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_editor_wopi"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_handler_console"
+	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_handler_webhook"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_image_ascii"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_image_c"
+	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_image_resize"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_image_transcode"
+	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_search_sqlitefts"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_search_stateless"
+	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_security_antivirus"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_security_scanner"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_security_svg"
 	_ "github.com/mickael-kerjean/filestash/server/plugin/plg_starter_http"
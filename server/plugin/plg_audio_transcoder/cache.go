@@ -0,0 +1,11 @@
+package plg_audio_transcoder
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+/*
+ * Transcoded files are kept on disk so they can be seeked through and played again without running
+ * ffmpeg. When the cache grows past its limit, the files played the least recently go first
+ */
+var audioCache = NewDiskCache(AudioCachePath, func() int { return transcoder_cache_size() })
@@ -0,0 +1,97 @@
+package plg_audio_transcoder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+type FFProbeData struct {
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   float64           `json:"duration,string"`
+		BitRate    int               `json:"bit_rate,string"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType   string            `json:"codec_type"`
+		CodecName   string            `json:"codec_name"`
+		SampleRate  int               `json:"sample_rate,string"`
+		Channels    int               `json:"channels"`
+		Tags        map[string]string `json:"tags"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+}
+
+func ffprobe(ctx context.Context, input string, stdin io.Reader) (FFProbeData, error) {
+	var stdout bytes.Buffer
+	var probe FFProbeData
+	cmd := exec.CommandContext(
+		ctx, "ffprobe",
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_format", "-show_streams",
+		"-i", input,
+	)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return probe, err
+	}
+	err := json.Unmarshal(stdout.Bytes(), &probe)
+	return probe, err
+}
+
+// audio transcoding is cheap compared to video but a whole album being converted at once would
+// still be enough to keep every core busy
+var ffmpegSlots chan struct{}
+
+func ffmpeg(ctx context.Context, stdin io.Reader, stdout io.Writer, args ...string) error {
+	select {
+	case ffmpegSlots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-ffmpegSlots }()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		Log.Debug("plg_audio_transcoder::ffmpeg '%s' - %s", err.Error(), stderr.String())
+		return err
+	}
+	return nil
+}
+
+/*
+ * withInput gives the content of a file to ffmpeg or ffprobe. We first try straight from the
+ * stream, which works for most formats. Those that need to seek through the file, like m4a files
+ * with their metadata at the end, get a local copy of the file instead. In that case fn is called
+ * twice and whatever the first call produced has to be thrown away
+ */
+func withInput(reader io.Reader, fn func(input string, stdin io.Reader) error) error {
+	tmp := GetAbsolutePath(TMP_PATH, "audio_"+QuickString(20)+".dat")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	if err = fn("pipe:0", io.TeeReader(reader, f)); err == nil {
+		return nil
+	} else if _, err = io.Copy(f, reader); err != nil {
+		return err
+	}
+	return fn(tmp, nil)
+}
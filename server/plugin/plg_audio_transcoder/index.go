@@ -0,0 +1,120 @@
+package plg_audio_transcoder
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	. "github.com/mickael-kerjean/filestash/server/middleware"
+)
+
+const AudioCachePath = "data/cache/audio/"
+
+var transcoder_cache_size func() int
+
+func init() {
+	ffmpegIsInstalled := false
+	ffprobeIsInstalled := false
+	if _, err := exec.LookPath("ffmpeg"); err == nil {
+		ffmpegIsInstalled = true
+	}
+	if _, err := exec.LookPath("ffprobe"); err == nil {
+		ffprobeIsInstalled = true
+	}
+	plugin_enable := func() bool {
+		return Config.Get("features.audio.enable_transcoder").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "enable_transcoder"
+			f.Type = "enable"
+			f.Target = []string{"audio_transcode_format", "audio_transcoder_cache_size"}
+			f.Description = "Enable/Disable on demand audio transcoding for formats browsers can't play"
+			f.Default = true
+			if ffmpegIsInstalled == false || ffprobeIsInstalled == false {
+				f.Default = false
+			}
+			return f
+		}).Bool()
+	}
+
+	transcode_format := func() string {
+		return Config.Get("features.audio.transcode_format").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "audio_transcode_format"
+			f.Name = "transcode_format"
+			f.Type = "text"
+			f.Description = "Audio format that are transcoded before being played"
+			f.Default = "ape,wma,aif,aiff,ra"
+			f.Placeholder = fmt.Sprintf("Default: '%s'", f.Default)
+			return f
+		}).String()
+	}
+	transcode_format()
+
+	transcoder_cache_size = func() int {
+		return Config.Get("features.audio.transcoder_cache_size").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "audio_transcoder_cache_size"
+			f.Name = "transcoder_cache_size"
+			f.Type = "number"
+			f.Description = "Size in MB of the disk cache where transcoded audio files are kept"
+			f.Placeholder = "Default: 1024MB"
+			f.Default = 1024
+			return f
+		}).Int()
+	}
+	transcoder_cache_size()
+
+	if plugin_enable() == false {
+		return
+	} else if ffmpegIsInstalled == false {
+		Log.Warning("[plugin audio transcoder] ffmpeg needs to be installed")
+		return
+	} else if ffprobeIsInstalled == false {
+		Log.Warning("[plugin audio transcoder] ffprobe needs to be installed")
+		return
+	}
+	os.MkdirAll(GetAbsolutePath(AudioCachePath), os.ModePerm)
+	ffmpegSlots = make(chan struct{}, runtime.NumCPU())
+
+	Hooks.Register.ProcessFileContentBeforeSend(audio_transcode)
+	for _, mType := range AllMimeTypes() {
+		if _, ok := Hooks.Get.MetadataExtractor()[mType]; ok == false && strings.HasPrefix(mType, "audio/") {
+			Hooks.Register.MetadataExtractor(mType, audio_metadata)
+		}
+	}
+	Hooks.Register.HttpEndpoint(func(r *mux.Router, app *App) error {
+		middlewares := []Middleware{ApiHeaders, SecureHeaders, WithPublicAPI, SessionStart, LoggedInOnly}
+		r.HandleFunc(COOKIE_PATH+"audio/meta", NewMiddlewareChain(AudioMetaHandler, middlewares, *app)).Methods("GET")
+		r.HandleFunc(COOKIE_PATH+"audio/cover", NewMiddlewareChain(AudioCoverHandler, middlewares, *app)).Methods("GET")
+		return nil
+	})
+	Hooks.Register.HttpEndpoint(func(r *mux.Router, app *App) error {
+		r.HandleFunc(OverrideAudioSourceMapper, func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Content-Type", GetMimeType(req.URL.String()))
+			res.Write([]byte(`window.overrides["audio-map-source"] = function(source, path){`))
+			formats := strings.Split(transcode_format(), ",")
+			for i := 0; i < len(formats); i++ {
+				formats[i] = strings.TrimSpace(formats[i])
+				if formats[i] == "" {
+					continue
+				}
+				res.Write([]byte(fmt.Sprintf(`if(/\.%s$/i.test(path)){ return source + "&transcode=mp3"; } `, regexp.QuoteMeta(formats[i]))))
+			}
+			res.Write([]byte(`    return source;`))
+			res.Write([]byte(`}`))
+		})
+		return nil
+	})
+}
@@ -0,0 +1,146 @@
+package plg_audio_transcoder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/ctrl"
+	"github.com/mickael-kerjean/filestash/server/model"
+)
+
+type AudioMetadata struct {
+	Format     string            `json:"format"`
+	Codec      string            `json:"codec"`
+	Duration   float64           `json:"duration"`
+	BitRate    int               `json:"bit_rate"`
+	SampleRate int               `json:"sample_rate"`
+	Channels   int               `json:"channels"`
+	Tags       map[string]string `json:"tags"`
+	Cover      bool              `json:"cover"`
+}
+
+/*
+ * The tags of a file come from ID3 for mp3, Vorbis comments for flac/ogg/opus, atoms for m4a, ...
+ * ffprobe takes care of all those and we give them back with lower cased keys, eg: "title",
+ * "artist", "album", "date", "track", "genre"
+ */
+func AudioMetaHandler(ctx *App, res http.ResponseWriter, req *http.Request) {
+	reader, err := audioOpen(ctx, req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	defer reader.Close()
+
+	var probe FFProbeData
+	if err = withInput(reader, func(input string, stdin io.Reader) error {
+		probe, err = ffprobe(req.Context(), input, stdin)
+		return err
+	}); err != nil {
+		Log.Debug("plg_audio_transcoder::meta err[%s]", err.Error())
+		SendErrorResult(res, NewError("Unable to read the file", 400))
+		return
+	}
+	SendSuccessResult(res, audioMetadata(probe))
+}
+
+func audioMetadata(probe FFProbeData) AudioMetadata {
+	meta := AudioMetadata{
+		Format:   probe.Format.FormatName,
+		Duration: probe.Format.Duration,
+		BitRate:  probe.Format.BitRate,
+		Tags:     map[string]string{},
+	}
+	for k, v := range probe.Format.Tags {
+		meta.Tags[strings.ToLower(k)] = v
+	}
+	for _, s := range probe.Streams {
+		if s.Disposition.AttachedPic == 1 {
+			meta.Cover = true
+			continue
+		} else if s.CodecType != "audio" || meta.Codec != "" {
+			continue
+		}
+		meta.Codec = s.CodecName
+		meta.SampleRate = s.SampleRate
+		meta.Channels = s.Channels
+		for k, v := range s.Tags {
+			if _, ok := meta.Tags[strings.ToLower(k)]; ok == false {
+				meta.Tags[strings.ToLower(k)] = v
+			}
+		}
+	}
+	return meta
+}
+
+// audio_metadata is the extractor behind /api/files/meta for the formats we can't read in pure Go
+func audio_metadata(reader io.Reader, m *MediaMetadata) error {
+	c, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var probe FFProbeData
+	if err := withInput(reader, func(input string, stdin io.Reader) (err error) {
+		probe, err = ffprobe(c, input, stdin)
+		return err
+	}); err != nil {
+		return err
+	}
+	meta := audioMetadata(probe)
+	m.Format = meta.Format
+	m.AudioCodec = meta.Codec
+	m.Duration = meta.Duration
+	m.BitRate = meta.BitRate
+	m.SampleRate = meta.SampleRate
+	m.Channels = meta.Channels
+	m.Cover = meta.Cover
+	m.Tags = meta.Tags
+	return nil
+}
+
+func AudioCoverHandler(ctx *App, res http.ResponseWriter, req *http.Request) {
+	reader, err := audioOpen(ctx, req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	defer reader.Close()
+
+	var cover bytes.Buffer
+	if err = withInput(reader, func(input string, stdin io.Reader) error {
+		cover.Reset()
+		return ffmpeg(
+			req.Context(), stdin, &cover,
+			"-i", input, "-map", "0:v:0", "-c:v", "copy", "-frames:v", "1", "-f", "image2pipe", "pipe:1",
+		)
+	}); err != nil || cover.Len() == 0 {
+		SendErrorResult(res, ErrNotFound)
+		return
+	}
+	res.Header().Set("Content-Type", http.DetectContentType(cover.Bytes()))
+	res.Header().Set("Cache-Control", "private, max-age=3600")
+	res.Write(cover.Bytes())
+}
+
+func audioOpen(ctx *App, req *http.Request) (io.ReadCloser, error) {
+	if model.CanRead(ctx) == false {
+		return nil, ErrPermissionDenied
+	}
+	query := req.URL.Query()
+	if strings.HasPrefix(GetMimeType(query.Get("path")), "audio/") == false {
+		return nil, NewError("Not an audio file", 400)
+	}
+	path, err := ctrl.PathBuilder(ctx, query.Get("path"))
+	if err != nil {
+		return nil, err
+	}
+	for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+		if err = auth.Cat(ctx, path); err != nil {
+			return nil, ErrNotAuthorized
+		}
+	}
+	return ctx.Backend.Cat(path)
+}
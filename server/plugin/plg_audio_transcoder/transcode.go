@@ -0,0 +1,249 @@
+package plg_audio_transcoder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/ctrl"
+)
+
+const TRANSCODE_TIMEOUT = 30 * time.Minute
+
+type audioFormat struct {
+	Mime string
+	Ext  string
+	Args []string
+}
+
+var AUDIO_FORMATS = map[string]audioFormat{
+	"opus": {"audio/ogg", "opus", []string{"-c:a", "libopus", "-b:a", "128k", "-f", "ogg"}},
+	"mp3":  {"audio/mpeg", "mp3", []string{"-c:a", "libmp3lame", "-q:a", "2", "-f", "mp3"}},
+}
+
+/*
+ * A transcode runs in the background, independently of the request that started it, so the
+ * result ends up in the cache even if the listener has moved on to the next track. While it runs,
+ * people read the output as it is being written. When ffmpeg has to start over from a local copy
+ * of the file, that new attempt is written elsewhere so what was already read isn't overwritten
+ */
+type transcodeJob struct {
+	path    string
+	attempt int
+	format  audioFormat
+	done    chan struct{}
+	err     error
+	mu      sync.Mutex
+}
+
+var ErrTranscodeRestarted = NewError("The transcode had to start over", 500)
+
+var transcodeJobs = struct {
+	sync.Mutex
+	m map[string]*transcodeJob
+}{m: map[string]*transcodeJob{}}
+
+func audio_transcode(reader io.ReadCloser, ctx *App, res *http.ResponseWriter, req *http.Request) (io.ReadCloser, error) {
+	query := req.URL.Query()
+	format, ok := AUDIO_FORMATS[query.Get("transcode")]
+	if ok == false {
+		return reader, nil
+	}
+	path := query.Get("path")
+	if strings.HasPrefix(GetMimeType(path), "audio/") == false {
+		return reader, nil
+	}
+
+	name := audioCacheKey(ctx, path, format) + "." + format.Ext
+	(*res).Header().Set("Content-Type", format.Mime)
+	if f, ok := audioCache.Get(name); ok {
+		reader.Close()
+		return f, nil
+	}
+	job, err := transcodeStart(name, reader, format)
+	if err != nil {
+		Log.Debug("plg_audio_transcoder::transcode path[%s] err[%s]", path, err.Error())
+		return nil, err
+	}
+	f, attempt, err := job.open()
+	if err != nil {
+		return nil, err
+	}
+	// until the transcode is completed, we don't know how big the output is and can't serve
+	// a range. The content is streamed as it comes
+	req.Header.Del("range")
+	return &followReader{job: job, file: f, attempt: attempt}, nil
+}
+
+func transcodeStart(name string, reader io.ReadCloser, format audioFormat) (*transcodeJob, error) {
+	transcodeJobs.Lock()
+	defer transcodeJobs.Unlock()
+	if job, found := transcodeJobs.m[name]; found {
+		reader.Close()
+		return job, nil
+	}
+	job := &transcodeJob{
+		format: format,
+		done:   make(chan struct{}),
+	}
+	if _, err := job.next(); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	transcodeJobs.m[name] = job
+
+	go func() {
+		c, cancel := context.WithTimeout(context.Background(), TRANSCODE_TIMEOUT)
+		defer cancel()
+		attempt := 0
+		err := withInput(reader, func(input string, stdin io.Reader) error {
+			output := job.path
+			if attempt += 1; attempt > 1 {
+				var err error
+				if output, err = job.next(); err != nil {
+					return err
+				}
+			}
+			args := []string{"-i", input, "-map", "0:a:0", "-vn", "-map_metadata", "0"}
+			args = append(args, format.Args...)
+			return ffmpeg(c, stdin, nil, append(args, "-y", output)...)
+		})
+		reader.Close()
+
+		job.mu.Lock()
+		if err == nil {
+			if err = audioCache.Put(name, job.path); err == nil {
+				job.path = audioCache.Path(name)
+			}
+		}
+		if err != nil {
+			os.Remove(job.path)
+		}
+		job.err = err
+		job.mu.Unlock()
+
+		transcodeJobs.Lock()
+		delete(transcodeJobs.m, name)
+		transcodeJobs.Unlock()
+		close(job.done)
+	}()
+	return job, nil
+}
+
+// next gives a new file for ffmpeg to write in, the output of the attempts made before is discarded
+func (this *transcodeJob) next() (string, error) {
+	path := GetAbsolutePath(TMP_PATH, "audio_"+QuickString(20)+"."+this.format.Ext)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.path != "" {
+		os.Remove(this.path)
+	}
+	this.path = path
+	this.attempt += 1
+	return path, nil
+}
+
+func (this *transcodeJob) open() (*os.File, int, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.err != nil {
+		return nil, 0, this.err
+	}
+	f, err := os.Open(this.path)
+	return f, this.attempt, err
+}
+
+// followReader reads a file while it is being written, like `tail -f` would
+type followReader struct {
+	job     *transcodeJob
+	file    *os.File
+	attempt int
+	n       int64
+}
+
+func (this *followReader) Read(p []byte) (int, error) {
+	for {
+		if err := this.follow(); err != nil {
+			return 0, err
+		}
+		n, err := this.file.Read(p)
+		if n > 0 {
+			this.n += int64(n)
+			return n, nil
+		} else if err != nil && err != io.EOF {
+			return 0, err
+		}
+		select {
+		case <-this.job.done:
+			if this.job.err != nil {
+				return 0, this.job.err
+			} else if err = this.follow(); err != nil {
+				return 0, err
+			} else if n, _ = this.file.Read(p); n > 0 {
+				this.n += int64(n)
+				return n, nil
+			}
+			return 0, io.EOF
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+/*
+ * follow moves on to the output of the attempt that replaced the one we were reading. Once some of
+ * the content was given away, there's no going back: what comes next wouldn't fit with it
+ */
+func (this *followReader) follow() error {
+	this.job.mu.Lock()
+	attempt, path := this.job.attempt, this.job.path
+	this.job.mu.Unlock()
+	if attempt == this.attempt {
+		return nil
+	} else if this.n > 0 {
+		return ErrTranscodeRestarted
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	this.file.Close()
+	this.file = f
+	this.attempt = attempt
+	return nil
+}
+
+func (this *followReader) Close() error {
+	return this.file.Close()
+}
+
+/*
+ * audioCacheKey identifies the transcoded version of a file, any change made to the file gives a
+ * different key
+ */
+func audioCacheKey(ctx *App, path string, format audioFormat) string {
+	version := QuickString(10)
+	if p, err := ctrl.PathBuilder(ctx, path); err == nil {
+		if files, err := ctx.Backend.Ls(EnforceDirectory(filepath.Dir(p))); err == nil {
+			for _, f := range files {
+				if f.Name() == filepath.Base(p) && f.ModTime().IsZero() == false {
+					version = fmt.Sprintf("%d %d", f.ModTime().UnixNano(), f.Size())
+					break
+				}
+			}
+		}
+	}
+	return Hash(fmt.Sprintf("%s %s %s %s %s", GenerateID(ctx), path, version, format.Ext, SECRET_KEY), 20)
+}
@@ -0,0 +1,80 @@
+package plg_backend_cache
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"strings"
+)
+
+var (
+	CACHE_ENABLE   func() bool
+	CACHE_BACKENDS func() []string
+	CACHE_SIZE     func() int
+	CACHE_LS_TTL   func() int
+)
+
+func init() {
+	CACHE_ENABLE = func() bool {
+		return Config.Get("features.cache.enable").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "enable"
+			f.Type = "enable"
+			f.Target = []string{"cache_backends", "cache_size", "cache_ls_ttl"}
+			f.Description = "Enable/Disable the local read-through cache for slow remote storages"
+			f.Placeholder = "Default: false"
+			f.Default = false
+			return f
+		}).Bool()
+	}
+	CACHE_ENABLE()
+	CACHE_BACKENDS = func() []string {
+		list := strings.Split(Config.Get("features.cache.backends").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "cache_backends"
+			f.Name = "backends"
+			f.Type = "text"
+			f.Description = "Comma separated list of storage types the cache applies to"
+			f.Placeholder = "Default: ftp,webdav,backblaze"
+			f.Default = "ftp,webdav,backblaze"
+			return f
+		}).String(), ",")
+		for i := range list {
+			list[i] = strings.TrimSpace(list[i])
+		}
+		return list
+	}
+	CACHE_BACKENDS()
+	CACHE_SIZE = func() int {
+		return Config.Get("features.cache.size").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "cache_size"
+			f.Name = "size"
+			f.Type = "number"
+			f.Description = "Maximum size of the on disk cache in MB, least recently used files are evicted first"
+			f.Placeholder = "Default: 1024MB"
+			f.Default = 1024
+			return f
+		}).Int()
+	}
+	CACHE_SIZE()
+	CACHE_LS_TTL = func() int {
+		return Config.Get("features.cache.ls_ttl").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "cache_ls_ttl"
+			f.Name = "ls_ttl"
+			f.Type = "number"
+			f.Description = "How long a directory listing is kept in cache, in seconds"
+			f.Placeholder = "Default: 10s"
+			f.Default = 10
+			return f
+		}).Int()
+	}
+	CACHE_LS_TTL()
+}
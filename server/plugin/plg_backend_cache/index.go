@@ -0,0 +1,270 @@
+package plg_backend_cache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	. "github.com/mickael-kerjean/filestash/server/middleware"
+)
+
+const BackendCachePath = "data/cache/backend/"
+
+var (
+	lru     *DiskLRU
+	lsCache AppCache
+)
+
+func init() {
+	cachePath := GetAbsolutePath(BackendCachePath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(cachePath, os.ModePerm)
+
+	lru = NewDiskLRU()
+	lsCache = NewQuickCache(10, 30)
+
+	Hooks.Register.BackendMiddleware(func(b IBackend, params map[string]string, app *App) IBackend {
+		if CACHE_ENABLE() == false {
+			return b
+		} else if _, ok := b.(interface{ OAuthURL() string }); ok {
+			// the oauth dance relies on methods we don't want to proxy
+			return b
+		} else if _, ok := b.(interface {
+			OAuthToken(*map[string]interface{}) error
+		}); ok {
+			return b
+		}
+		for _, t := range CACHE_BACKENDS() {
+			if t == params["type"] {
+				return &CachedBackend{
+					backend: b,
+					id:      GenerateID(&App{Session: params}),
+					home:    params["path"],
+				}
+			}
+		}
+		return b
+	})
+	Hooks.Register.HttpEndpoint(func(r *mux.Router, app *App) error {
+		middlewares := []Middleware{ApiHeaders, AdminOnly, SecureOrigin}
+		r.HandleFunc("/admin/api/cache", NewMiddlewareChain(statsHandler, middlewares, *app)).Methods("GET")
+		r.HandleFunc("/admin/api/cache", NewMiddlewareChain(purgeHandler, middlewares, *app)).Methods("DELETE")
+		return nil
+	})
+}
+
+func statsHandler(ctx *App, res http.ResponseWriter, req *http.Request) {
+	stats := lru.Stats()
+	stats["enable"] = CACHE_ENABLE()
+	stats["max_size"] = int64(CACHE_SIZE()) * 1024 * 1024
+	SendSuccessResult(res, stats)
+}
+
+func purgeHandler(ctx *App, res http.ResponseWriter, req *http.Request) {
+	lru.Purge()
+	lsCache.Cache.Flush()
+	SendSuccessResult(res, nil)
+}
+
+/*
+ * CachedBackend is a read-through cache sitting in front of another backend:
+ * - file content is kept on disk, keyed by path + mtime + size so that a change made on the remote
+ *   is picked up as soon as the listing that contains the file expires
+ * - listings are kept in memory for a few seconds
+ * - every write made through filestash invalidates the relevant entries
+ * - the optional methods the rest of the app looks for on a backend (Meta, Home, Close) are
+ *   forwarded so the cache doesn't change what a backend can do
+ * - Refresh lets the rest of the app skip the cache when it needs to know the current version of a file
+ */
+type CachedBackend struct {
+	backend IBackend
+	id      string
+	home    string
+}
+
+func (this *CachedBackend) Init(params map[string]string, app *App) (IBackend, error) {
+	return this.backend.Init(params, app)
+}
+
+func (this *CachedBackend) Ls(path string) ([]os.FileInfo, error) {
+	key := this.id + "::" + path
+	if files, ok := lsCache.Cache.Get(key); ok {
+		atomic.AddUint64(&lru.stats.LsHits, 1)
+		return files.([]os.FileInfo), nil
+	}
+	atomic.AddUint64(&lru.stats.LsMisses, 1)
+	files, err := this.backend.Ls(path)
+	if err != nil {
+		return files, err
+	}
+	lsCache.Cache.Set(key, files, time.Duration(CACHE_LS_TTL())*time.Second)
+	return files, nil
+}
+
+func (this *CachedBackend) Cat(path string) (io.ReadCloser, error) {
+	root, filename := SplitPath(path)
+	files, err := this.Ls(root)
+	if err != nil || filename == "" {
+		return this.backend.Cat(path)
+	}
+	var info os.FileInfo
+	for i := range files {
+		if files[i].Name() == filename {
+			info = files[i]
+			break
+		}
+	}
+	if info == nil || info.IsDir() {
+		return this.backend.Cat(path)
+	}
+
+	key := Hash(fmt.Sprintf("%s%s%d%d", this.id, path, info.ModTime().UnixNano(), info.Size()), 20)
+	if file := lru.Get(key); file != "" {
+		if f, err := os.OpenFile(file, os.O_RDONLY, os.ModePerm); err == nil {
+			return f, nil
+		}
+	}
+	reader, err := this.backend.Cat(path)
+	if err != nil {
+		return reader, err
+	}
+	maxSize := int64(CACHE_SIZE()) * 1024 * 1024
+	if info.Size() > maxSize {
+		return reader, nil
+	}
+	tmp, err := os.CreateTemp(GetAbsolutePath(BackendCachePath), "cat_*.dat")
+	if err != nil {
+		Log.Debug("plg_backend_cache::cat create_temp '%s'", err.Error())
+		return reader, nil
+	}
+	return &cacheWriter{
+		reader: reader,
+		tmp:    tmp,
+		onComplete: func(file string, size int64) {
+			lru.Add(key, this.id+"::"+path, file, size, maxSize)
+		},
+	}, nil
+}
+
+func (this *CachedBackend) Mkdir(path string) error {
+	this.invalidate(path)
+	return this.backend.Mkdir(path)
+}
+
+func (this *CachedBackend) Rm(path string) error {
+	this.invalidate(path)
+	return this.backend.Rm(path)
+}
+
+func (this *CachedBackend) Mv(from string, to string) error {
+	this.invalidate(from)
+	this.invalidate(to)
+	return this.backend.Mv(from, to)
+}
+
+func (this *CachedBackend) Save(path string, file io.Reader) error {
+	this.invalidate(path)
+	err := this.backend.Save(path, file)
+	this.invalidate(path)
+	return err
+}
+
+func (this *CachedBackend) Touch(path string) error {
+	this.invalidate(path)
+	return this.backend.Touch(path)
+}
+
+func (this *CachedBackend) LoginForm() Form {
+	return this.backend.LoginForm()
+}
+
+func (this *CachedBackend) Meta(path string) Metadata {
+	if obj, ok := this.backend.(interface{ Meta(path string) Metadata }); ok {
+		return obj.Meta(path)
+	}
+	return Metadata{}
+}
+
+func (this *CachedBackend) Home() (string, error) {
+	if obj, ok := this.backend.(interface{ Home() (string, error) }); ok {
+		return obj.Home()
+	}
+	// same behavior as what happens for backends that can't tell where home is
+	if _, err := this.backend.Ls(EnforceDirectory(strings.TrimSpace(this.home))); err != nil {
+		return "/", err
+	}
+	return "/", nil
+}
+
+func (this *CachedBackend) Close() error {
+	if obj, ok := this.backend.(interface{ Close() error }); ok {
+		return obj.Close()
+	}
+	return nil
+}
+
+// Refresh forgets the listing of a folder, for those who can't make do with one a few seconds old
+func (this *CachedBackend) Refresh(path string) {
+	lsCache.Cache.Delete(this.id + "::" + path)
+}
+
+func (this *CachedBackend) invalidate(path string) {
+	lru.Invalidate(this.id + "::" + path)
+	parent := this.id + "::" + EnforceDirectory(filepath.Dir(strings.TrimSuffix(path, "/")))
+	for key := range lsCache.Cache.Items() {
+		if isUnder(key, this.id+"::"+path) || key == parent {
+			lsCache.Cache.Delete(key)
+		}
+	}
+}
+
+// isUnder tells if p is the given path or something living inside it: /a/foo/bar is under /a/foo
+// but /a/foobar isn't
+func isUnder(p string, path string) bool {
+	return p == path || strings.HasPrefix(p, strings.TrimSuffix(path, "/")+"/")
+}
+
+/*
+ * cacheWriter streams the content from the remote while keeping a copy on disk. The copy only
+ * makes it to the cache if the stream was consumed entirely
+ */
+type cacheWriter struct {
+	reader     io.ReadCloser
+	tmp        *os.File
+	written    int64
+	complete   bool
+	failed     bool
+	onComplete func(file string, size int64)
+}
+
+func (this *cacheWriter) Read(p []byte) (int, error) {
+	n, err := this.reader.Read(p)
+	if n > 0 && this.failed == false {
+		if _, werr := this.tmp.Write(p[:n]); werr != nil {
+			this.failed = true
+		}
+		this.written += int64(n)
+	}
+	if err == io.EOF {
+		this.complete = true
+	}
+	return n, err
+}
+
+func (this *cacheWriter) Close() error {
+	err := this.reader.Close()
+	this.tmp.Close()
+	if this.complete && this.failed == false {
+		this.onComplete(this.tmp.Name(), this.written)
+		return err
+	}
+	os.Remove(this.tmp.Name())
+	return err
+}
@@ -0,0 +1,147 @@
+package plg_backend_cache
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * DiskLRU keeps track of the files we have stored on disk. The index only lives in memory,
+ * which is why the cache folder gets wiped out every time the application starts
+ */
+type DiskLRU struct {
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+	paths   map[string]string
+	size    int64
+	stats   CacheStats
+}
+
+type diskEntry struct {
+	key  string
+	path string
+	file string
+	size int64
+}
+
+type CacheStats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	LsHits      uint64 `json:"ls_hits"`
+	LsMisses    uint64 `json:"ls_misses"`
+	Evictions   uint64 `json:"evictions"`
+	Invalidated uint64 `json:"invalidated"`
+}
+
+func NewDiskLRU() *DiskLRU {
+	return &DiskLRU{
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+		paths:   make(map[string]string),
+	}
+}
+
+func (this *DiskLRU) Get(key string) string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	el, ok := this.entries[key]
+	if ok == false {
+		atomic.AddUint64(&this.stats.Misses, 1)
+		return ""
+	}
+	atomic.AddUint64(&this.stats.Hits, 1)
+	this.ll.MoveToFront(el)
+	return el.Value.(*diskEntry).file
+}
+
+func (this *DiskLRU) Add(key string, path string, file string, size int64, maxSize int64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if size > maxSize {
+		os.Remove(file)
+		return
+	}
+	if old, ok := this.paths[path]; ok {
+		if el, ok := this.entries[old]; ok {
+			this.remove(el)
+		}
+	}
+	this.entries[key] = this.ll.PushFront(&diskEntry{key, path, file, size})
+	this.paths[path] = key
+	this.size += size
+	for this.size > maxSize {
+		el := this.ll.Back()
+		if el == nil {
+			break
+		}
+		this.remove(el)
+		atomic.AddUint64(&this.stats.Evictions, 1)
+	}
+}
+
+// Invalidate drops everything stored under the given path, including its children
+// when the path is a folder
+func (this *DiskLRU) Invalidate(path string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for p, key := range this.paths {
+		if isUnder(p, path) == false {
+			continue
+		}
+		if el, ok := this.entries[key]; ok {
+			this.remove(el)
+			atomic.AddUint64(&this.stats.Invalidated, 1)
+		}
+	}
+}
+
+func (this *DiskLRU) Purge() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for el := this.ll.Back(); el != nil; el = this.ll.Back() {
+		this.remove(el)
+	}
+}
+
+func (this *DiskLRU) Stats() map[string]interface{} {
+	this.mu.Lock()
+	size := this.size
+	count := this.ll.Len()
+	this.mu.Unlock()
+	hits := atomic.LoadUint64(&this.stats.Hits)
+	misses := atomic.LoadUint64(&this.stats.Misses)
+	lsHits := atomic.LoadUint64(&this.stats.LsHits)
+	lsMisses := atomic.LoadUint64(&this.stats.LsMisses)
+	ratio := func(a uint64, b uint64) float64 {
+		if a+b == 0 {
+			return 0
+		}
+		return float64(a) / float64(a+b)
+	}
+	return map[string]interface{}{
+		"entries":     count,
+		"size":        size,
+		"hits":        hits,
+		"misses":      misses,
+		"hit_rate":    ratio(hits, misses),
+		"ls_hits":     lsHits,
+		"ls_misses":   lsMisses,
+		"ls_hit_rate": ratio(lsHits, lsMisses),
+		"evictions":   atomic.LoadUint64(&this.stats.Evictions),
+		"invalidated": atomic.LoadUint64(&this.stats.Invalidated),
+	}
+}
+
+func (this *DiskLRU) remove(el *list.Element) {
+	e := el.Value.(*diskEntry)
+	this.ll.Remove(el)
+	delete(this.entries, e.key)
+	if this.paths[e.path] == e.key {
+		delete(this.paths, e.path)
+	}
+	this.size -= e.size
+	os.Remove(e.file)
+}
@@ -0,0 +1,144 @@
+package plg_editor_wopi
+
+import (
+	"encoding/xml"
+	"fmt"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// what the WOPI server supports changes when it gets upgraded, it's worth looking again from time to time
+const DISCOVERY_TTL = time.Hour
+
+var (
+	discovery = struct {
+		sync.Mutex
+		actions map[string]map[string]string // extension -> action -> url
+		expire  time.Time
+	}{}
+	// urls from the discovery have optional parameters like "<ui=UI_LLCC&>" we fill or drop
+	discoveryPlaceholder = regexp.MustCompile(`<([a-zA-Z_]+)=([^&>]*)&?>`)
+)
+
+type wopiDiscovery struct {
+	NetZones []struct {
+		Name string `xml:"name,attr"`
+		Apps []struct {
+			Name    string `xml:"name,attr"`
+			Actions []struct {
+				Name   string `xml:"name,attr"`
+				Ext    string `xml:"ext,attr"`
+				Urlsrc string `xml:"urlsrc,attr"`
+			} `xml:"action"`
+		} `xml:"app"`
+	} `xml:"net-zone"`
+}
+
+func discoveryActions() (map[string]map[string]string, error) {
+	discovery.Lock()
+	defer discovery.Unlock()
+	if discovery.actions != nil && time.Now().Before(discovery.expire) {
+		return discovery.actions, nil
+	}
+
+	resp, err := HTTPClient.Get(strings.TrimSuffix(wopi_server(), "/") + "/hosting/discovery")
+	if err != nil {
+		return discovery.actions, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return discovery.actions, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	d := wopiDiscovery{}
+	if err = xml.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return discovery.actions, err
+	}
+	actions := map[string]map[string]string{}
+	for _, zone := range d.NetZones {
+		for _, app := range zone.Apps {
+			for _, action := range app.Actions {
+				if action.Ext == "" || action.Urlsrc == "" {
+					continue
+				}
+				ext := strings.ToLower(action.Ext)
+				if actions[ext] == nil {
+					actions[ext] = map[string]string{}
+				}
+				if _, ok := actions[ext][action.Name]; ok == false {
+					actions[ext][action.Name] = action.Urlsrc
+				}
+			}
+		}
+	}
+	if len(actions) == 0 {
+		return discovery.actions, fmt.Errorf("no action in the discovery")
+	}
+	discovery.actions = actions
+	discovery.expire = time.Now().Add(DISCOVERY_TTL)
+	return actions, nil
+}
+
+// discoveryMimeTypes gives the mime types of the files the WOPI server can open
+func discoveryMimeTypes() ([]string, error) {
+	actions, err := discoveryActions()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	mimes := []string{}
+	for ext, a := range actions {
+		if a["edit"] == "" && a["view"] == "" {
+			continue
+		}
+		mType := GetMimeType("file." + ext)
+		if mType == "application/octet-stream" || seen[mType] {
+			continue
+		}
+		seen[mType] = true
+		mimes = append(mimes, mType)
+	}
+	sort.Strings(mimes)
+	return mimes, nil
+}
+
+/*
+ * discoveryAction gives the url of the page of the WOPI server that opens a file, the WOPISrc is
+ * what tells it where to find the file
+ */
+func discoveryAction(ext string, canEdit bool, lang string, wopiSrc string) (string, error) {
+	actions, err := discoveryActions()
+	if err != nil {
+		return "", err
+	}
+	a := actions[strings.ToLower(ext)]
+	urlsrc := a["view"]
+	if canEdit && a["edit"] != "" || urlsrc == "" {
+		urlsrc = a["edit"]
+	}
+	if urlsrc == "" {
+		return "", ErrNotSupported
+	}
+	urlsrc = discoveryPlaceholder.ReplaceAllStringFunc(urlsrc, func(p string) string {
+		m := discoveryPlaceholder.FindStringSubmatch(p)
+		switch m[2] {
+		case "UI_LLCC", "DC_LLCC":
+			if lang != "" {
+				return m[1] + "=" + lang + "&"
+			}
+		case "DISABLE_CHAT":
+			return m[1] + "=1&"
+		}
+		return ""
+	})
+	if strings.Contains(urlsrc, "?") == false {
+		urlsrc += "?"
+	} else if strings.HasSuffix(urlsrc, "?") == false && strings.HasSuffix(urlsrc, "&") == false {
+		urlsrc += "&"
+	}
+	return urlsrc + "WOPISrc=" + wopiSrc, nil
+}
@@ -0,0 +1,195 @@
+package plg_editor_wopi
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/ctrl"
+	. "github.com/mickael-kerjean/filestash/server/middleware"
+	"github.com/mickael-kerjean/filestash/server/model"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	wopi_server   func() string
+	wopi_host_url func() string
+)
+
+func init() {
+	plugin_enable := func() bool {
+		return Config.Get("features.wopi.enable").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "enable"
+			f.Type = "enable"
+			f.Target = []string{"wopi_server", "wopi_host_url"}
+			f.Description = "Enable/Disable editing documents with a WOPI client like Collabora Online. This setting requires a restart to comes into effect"
+			f.Default = false
+			if u := os.Getenv("WOPI_URL"); u != "" {
+				f.Default = true
+			}
+			return f
+		}).Bool()
+	}()
+	wopi_server = func() string {
+		return Config.Get("features.wopi.server").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "wopi_server"
+			f.Name = "server"
+			f.Type = "text"
+			f.Description = "Location of your WOPI server, its discovery document is expected under /hosting/discovery"
+			f.Default = "http://127.0.0.1:9980"
+			f.Placeholder = "Eg: http://127.0.0.1:9980"
+			if u := os.Getenv("WOPI_URL"); u != "" {
+				f.Default = u
+				f.Placeholder = fmt.Sprintf("Default: '%s'", u)
+			}
+			return f
+		}).String()
+	}
+	wopi_host_url = func() string {
+		return Config.Get("features.wopi.host_url").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "wopi_host_url"
+			f.Name = "host_url"
+			f.Type = "text"
+			f.Description = "Location from which the WOPI server can reach Filestash. Leave it empty to use the address people connect to"
+			f.Placeholder = "Eg: http://filestash:8334"
+			return f
+		}).String()
+	}
+	wopi_server()
+	wopi_host_url()
+
+	if plugin_enable == false {
+		return
+	}
+
+	Hooks.Register.HttpEndpoint(func(r *mux.Router, app *App) error {
+		wopi := r.PathPrefix("/wopi/files/{id}").Subrouter()
+		wopi.HandleFunc("", CheckFileInfoHandler).Methods("GET")
+		wopi.HandleFunc("", FileOperationHandler).Methods("POST")
+		wopi.HandleFunc("/contents", GetFileHandler).Methods("GET")
+		wopi.HandleFunc("/contents", PutFileHandler).Methods("POST")
+
+		r.HandleFunc(
+			COOKIE_PATH+"wopi/iframe",
+			NewMiddlewareChain(
+				IframeContentHandler,
+				[]Middleware{SessionStart, LoggedInOnly},
+				*app,
+			),
+		).Methods("GET")
+		return nil
+	})
+
+	// the WOPI server tells which file extensions it knows about, it might not be up yet when we start
+	go func() {
+		for wait := 5 * time.Second; ; wait = min(2*wait, 10*time.Minute) {
+			mimes, err := discoveryMimeTypes()
+			if err == nil {
+				Hooks.Register.XDGOpen(fmt.Sprintf(`
+    if(["%s"].indexOf(mime) !== -1) {
+        return ["appframe", {"endpoint": "/api/wopi/iframe"}];
+    }
+    `, strings.Join(mimes, `", "`)))
+				return
+			}
+			Log.Warning("[wopi] discovery '%s', retrying in %s", err.Error(), wait)
+			time.Sleep(wait)
+		}
+	}()
+}
+
+// hostUrl is where the WOPI server calls us back
+func hostUrl(req *http.Request) string {
+	if u := wopi_host_url(); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return hostOrigin(req)
+}
+
+func IframeContentHandler(ctx *App, res http.ResponseWriter, req *http.Request) {
+	if model.CanRead(ctx) == false {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	path, err := ctrl.PathBuilder(ctx, req.URL.Query().Get("path"))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+		if err = auth.Cat(ctx, path); err != nil {
+			Log.Info("[wopi] iframe::auth '%s'", err.Error())
+			SendErrorResult(res, ErrNotAuthorized)
+			return
+		}
+	}
+	canEdit := model.CanEdit(ctx)
+	userId := GenerateID(ctx)
+	username := "Me"
+	if ctx.Session["username"] != "" {
+		username = ctx.Session["username"]
+	}
+	if ctx.Share.Id != "" {
+		username = "Anonymous"
+		userId = RandomString(10)
+	}
+	lang := strings.Split(strings.Split(req.Header.Get("Accept-Language"), ",")[0], ";")[0]
+
+	accessToken, t := tokenCreate(ctx, path, canEdit, Hash(userId, 20), username, hostOrigin(req))
+	action, err := discoveryAction(
+		strings.TrimPrefix(filepath.Ext(path), "."), canEdit, lang,
+		url.QueryEscape(hostUrl(req)+"/wopi/files/"+t.FileId),
+	)
+	if err != nil {
+		Log.Warning("[wopi] discovery '%s'", err.Error())
+		res.WriteHeader(http.StatusServiceUnavailable)
+		res.Write([]byte("<p>The WOPI server can't open this document</p>"))
+		res.Write([]byte("<style>p {color: white; text-align: center; margin-top: 50px; font-size: 20px; opacity: 0.6; font-family: monospace; } </style>"))
+		return
+	}
+	res.Write([]byte(fmt.Sprintf(`<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+  </head>
+  <body>
+    <style> body { margin: 0; } body, html{ height: 100%%; } iframe { width: 100%%; height: 100%%; border: none; display: block; } </style>
+    <form id="wopi" action="%s" method="post" target="wopi_frame">
+      <input name="access_token" value="%s" type="hidden" />
+      <input name="access_token_ttl" value="%d" type="hidden" />
+    </form>
+    <iframe name="wopi_frame" allow="fullscreen; clipboard-read; clipboard-write"></iframe>
+    <script>document.getElementById("wopi").submit();</script>
+  </body>
+</html>`,
+		html.EscapeString(action),
+		html.EscapeString(accessToken),
+		t.Expire.UnixMilli(),
+	)))
+}
+
+// hostOrigin is where people see Filestash from, the WOPI client only talks to that page
+func hostOrigin(req *http.Request) string {
+	scheme := "http"
+	if s := req.Header.Get("X-Forwarded-Proto"); s != "" {
+		scheme = s
+	} else if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
@@ -0,0 +1,67 @@
+package plg_editor_wopi
+
+import (
+	"encoding/base64"
+	"strings"
+	"unicode/utf16"
+)
+
+// file names in WOPI headers are encoded in UTF-7: ascii as it is, the rest as base64 of utf-16
+const utf7Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+func utf7Decode(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); {
+		if s[i] != '+' {
+			out.WriteByte(s[i])
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(s) && strings.IndexByte(utf7Alphabet, s[j]) >= 0 {
+			j++
+		}
+		if section := s[i+1 : j]; section == "" {
+			out.WriteByte('+')
+		} else if b, err := base64.RawStdEncoding.DecodeString(section); err == nil {
+			units := make([]uint16, len(b)/2)
+			for k := range units {
+				units[k] = uint16(b[2*k])<<8 | uint16(b[2*k+1])
+			}
+			out.WriteString(string(utf16.Decode(units)))
+		}
+		if j < len(s) && s[j] == '-' {
+			j++
+		}
+		i = j
+	}
+	return out.String()
+}
+
+func utf7Encode(s string) string {
+	var out strings.Builder
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		if r := runes[i]; r == '+' {
+			out.WriteString("+-")
+			i++
+			continue
+		} else if r >= 0x20 && r < 0x7f {
+			out.WriteRune(r)
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && (runes[j] < 0x20 || runes[j] >= 0x7f) {
+			j++
+		}
+		units := utf16.Encode(runes[i:j])
+		b := make([]byte, 0, 2*len(units))
+		for _, u := range units {
+			b = append(b, byte(u>>8), byte(u))
+		}
+		out.WriteString("+" + base64.RawStdEncoding.EncodeToString(b) + "-")
+		i = j
+	}
+	return out.String()
+}
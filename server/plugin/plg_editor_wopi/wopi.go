@@ -0,0 +1,364 @@
+package plg_editor_wopi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TOKEN_TTL     = 10 * time.Hour
+	LOCK_DURATION = 30 * time.Minute
+)
+
+var (
+	tokens = NewAppCache(TOKEN_TTL/time.Minute, 60)
+	locks  = struct {
+		sync.Mutex
+		m map[string]wopiLock
+	}{m: map[string]wopiLock{}}
+)
+
+/*
+ * wopiToken is what an access token gives access to: a single file, through the backend and with
+ * the permissions of the session it was created from
+ */
+type wopiToken struct {
+	FileId   string
+	Path     string
+	App      *App
+	CanEdit  bool
+	UserId   string
+	Username string
+	Origin   string
+	Expire   time.Time
+}
+
+type wopiLock struct {
+	Value  string
+	Expire time.Time
+}
+
+func fileId(ctx *App, path string) string {
+	return Hash(GenerateID(ctx)+path, 20)
+}
+
+func tokenCreate(ctx *App, path string, canEdit bool, userId string, username string, origin string) (string, *wopiToken) {
+	app := *ctx
+	// the WOPI server calls us long after the request that made the token is gone
+	app.Context = context.Background()
+	t := &wopiToken{
+		FileId:   fileId(ctx, path),
+		Path:     path,
+		App:      &app,
+		CanEdit:  canEdit,
+		UserId:   userId,
+		Username: username,
+		Origin:   origin,
+		Expire:   time.Now().Add(TOKEN_TTL),
+	}
+	accessToken := RandomString(48)
+	tokens.SetKey(accessToken, t)
+	return accessToken, t
+}
+
+// tokenVerify sends back a 401 when the access token isn't one we gave for that file
+func tokenVerify(res http.ResponseWriter, req *http.Request) (*wopiToken, bool) {
+	if v, found := tokens.Cache.Get(req.URL.Query().Get("access_token")); found {
+		if t := v.(*wopiToken); t.FileId == mux.Vars(req)["id"] && time.Now().Before(t.Expire) {
+			return t, true
+		}
+	}
+	Log.Debug("[wopi] invalid access token for '%s'", mux.Vars(req)["id"])
+	res.WriteHeader(http.StatusUnauthorized)
+	return nil, false
+}
+
+func lockGet(id string) string {
+	locks.Lock()
+	defer locks.Unlock()
+	if l, ok := locks.m[id]; ok && time.Now().Before(l.Expire) {
+		return l.Value
+	}
+	delete(locks.m, id)
+	return ""
+}
+
+// lockSwap changes the lock of a file when its current value is one we expect, in one go so 2 clients
+// can't get the same file at the same time
+func lockSwap(id string, expected []string, value string) (string, bool) {
+	locks.Lock()
+	defer locks.Unlock()
+	current := ""
+	if l, ok := locks.m[id]; ok && time.Now().Before(l.Expire) {
+		current = l.Value
+	}
+	for _, e := range expected {
+		if e != current {
+			continue
+		}
+		if value == "" {
+			delete(locks.m, id)
+		} else {
+			locks.m[id] = wopiLock{Value: value, Expire: time.Now().Add(LOCK_DURATION)}
+		}
+		return current, true
+	}
+	return current, false
+}
+
+func stat(ctx *App, path string) (os.FileInfo, error) {
+	root, filename := SplitPath(path)
+	entries, err := ctx.Backend.Ls(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name() == filename {
+			return entry, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func version(f os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", f.ModTime().UnixNano(), f.Size())
+}
+
+func CheckFileInfoHandler(res http.ResponseWriter, req *http.Request) {
+	t, ok := tokenVerify(res, req)
+	if ok == false {
+		return
+	}
+	f, err := stat(t.App, t.Path)
+	if err != nil {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(map[string]interface{}{
+		"BaseFileName":               filepath.Base(t.Path),
+		"Size":                       f.Size(),
+		"Version":                    version(f),
+		"LastModifiedTime":           f.ModTime().UTC().Format(time.RFC3339),
+		"OwnerId":                    Hash(GenerateID(t.App), 20),
+		"UserId":                     t.UserId,
+		"UserFriendlyName":           t.Username,
+		"IsAnonymousUser":            t.App.Share.Id != "",
+		"ReadOnly":                   t.CanEdit == false,
+		"UserCanWrite":               t.CanEdit,
+		"UserCanNotWriteRelative":    t.CanEdit == false,
+		"UserCanRename":              false,
+		"SupportsUpdate":             true,
+		"SupportsLocks":              true,
+		"SupportsGetLock":            true,
+		"SupportsExtendedLockLength": true,
+		"SupportsRename":             false,
+		"PostMessageOrigin":          t.Origin,
+	})
+}
+
+func GetFileHandler(res http.ResponseWriter, req *http.Request) {
+	t, ok := tokenVerify(res, req)
+	if ok == false {
+		return
+	}
+	for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+		if err := auth.Cat(t.App, t.Path); err != nil {
+			Log.Info("[wopi] cat::auth '%s'", err.Error())
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	if f, err := stat(t.App, t.Path); err == nil {
+		res.Header().Set("X-WOPI-ItemVersion", version(f))
+	}
+	file, err := t.App.Backend.Cat(t.Path)
+	if err != nil {
+		Log.Debug("[wopi] cat '%s'", err.Error())
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	res.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(res, file)
+}
+
+func PutFileHandler(res http.ResponseWriter, req *http.Request) {
+	t, ok := tokenVerify(res, req)
+	if ok == false {
+		return
+	} else if req.Header.Get("X-WOPI-Override") != "PUT" {
+		res.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if t.CanEdit == false {
+		res.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// saving a file that isn't locked is what clients without lock support do, we let them
+	if lock := lockGet(t.FileId); lock != "" && lock != req.Header.Get("X-WOPI-Lock") {
+		res.Header().Set("X-WOPI-Lock", lock)
+		res.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err := model.FileSave(t.App, t.Path, req.Body, req.ContentLength, "", ""); err != nil {
+		Log.Debug("[wopi] save '%s'", err.Error())
+		wopiError(res, err)
+		return
+	}
+	if f, err := stat(t.App, t.Path); err == nil {
+		res.Header().Set("X-WOPI-ItemVersion", version(f))
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+func FileOperationHandler(res http.ResponseWriter, req *http.Request) {
+	t, ok := tokenVerify(res, req)
+	if ok == false {
+		return
+	}
+	lock := req.Header.Get("X-WOPI-Lock")
+	conflict := func(current string) {
+		res.Header().Set("X-WOPI-Lock", current)
+		res.WriteHeader(http.StatusConflict)
+	}
+
+	switch req.Header.Get("X-WOPI-Override") {
+	case "LOCK":
+		expected := []string{"", lock}
+		if oldLock := req.Header.Get("X-WOPI-OldLock"); oldLock != "" {
+			// unlock and relock
+			expected = []string{oldLock}
+		}
+		if t.CanEdit == false {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if lock == "" {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		} else if current, ok := lockSwap(t.FileId, expected, lock); ok == false {
+			conflict(current)
+			return
+		}
+		if f, err := stat(t.App, t.Path); err == nil {
+			res.Header().Set("X-WOPI-ItemVersion", version(f))
+		}
+	case "GET_LOCK":
+		res.Header().Set("X-WOPI-Lock", lockGet(t.FileId))
+	case "REFRESH_LOCK":
+		if current, ok := lockSwap(t.FileId, []string{lock}, lock); ok == false || lock == "" {
+			conflict(current)
+			return
+		}
+	case "UNLOCK":
+		if current, ok := lockSwap(t.FileId, []string{lock}, ""); ok == false || lock == "" {
+			conflict(current)
+			return
+		}
+		if f, err := stat(t.App, t.Path); err == nil {
+			res.Header().Set("X-WOPI-ItemVersion", version(f))
+		}
+	case "PUT_RELATIVE":
+		putRelative(t, res, req)
+		return
+	default:
+		res.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+/*
+ * putRelative creates a new file next to the one being edited, it's how "save as" and exports from
+ * the editor work. With a suggested target we find a name that's free, with a relative target the
+ * name is the one given and an existing file is only replaced when asked
+ */
+func putRelative(t *wopiToken, res http.ResponseWriter, req *http.Request) {
+	suggested, relative := req.Header.Get("X-WOPI-SuggestedTarget"), req.Header.Get("X-WOPI-RelativeTarget")
+	if t.CanEdit == false || (suggested == "") == (relative == "") {
+		res.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	root, filename := SplitPath(t.Path)
+	entries, err := t.App.Backend.Ls(root)
+	if err != nil {
+		wopiError(res, err)
+		return
+	}
+	exists := map[string]bool{}
+	for _, entry := range entries {
+		exists[entry.Name()] = true
+	}
+	free := func(name string) string {
+		ext := filepath.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		for i := 1; exists[name]; i++ {
+			name = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+		return name
+	}
+
+	var name string
+	if suggested != "" {
+		name = utf7Decode(suggested)
+		if strings.HasPrefix(name, ".") {
+			name = strings.TrimSuffix(filename, filepath.Ext(filename)) + name
+		}
+		name = free(name)
+	} else {
+		name = utf7Decode(relative)
+		if exists[name] && req.Header.Get("X-WOPI-OverwriteRelativeTarget") != "True" {
+			res.Header().Set("X-WOPI-ValidRelativeTarget", utf7Encode(free(name)))
+			res.WriteHeader(http.StatusConflict)
+			return
+		} else if lock := lockGet(fileId(t.App, root+name)); lock != "" {
+			res.Header().Set("X-WOPI-Lock", lock)
+			res.WriteHeader(http.StatusConflict)
+			return
+		}
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	path := root + name
+	if err = model.FileSave(t.App, path, req.Body, req.ContentLength, "", ""); err != nil {
+		Log.Debug("[wopi] put_relative '%s'", err.Error())
+		wopiError(res, err)
+		return
+	}
+	accessToken, nt := tokenCreate(t.App, path, t.CanEdit, t.UserId, t.Username, t.Origin)
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(map[string]string{
+		"Name": name,
+		"Url":  fmt.Sprintf("%s/wopi/files/%s?access_token=%s", hostUrl(req), nt.FileId, accessToken),
+	})
+}
+
+func wopiError(res http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(AppError); ok {
+		status = e.Status()
+	}
+	if status == http.StatusForbidden || status == http.StatusUnauthorized {
+		status = http.StatusUnauthorized
+	} else if status == http.StatusInsufficientStorage {
+		status = http.StatusRequestEntityTooLarge
+	} else if status == http.StatusPreconditionFailed {
+		status = http.StatusConflict
+	} else if status != http.StatusNotFound && status != http.StatusConflict {
+		status = http.StatusInternalServerError
+	}
+	res.WriteHeader(status)
+}
@@ -0,0 +1,79 @@
+package plg_handler_webhook
+
+import (
+	"encoding/json"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+var (
+	WEBHOOK_ENABLE  func() bool
+	WEBHOOK_TARGETS func() []Target
+	WEBHOOK_RETRY   func() int
+)
+
+/*
+ * Target is a destination for our events, eg:
+ * { "url": "https://ci.example.com/hook", "secret": "xxx", "events": ["file.save"], "paths": ["/incoming/**"] }
+ * An empty list of events or paths matches everything
+ */
+type Target struct {
+	Url    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+	Paths  []string `json:"paths"`
+}
+
+func init() {
+	WEBHOOK_ENABLE = func() bool {
+		return Config.Get("features.webhook.enable").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "enable"
+			f.Type = "enable"
+			f.Target = []string{"webhook_targets", "webhook_retry"}
+			f.Description = "Enable/Disable webhooks sent when files and shared links are changed"
+			f.Placeholder = "Default: false"
+			f.Default = false
+			return f
+		}).Bool()
+	}
+	WEBHOOK_ENABLE()
+	WEBHOOK_TARGETS = func() []Target {
+		targets := []Target{}
+		str := Config.Get("features.webhook.targets").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "webhook_targets"
+			f.Name = "targets"
+			f.Type = "long_text"
+			f.Description = `List of endpoints to notify, in json. eg: [{"url": "https://example.com/hook", "secret": "xxx", "events": ["file.save", "file.mv"], "paths": ["/incoming/**"]}]. Payloads are signed with the secret, see the X-Filestash-Signature header`
+			f.Placeholder = "Default: []"
+			f.Default = "[]"
+			return f
+		}).String()
+		if err := json.Unmarshal([]byte(str), &targets); err != nil {
+			Log.Warning("plg_handler_webhook::config invalid targets '%s'", err.Error())
+			return []Target{}
+		}
+		return targets
+	}
+	WEBHOOK_TARGETS()
+	WEBHOOK_RETRY = func() int {
+		return Config.Get("features.webhook.retry").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "webhook_retry"
+			f.Name = "retry"
+			f.Type = "number"
+			f.Description = "Number of attempts made to deliver an event before giving up. The time between each attempt doubles every time"
+			f.Placeholder = "Default: 5"
+			f.Default = 5
+			return f
+		}).Int()
+	}
+	WEBHOOK_RETRY()
+}
@@ -0,0 +1,219 @@
+package plg_handler_webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	. "github.com/mickael-kerjean/filestash/server/middleware"
+)
+
+const DELIVERY_LOG_SIZE = 500
+
+func init() {
+	Hooks.Register.OnEvent(func(e Event) {
+		if WEBHOOK_ENABLE() == false {
+			return
+		}
+		for _, target := range WEBHOOK_TARGETS() {
+			if target.Url == "" || target.Match(e) == false {
+				continue
+			}
+			go deliver(target, e)
+		}
+	})
+	Hooks.Register.HttpEndpoint(func(r *mux.Router, app *App) error {
+		r.HandleFunc(
+			"/admin/api/webhook",
+			NewMiddlewareChain(deliveryLogHandler, []Middleware{ApiHeaders, AdminOnly, SecureOrigin}, *app),
+		).Methods("GET")
+		return nil
+	})
+}
+
+func deliveryLogHandler(ctx *App, res http.ResponseWriter, req *http.Request) {
+	SendSuccessResults(res, deliveries.List())
+}
+
+func (this Target) Match(e Event) bool {
+	if len(this.Events) > 0 {
+		found := false
+		for _, t := range this.Events {
+			if t == e.Type || t == "*" {
+				found = true
+				break
+			}
+		}
+		if found == false {
+			return false
+		}
+	}
+	if len(this.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range this.Paths {
+		if globMatch(pattern, e.Path) || (e.To != "" && globMatch(pattern, e.To)) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch supports '*' and '?' within a path segment and '**' across segments, eg: /incoming/**/*.pdf
+func globMatch(pattern string, path string) bool {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				expr.WriteString(".*")
+				i++
+				continue
+			}
+			expr.WriteString("[^/]*")
+		case '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	r, err := regexp.Compile(expr.String())
+	if err != nil {
+		return false
+	}
+	return r.MatchString(path)
+}
+
+func deliver(target Target, e Event) {
+	id := QuickString(16)
+	body, err := json.Marshal(struct {
+		Id string `json:"id"`
+		Event
+	}{id, e})
+	if err != nil {
+		Log.Warning("plg_handler_webhook::deliver marshal '%s'", err.Error())
+		return
+	}
+	d := deliveries.Add(Delivery{
+		Id:     id,
+		Url:    target.Url,
+		Event:  e.Type,
+		Path:   e.Path,
+		Status: "pending",
+		Date:   time.Now(),
+	})
+
+	maxAttempts := WEBHOOK_RETRY()
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	backoff := time.Second
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		code, err := send(target, id, e.Type, body)
+		deliveries.Update(d, func(d *Delivery) {
+			d.Attempts = attempt
+			d.StatusCode = code
+			d.Error = ""
+			if err != nil {
+				d.Error = err.Error()
+			}
+		})
+		if err == nil {
+			deliveries.Update(d, func(d *Delivery) { d.Status = "success" })
+			return
+		}
+		Log.Debug("plg_handler_webhook::deliver url[%s] attempt[%d] err[%s]", target.Url, attempt, err.Error())
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	deliveries.Update(d, func(d *Delivery) { d.Status = "failed" })
+	Log.Warning("plg_handler_webhook::deliver giving up url[%s] event[%s] path[%s]", target.Url, e.Type, e.Path)
+}
+
+func send(target Target, id string, eventType string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", target.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", USER_AGENT)
+	req.Header.Set("X-Filestash-Event", eventType)
+	req.Header.Set("X-Filestash-Delivery", id)
+	if target.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(target.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Filestash-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := HTTP.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+/*
+ * The delivery log keeps the last few deliveries in memory so admins can find out
+ * what happened to an event
+ */
+type Delivery struct {
+	Id         string    `json:"id"`
+	Url        string    `json:"url"`
+	Event      string    `json:"event"`
+	Path       string    `json:"path"`
+	Status     string    `json:"status"`
+	StatusCode int       `json:"status_code"`
+	Attempts   int       `json:"attempts"`
+	Error      string    `json:"error,omitempty"`
+	Date       time.Time `json:"date"`
+}
+
+type DeliveryLog struct {
+	mu   sync.Mutex
+	list []*Delivery
+}
+
+var deliveries = &DeliveryLog{list: make([]*Delivery, 0)}
+
+func (this *DeliveryLog) Add(d Delivery) *Delivery {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.list = append(this.list, &d)
+	if len(this.list) > DELIVERY_LOG_SIZE {
+		this.list = this.list[len(this.list)-DELIVERY_LOG_SIZE:]
+	}
+	return &d
+}
+
+func (this *DeliveryLog) Update(d *Delivery, fn func(*Delivery)) {
+	this.mu.Lock()
+	fn(d)
+	this.mu.Unlock()
+}
+
+func (this *DeliveryLog) List() []Delivery {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	list := make([]Delivery, len(this.list))
+	for i := range this.list {
+		list[len(this.list)-1-i] = *this.list[i]
+	}
+	return list
+}
@@ -0,0 +1,32 @@
+package plg_image_resize
+
+import (
+	"runtime"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+var (
+	resize_max_dimension func() int
+	// decoding and scaling an image is CPU and memory heavy
+	resizeSlots = make(chan struct{}, runtime.NumCPU())
+)
+
+func init() {
+	resize_max_dimension = func() int {
+		return Config.Get("features.image.resize_max_dimension").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "resize_max_dimension"
+			f.Name = "resize_max_dimension"
+			f.Type = "number"
+			f.Description = "Largest width or height in pixels of the images resized or converted on the fly through the 'w', 'h', 'fit', 'format' and 'quality' parameters"
+			f.Placeholder = "Default: 4096"
+			f.Default = 4096
+			return f
+		}).Int()
+	}
+	resize_max_dimension()
+	Hooks.Register.ProcessFileContentBeforeSend(image_resize)
+}
@@ -0,0 +1,268 @@
+package plg_image_resize
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/ctrl"
+	"github.com/mickael-kerjean/filestash/server/model"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// decoding takes about 4 bytes per pixel, we don't go beyond what a high end camera produces
+	MAX_INPUT_PIXELS = 100 * 1000 * 1000
+	MAX_INPUT_SIZE   = 200 * 1024 * 1024
+	DEFAULT_QUALITY  = 80
+)
+
+var (
+	ErrImageTooBig = NewError("Image is too big", 413)
+	FORMATS        = map[string]string{"jpeg": "image/jpeg", "png": "image/png", "webp": "image/webp"}
+	DECODABLE      = map[string]bool{
+		"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true,
+		"image/x-ms-bmp": true, "image/tiff": true,
+	}
+)
+
+type resizeOptions struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+}
+
+/*
+ * image_resize gives a version of an image that fits what the client is about to display:
+ *   /api/files/cat?path=/photo.jpg&w=800                       => 800px wide, same ratio
+ *   /api/files/cat?path=/photo.jpg&w=400&h=400&fit=cover      => 400x400 cropped at the center
+ *   /api/files/cat?path=/scan.tiff&format=webp                 => same size, as webp
+ *   /api/files/cat?path=/photo.jpg&w=800&quality=60            => lighter jpeg, webp and png are lossless
+ * Images are turned the way the camera says they should be looked at and never made bigger than
+ * they are. What's generated is kept in the thumbnail cache
+ */
+func image_resize(reader io.ReadCloser, ctx *App, res *http.ResponseWriter, req *http.Request) (io.ReadCloser, error) {
+	query := req.URL.Query()
+	if query.Get("thumbnail") == "true" {
+		return reader, nil
+	} else if query.Get("w") == "" && query.Get("h") == "" && query.Get("format") == "" && query.Get("fit") == "" && query.Get("quality") == "" {
+		return reader, nil
+	}
+	mType := GetMimeType(query.Get("path"))
+	if DECODABLE[mType] == false {
+		return reader, nil
+	}
+	opts, err := resizeParse(query.Get, mType)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	// the size of the output isn't known in advance
+	req.Header.Del("range")
+
+	cacheKey := ""
+	if p, err := ctrl.PathBuilder(ctx, query.Get("path")); err == nil {
+		if key := model.ThumbnailCacheKey(ctx, p); key != "" {
+			cacheKey = Hash(fmt.Sprintf("%s %+v", key, opts), 32)
+		}
+	}
+	(*res).Header().Set("Content-Type", FORMATS[opts.Format])
+	(*res).Header().Set("Cache-Control", "private, max-age=3600")
+	if cacheKey != "" {
+		if f, ok := model.ThumbnailCacheGet(cacheKey); ok {
+			reader.Close()
+			return f, nil
+		}
+	}
+
+	resizeSlots <- struct{}{}
+	out, err := resize(reader, mType, opts)
+	<-resizeSlots
+	reader.Close()
+	if err != nil {
+		Log.Debug("plg_image_resize::resize path[%s] err[%s]", query.Get("path"), err.Error())
+		(*res).Header().Del("Cache-Control")
+		if err == ErrImageTooBig {
+			return nil, err
+		}
+		return nil, ErrNotValid
+	}
+	return model.ThumbnailCachePut(cacheKey, NewReadCloserFromBytes(out), "private, max-age=3600"), nil
+}
+
+func resizeParse(get func(string) string, mType string) (resizeOptions, error) {
+	opts := resizeOptions{Fit: "contain", Format: "png", Quality: DEFAULT_QUALITY}
+	if mType == "image/jpeg" {
+		opts.Format = "jpeg"
+	}
+	for _, p := range []struct {
+		name string
+		dst  *int
+		max  int
+	}{{"w", &opts.Width, 1 << 16}, {"h", &opts.Height, 1 << 16}, {"quality", &opts.Quality, 100}} {
+		if v := get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > p.max {
+				return opts, NewError(fmt.Sprintf("Invalid value for '%s'", p.name), 400)
+			}
+			*p.dst = n
+		}
+	}
+	if v := get("fit"); v == "cover" || v == "contain" {
+		opts.Fit = v
+	} else if v != "" {
+		return opts, NewError("Invalid value for 'fit', expected 'cover' or 'contain'", 400)
+	}
+	if v := get("format"); FORMATS[v] != "" {
+		opts.Format = v
+	} else if v == "jpg" {
+		opts.Format = "jpeg"
+	} else if v != "" {
+		return opts, NewError("Invalid value for 'format', expected 'webp', 'jpeg' or 'png'", 400)
+	}
+	// webp and png are always lossless, a quality would be silently ignored
+	if get("quality") != "" && opts.Format != "jpeg" {
+		return opts, NewError("Invalid value for 'quality', it only applies to jpeg", 400)
+	}
+	if limit := resize_max_dimension(); limit > 0 {
+		opts.Width, opts.Height = min(opts.Width, limit), min(opts.Height, limit)
+	}
+	return opts, nil
+}
+
+func resize(reader io.Reader, mType string, opts resizeOptions) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(reader, MAX_INPUT_SIZE+1))
+	if err != nil {
+		return nil, err
+	} else if len(b) > MAX_INPUT_SIZE {
+		return nil, ErrImageTooBig
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	} else if config.Width*config.Height > MAX_INPUT_PIXELS {
+		return nil, ErrImageTooBig
+	}
+	orientation := 1
+	if extractor, ok := Hooks.Get.MetadataExtractor()[mType]; ok {
+		m := &MediaMetadata{}
+		if extractor(bytes.NewReader(b), m) == nil && m.Orientation >= 1 && m.Orientation <= 8 {
+			orientation = m.Orientation
+		}
+	}
+	src, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	b = nil
+
+	// sizes are computed on the image the way it is displayed, then mapped back onto the pixels
+	// as they are stored
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if orientation >= 5 {
+		sw, sh = sh, sw
+	}
+	crop, dw, dh := resizeTarget(sw, sh, opts, resize_max_dimension())
+	if orientation >= 5 {
+		crop = image.Rect(crop.Min.Y, crop.Min.X, crop.Max.Y, crop.Max.X)
+		dw, dh = dh, dw
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop.Add(src.Bounds().Min), draw.Src, nil)
+	img := orient(dst, orientation)
+
+	var out bytes.Buffer
+	switch opts.Format {
+	case "jpeg":
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: opts.Quality})
+	case "webp":
+		err = encodeWebp(&out, img)
+	default:
+		err = png.Encode(&out, img)
+	}
+	return out.Bytes(), err
+}
+
+/*
+ * resizeTarget gives the part of the source to use and the size it is scaled to. With "contain"
+ * the whole image fits in the box, with "cover" the image fills the box and what overflows is
+ * cropped evenly on both sides
+ */
+func resizeTarget(sw, sh int, opts resizeOptions, maxDimension int) (image.Rectangle, int, int) {
+	w, h := float64(opts.Width), float64(opts.Height)
+	scale := 1.0
+	switch {
+	case opts.Width > 0 && opts.Height > 0 && opts.Fit == "cover":
+		scale = math.Max(w/float64(sw), h/float64(sh))
+	case opts.Width > 0 && opts.Height > 0:
+		scale = math.Min(w/float64(sw), h/float64(sh))
+	case opts.Width > 0:
+		scale = w / float64(sw)
+	case opts.Height > 0:
+		scale = h / float64(sh)
+	}
+	if maxDimension > 0 {
+		scale = math.Min(scale, float64(maxDimension)/float64(max(sw, sh)))
+	}
+	scale = math.Min(scale, 1)
+
+	dw := max(1, int(math.Round(float64(sw)*scale)))
+	dh := max(1, int(math.Round(float64(sh)*scale)))
+	crop := image.Rect(0, 0, sw, sh)
+	if opts.Fit == "cover" && opts.Width > 0 && opts.Height > 0 {
+		dw, dh = min(dw, opts.Width), min(dh, opts.Height)
+		cw := min(sw, int(math.Round(float64(dw)/scale)))
+		ch := min(sh, int(math.Round(float64(dh)/scale)))
+		crop = image.Rect((sw-cw)/2, (sh-ch)/2, (sw-cw)/2+cw, (sh-ch)/2+ch)
+	}
+	return crop, dw, dh
+}
+
+// orient turns an image the way the EXIF orientation tag says it should be displayed
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	dw, dh := dst.Bounds().Dx(), dst.Bounds().Dy()
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // flip horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotate 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // flip vertically
+				sx, sy = x, h-1-y
+			case 5: // transpose
+				sx, sy = y, x
+			case 6: // rotate 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transverse
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotate 90° counter clockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:sy*src.Stride+sx*4+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,25 @@
+package plg_image_resize
+
+import (
+	"testing"
+)
+
+func TestResizeParseQuality(t *testing.T) {
+	for _, tc := range []struct {
+		mType string
+		query map[string]string
+		valid bool
+	}{
+		{"image/jpeg", map[string]string{"quality": "60"}, true},
+		{"image/png", map[string]string{"quality": "60", "format": "jpeg"}, true},
+		{"image/jpeg", map[string]string{"quality": "60", "format": "webp"}, false},
+		{"image/jpeg", map[string]string{"quality": "60", "format": "png"}, false},
+		{"image/png", map[string]string{"quality": "60"}, false},
+		{"image/png", map[string]string{"format": "webp"}, true},
+	} {
+		_, err := resizeParse(func(key string) string { return tc.query[key] }, tc.mType)
+		if (err == nil) != tc.valid {
+			t.Errorf("mType[%s] query[%v] err[%v]", tc.mType, tc.query, err)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package plg_image_resize
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+)
+
+/*
+ * There's no webp encoder in pure Go so we have our own. It produces lossless webp (VP8L), which
+ * is what you can do without having to implement the VP8 codec: the image goes through the
+ * "subtract green" and "predictor" transforms before its pixels are entropy coded. Without the
+ * backward references and color cache a full blown encoder would use, files are bigger than what
+ * libwebp would do but they are valid everywhere webp is supported.
+ * Spec: https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+ */
+func encodeWebp(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width == 0 || height == 0 || width > 1<<14 || height > 1<<14 {
+		return ErrImageTooBig
+	}
+	src := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	pix := src.Pix
+
+	alpha := false
+	for i := 3; i < len(pix); i += 4 {
+		if pix[i] != 0xff {
+			alpha = true
+			break
+		}
+	}
+	// subtract green: red and blue often move with green, what's left is closer to 0
+	for i := 0; i < len(pix); i += 4 {
+		pix[i] -= pix[i+1]
+		pix[i+2] -= pix[i+1]
+	}
+	// predictor: every pixel is replaced by its difference with the average of its left and top
+	// neighbours. The first pixel is predicted by opaque black, the rest of the top row by the
+	// pixel on the left and the rest of the first column by the pixel at the top
+	residuals := make([]byte, len(pix))
+	stride := width * 4
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := y*stride + x*4
+			for c := 0; c < 4; c++ {
+				var predicted byte
+				switch {
+				case x == 0 && y == 0:
+					if c == 3 {
+						predicted = 0xff
+					}
+				case y == 0:
+					predicted = pix[p-4+c]
+				case x == 0:
+					predicted = pix[p-stride+c]
+				default:
+					predicted = byte((uint16(pix[p-4+c]) + uint16(pix[p-stride+c])) / 2)
+				}
+				residuals[p+c] = pix[p+c] - predicted
+			}
+		}
+	}
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3) // version
+
+	bw.write(1, 1) // transform: subtract green
+	bw.write(2, 2)
+	bw.write(1, 1) // transform: predictor
+	bw.write(0, 2)
+	const predictorBits = 9
+	bw.write(predictorBits-2, 3)
+	// the predictor sub image gives the prediction mode for each block of the image, with a single
+	// mode everywhere each prefix code has only 1 symbol and the pixels take no space
+	bw.write(0, 1) // no color cache
+	for _, symbol := range []uint32{7, 0, 0, 0, 0} {
+		bw.writeSimpleCode([]uint32{symbol})
+	}
+	bw.write(0, 1) // no more transform
+
+	bw.write(0, 1) // no color cache
+	bw.write(0, 1) // no meta prefix codes
+	histograms := [4][]int{make([]int, 256+24), make([]int, 256), make([]int, 256), make([]int, 256)}
+	for i := 0; i < len(residuals); i += 4 {
+		histograms[0][residuals[i+1]]++
+		histograms[1][residuals[i]]++
+		histograms[2][residuals[i+2]]++
+		histograms[3][residuals[i+3]]++
+	}
+	codes := [4]prefixCode{}
+	for i := range histograms {
+		codes[i] = bw.writeCode(histograms[i])
+	}
+	bw.writeSimpleCode([]uint32{0}) // distance, unused without backward references
+	for i := 0; i < len(residuals); i += 4 {
+		codes[0].write(bw, int(residuals[i+1]))
+		codes[1].write(bw, int(residuals[i]))
+		codes[2].write(bw, int(residuals[i+2]))
+		codes[3].write(bw, int(residuals[i+3]))
+	}
+	data := bw.bytes()
+
+	var out bytes.Buffer
+	chunk := uint32(len(data))
+	padding := chunk % 2
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, 4+8+chunk+padding)
+	out.WriteString("WEBPVP8L")
+	binary.Write(&out, binary.LittleEndian, chunk)
+	out.Write(data)
+	if padding == 1 {
+		out.WriteByte(0)
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nBits uint
+}
+
+// write puts the n lowest bits of v in the stream, least significant bit first
+func (this *bitWriter) write(v uint32, n uint) {
+	this.acc |= uint64(v&(1<<n-1)) << this.nBits
+	this.nBits += n
+	for this.nBits >= 8 {
+		this.buf = append(this.buf, byte(this.acc))
+		this.acc >>= 8
+		this.nBits -= 8
+	}
+}
+
+func (this *bitWriter) bytes() []byte {
+	if this.nBits > 0 {
+		this.buf = append(this.buf, byte(this.acc))
+		this.acc, this.nBits = 0, 0
+	}
+	return this.buf
+}
+
+// writeSimpleCode writes a prefix code made of 1 or 2 symbols lower than 256
+func (this *bitWriter) writeSimpleCode(symbols []uint32) prefixCode {
+	this.write(1, 1)
+	this.write(uint32(len(symbols)-1), 1)
+	if symbols[0] < 2 {
+		this.write(0, 1)
+		this.write(symbols[0], 1)
+	} else {
+		this.write(1, 1)
+		this.write(symbols[0], 8)
+	}
+	code := prefixCode{lengths: make([]uint8, 256), codes: make([]uint16, 256)}
+	if len(symbols) == 2 {
+		this.write(symbols[1], 8)
+		code.lengths[symbols[0]], code.lengths[symbols[1]] = 1, 1
+		code.codes[symbols[1]] = 1
+	}
+	return code
+}
+
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// writeCode writes the prefix code that fits a histogram of symbols and gives it back
+func (this *bitWriter) writeCode(histogram []int) prefixCode {
+	used := []uint32{}
+	for symbol, n := range histogram {
+		if n > 0 {
+			used = append(used, uint32(symbol))
+		}
+	}
+	if len(used) == 0 {
+		return this.writeSimpleCode([]uint32{0})
+	} else if len(used) <= 2 && used[len(used)-1] < 256 {
+		return this.writeSimpleCode(used)
+	}
+
+	lengths := huffmanLengths(histogram, 15)
+	// code lengths are themselves prefix coded
+	clHistogram := make([]int, 19)
+	for _, l := range lengths {
+		clHistogram[l]++
+	}
+	clLengths := huffmanLengths(clHistogram, 7)
+	clCode := newPrefixCode(clLengths)
+	n := 4
+	for i := range codeLengthCodeOrder {
+		if clLengths[codeLengthCodeOrder[i]] > 0 {
+			n = max(n, i+1)
+		}
+	}
+	this.write(0, 1)
+	this.write(uint32(n-4), 4)
+	for i := 0; i < n; i++ {
+		this.write(uint32(clLengths[codeLengthCodeOrder[i]]), 3)
+	}
+	this.write(0, 1) // every symbol of the alphabet has a code length
+	for _, l := range lengths {
+		clCode.write(this, int(l))
+	}
+	return newPrefixCode(lengths)
+}
+
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint16 // bits are reversed as codes are read from their most significant bit
+}
+
+// newPrefixCode assigns the canonical codes, when there's a single symbol it takes no space
+func newPrefixCode(lengths []uint8) prefixCode {
+	code := prefixCode{lengths: make([]uint8, len(lengths)), codes: make([]uint16, len(lengths))}
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	if used <= 1 {
+		return code
+	}
+	count := [16]uint16{}
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	next := [16]uint16{}
+	for l, c := 1, uint16(0); l < 16; l++ {
+		c = (c + count[l-1]) << 1
+		next[l] = c
+	}
+	for symbol, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		var reversed uint16
+		for i := uint8(0); i < l; i++ {
+			reversed = reversed<<1 | (c>>i)&1
+		}
+		code.lengths[symbol], code.codes[symbol] = l, reversed
+	}
+	return code
+}
+
+func (this prefixCode) write(bw *bitWriter, symbol int) {
+	bw.write(uint32(this.codes[symbol]), uint(this.lengths[symbol]))
+}
+
+/*
+ * huffmanLengths gives the length of the code of each symbol, none of them longer than maxLength.
+ * When the tree is too deep the rare symbols are made more frequent until it fits
+ */
+func huffmanLengths(histogram []int, maxLength uint8) []uint8 {
+	freq := make([]int, len(histogram))
+	copy(freq, histogram)
+	for {
+		lengths := make([]uint8, len(freq))
+		h := &huffmanHeap{}
+		for symbol, f := range freq {
+			if f > 0 {
+				*h = append(*h, &huffmanNode{freq: f, symbols: []int{symbol}})
+			}
+		}
+		if len(*h) == 1 {
+			lengths[(*h)[0].symbols[0]] = 1
+			return lengths
+		}
+		heap.Init(h)
+		for h.Len() > 1 {
+			a, b := heap.Pop(h).(*huffmanNode), heap.Pop(h).(*huffmanNode)
+			for _, s := range a.symbols {
+				lengths[s]++
+			}
+			for _, s := range b.symbols {
+				lengths[s]++
+			}
+			symbols := make([]int, 0, len(a.symbols)+len(b.symbols))
+			heap.Push(h, &huffmanNode{freq: a.freq + b.freq, symbols: append(append(symbols, a.symbols...), b.symbols...)})
+		}
+		deepest := uint8(0)
+		for _, l := range lengths {
+			deepest = max(deepest, l)
+		}
+		if deepest <= maxLength {
+			return lengths
+		}
+		for i := range freq {
+			if freq[i] > 0 {
+				freq[i] = freq[i]/2 + 1
+			}
+		}
+	}
+}
+
+type huffmanNode struct {
+	freq    int
+	symbols []int
+}
+
+type huffmanHeap []*huffmanNode
+
+func (this huffmanHeap) Len() int { return len(this) }
+func (this huffmanHeap) Less(i, j int) bool {
+	if this[i].freq == this[j].freq {
+		return len(this[i].symbols) < len(this[j].symbols)
+	}
+	return this[i].freq < this[j].freq
+}
+func (this huffmanHeap) Swap(i, j int)       { this[i], this[j] = this[j], this[i] }
+func (this *huffmanHeap) Push(x interface{}) { *this = append(*this, x.(*huffmanNode)) }
+func (this *huffmanHeap) Pop() interface{} {
+	old := *this
+	n := old[len(old)-1]
+	*this = old[:len(old)-1]
+	return n
+}
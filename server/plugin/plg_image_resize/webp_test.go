@@ -0,0 +1,67 @@
+package plg_image_resize
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// what we encode must come back pixel for pixel through a decoder we didn't write
+func TestEncodeWebpRoundTrip(t *testing.T) {
+	for _, size := range [][2]int{{1, 1}, {2, 1}, {1, 7}, {3, 5}, {17, 9}, {64, 33}, {255, 3}} {
+		for _, alpha := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%dx%d alpha=%t", size[0], size[1], alpha), func(t *testing.T) {
+				src := webpFixture(size[0], size[1], alpha)
+				var out bytes.Buffer
+				if err := encodeWebp(&out, src); err != nil {
+					t.Fatalf("encode: %s", err.Error())
+				}
+				img, err := webp.Decode(bytes.NewReader(out.Bytes()))
+				if err != nil {
+					t.Fatalf("decode: %s", err.Error())
+				} else if img.Bounds().Dx() != size[0] || img.Bounds().Dy() != size[1] {
+					t.Fatalf("unexpected size: %v", img.Bounds())
+				}
+				for y := 0; y < size[1]; y++ {
+					for x := 0; x < size[0]; x++ {
+						want := src.NRGBAAt(x, y)
+						got := color.NRGBAModel.Convert(img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y)).(color.NRGBA)
+						if got != want {
+							t.Fatalf("pixel (%d,%d): got %v, want %v", x, y, got, want)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestEncodeWebpEmpty(t *testing.T) {
+	if err := encodeWebp(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, 0, 4))); err == nil {
+		t.Fatal("expected an error for an empty image")
+	}
+}
+
+// a gradient for the predictors to work with and some noise so not everything is predictable
+func webpFixture(w int, h int, alpha bool) *image.NRGBA {
+	r := rand.New(rand.NewSource(int64(w*1000 + h)))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{uint8(x * 7), uint8(y * 13), uint8(x + y), 0xff}
+			if r.Intn(4) == 0 {
+				c.R, c.G, c.B = uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256))
+			}
+			if alpha {
+				c.A = uint8(r.Intn(256))
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
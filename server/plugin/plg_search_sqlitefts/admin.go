@@ -0,0 +1,219 @@
+package plg_search_sqlitefts
+
+import (
+	"container/heap"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	. "github.com/mickael-kerjean/filestash/server/middleware"
+)
+
+/*
+ * The admin api gives visibility over what the indexers are doing:
+ * - GET    /admin/api/search                  => list indexers, loaded in memory or only on disk
+ * - POST   /admin/api/search/{id}/pause       => stop crawling
+ * - POST   /admin/api/search/{id}/resume      => restart crawling
+ * - POST   /admin/api/search/{id}/reindex     => force a path to be crawled again, eg: ?path=/documents/
+ * - DELETE /admin/api/search/{id}             => drop the index
+ */
+func init() {
+	Hooks.Register.HttpEndpoint(func(r *mux.Router, app *App) error {
+		middlewares := []Middleware{ApiHeaders, AdminOnly, SecureOrigin}
+		r.HandleFunc("/admin/api/search", NewMiddlewareChain(adminIndexerList, middlewares, *app)).Methods("GET")
+		r.HandleFunc("/admin/api/search/{id}/{action}", NewMiddlewareChain(adminIndexerAction, middlewares, *app)).Methods("POST")
+		r.HandleFunc("/admin/api/search/{id}", NewMiddlewareChain(adminIndexerDelete, middlewares, *app)).Methods("DELETE")
+		return nil
+	})
+}
+
+type IndexerStatus struct {
+	Id           string     `json:"id"`
+	Backend      string     `json:"backend"`
+	Loaded       bool       `json:"loaded"`
+	Phase        string     `json:"phase"`
+	Paused       bool       `json:"paused"`
+	Files        int        `json:"files"`
+	FilesIndexed int        `json:"files_indexed"`
+	QueueSize    int        `json:"queue_size"`
+	DBSize       int64      `json:"db_size"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastIndexed  *time.Time `json:"last_indexed,omitempty"`
+}
+
+func adminIndexerList(ctx *App, res http.ResponseWriter, req *http.Request) {
+	list := []IndexerStatus{}
+	seen := map[string]bool{}
+
+	// the status of an indexer waits for its current cycle, the pool isn't kept locked meanwhile
+	SProc.mu.RLock()
+	loaded := append([]*SearchIndexer{}, SProc.idx...)
+	SProc.mu.RUnlock()
+	for _, s := range loaded {
+		list = append(list, s.Status())
+		seen[s.Id] = true
+	}
+
+	// indexes that were created before but aren't currently used by anyone
+	entries, err := os.ReadDir(GetAbsolutePath(FTS_PATH))
+	if err != nil {
+		Log.Warning("search::admin list '%s'", err.Error())
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "fts_") == false || strings.HasSuffix(name, ".sql") == false {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(name, "fts_"), ".sql")
+		if seen[id] {
+			continue
+		}
+		list = append(list, IndexerStatus{
+			Id:     id,
+			DBSize: dbSize(GetAbsolutePath(FTS_PATH, name)),
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Loaded && list[j].Loaded == false
+	})
+	SendSuccessResults(res, list)
+}
+
+func adminIndexerAction(ctx *App, res http.ResponseWriter, req *http.Request) {
+	s := SProc.Find(mux.Vars(req)["id"])
+	if s == nil {
+		SendErrorResult(res, NewError("The index isn't currently loaded", 404))
+		return
+	}
+	switch mux.Vars(req)["action"] {
+	case "pause":
+		s.mu.Lock()
+		s.Paused = true
+		s.mu.Unlock()
+	case "resume":
+		s.mu.Lock()
+		s.Paused = false
+		s.mu.Unlock()
+	case "reindex":
+		path := req.URL.Query().Get("path")
+		if path == "" {
+			path = "/"
+		}
+		path = strings.TrimSuffix(filepath.ToSlash(filepath.Join("/", path)), "/") + "/"
+		if err := s.Reindex(path); err != nil {
+			Log.Warning("search::admin reindex '%s'", err.Error())
+			SendErrorResult(res, err)
+			return
+		}
+	default:
+		SendErrorResult(res, ErrNotFound)
+		return
+	}
+	SendSuccessResult(res, s.Status())
+}
+
+func adminIndexerDelete(ctx *App, res http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if id == "" || filepath.Base(id) != id {
+		SendErrorResult(res, NewError("Invalid index", 400))
+		return
+	}
+	if err := SProc.Delete(id); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
+
+// Status gives a snapshot of the indexer. The state is read in between 2 cycles of the spider,
+// the counters come from the database and don't need to wait
+func (this *SearchIndexer) Status() IndexerStatus {
+	this.mu.Lock()
+	st := IndexerStatus{
+		Id:        this.Id,
+		Backend:   this.BackendType,
+		Loaded:    true,
+		Phase:     this.CurrentPhase,
+		Paused:    this.Paused,
+		QueueSize: this.FoldersUnknown.Len(),
+		DBSize:    dbSize(this.DBPath),
+		LastError: this.LastError,
+	}
+	db := this.DB
+	this.mu.Unlock()
+	if db == nil {
+		return st
+	}
+	var lastIndexed string
+	if err := db.QueryRow(
+		"SELECT count(*), count(indexTime), coalesce(max(indexTime), '') FROM file WHERE type = 'file'",
+	).Scan(&st.Files, &st.FilesIndexed, &lastIndexed); err != nil {
+		Log.Debug("search::admin status '%s'", err.Error())
+	}
+	// aggregates lose the column type, we get back the time as sqlite stores it
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999-07:00", time.RFC3339} {
+		if t, err := time.Parse(layout, lastIndexed); err == nil {
+			st.LastIndexed = &t
+			break
+		}
+	}
+	return st
+}
+
+/*
+ * Reindex makes the indexer forget what it knows about a path: files get their content extracted
+ * again and folders are considered stale so the discovery phase goes through them once more
+ */
+func (this *SearchIndexer) Reindex(path string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.DB == nil {
+		return ErrNotReachable
+	}
+	tx, err := this.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(
+		"UPDATE file SET indexTime = NULL WHERE type = 'file' AND path >= ? AND path < ?",
+		path, path+"~",
+	); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec(
+		"UPDATE file SET indexTime = ? WHERE type = 'directory' AND path >= ? AND path < ?",
+		time.Unix(0, 0), path, path+"~",
+	); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	heap.Push(&this.FoldersUnknown, &Document{
+		Type:        "directory",
+		Path:        path,
+		InitialPath: path,
+		Name:        filepath.Base(path),
+		Priority:    -1,
+	})
+	this.CurrentPhase = PHASE_EXPLORE
+	this.LastError = ""
+	return nil
+}
+
+func dbSize(path string) int64 {
+	var size int64 = 0
+	for _, suffix := range []string{"", "-wal"} {
+		if f, err := os.Stat(path + suffix); err == nil {
+			size += f.Size()
+		}
+	}
+	return size
+}
@@ -30,10 +30,11 @@ func init() {
 			f.Target = []string{
 				"process_max", "process_par", "reindex_time",
 				"cycle_time", "max_size", "indexer_ext",
+				"extractor_max_size", "extractor_timeout",
 			}
 			f.Description = "Enable/Disable full text search"
-			f.Placeholder = "Default: false"
-			f.Default = false
+			f.Placeholder = "Default: true"
+			f.Default = true
 			return f
 		}).Bool()
 	}
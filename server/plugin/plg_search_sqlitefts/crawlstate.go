@@ -3,17 +3,19 @@ package plg_search_sqlitefts
 import (
 	"container/heap"
 	. "github.com/mickael-kerjean/filestash/server/common"
+	"os"
 	"path/filepath"
 	"sync"
 )
 
 var SProc SearchProcess = SearchProcess{
-	idx: make([]SearchIndexer, 0),
+	idx: make([]*SearchIndexer, 0),
 	n:   -1,
 }
 
+// indexers are shared by pointer, the spider and the admin can hold on to one while the pool changes
 type SearchProcess struct {
-	idx []SearchIndexer
+	idx []*SearchIndexer
 	n   int
 	mu  sync.RWMutex
 }
@@ -40,7 +42,7 @@ func (this *SearchProcess) HintLs(app *App, path string) *SearchIndexer {
 					Name:        filepath.Base(path),
 				})
 			}
-			ret := &this.idx[i]
+			ret := this.idx[i]
 			this.mu.RUnlock()
 			return ret
 		}
@@ -60,39 +62,73 @@ func (this *SearchProcess) HintLs(app *App, path string) *SearchIndexer {
 	}
 	// instantiate the new indexer
 	s := NewSearchIndexer(id, app.Backend)
+	s.BackendType = app.Session["type"]
 	heap.Push(&s.FoldersUnknown, &Document{
 		Type:        "directory",
 		Path:        path,
 		InitialPath: path,
 		Name:        filepath.Base(path),
 	})
-	this.idx = append(this.idx, s)
+	this.idx = append(this.idx, &s)
 	this.mu.Unlock()
 	return &s
 }
 
-func (this *SearchProcess) HintRm(app *App, path string) {
+// Get gives the indexer attached to the current session if it was already created
+func (this *SearchProcess) Get(app *App) *SearchIndexer {
 	id := GenerateID(app)
 	this.mu.RLock()
+	defer this.mu.RUnlock()
 	for i := len(this.idx) - 1; i >= 0; i-- {
 		if id == this.idx[i].Id {
-			this.idx[i].DB.Exec("DELETE FROM file WHERE path >= ? AND path < ?", path, path+"~")
-			break
+			return this.idx[i]
 		}
 	}
-	this.mu.RUnlock()
+	return nil
 }
 
-func (this *SearchProcess) HintFile(app *App, path string) {
-	id := GenerateID(app)
+// Find gives the indexer with the given id among the ones currently loaded in the pool
+func (this *SearchProcess) Find(id string) *SearchIndexer {
 	this.mu.RLock()
-	for i := len(this.idx) - 1; i >= 0; i-- {
-		if id == this.idx[i].Id {
-			this.idx[i].DB.Exec("UPDATE file set indexTime = NULL WHERE path = ?", path)
-			break
+	defer this.mu.RUnlock()
+	for i := range this.idx {
+		if this.idx[i].Id == id {
+			return this.idx[i]
 		}
 	}
-	this.mu.RUnlock()
+	return nil
+}
+
+// Delete takes an indexer out of the pool and removes its database
+func (this *SearchProcess) Delete(id string) error {
+	this.mu.Lock()
+	for i := range this.idx {
+		if this.idx[i].Id != id {
+			continue
+		}
+		this.idx[i].mu.Lock()
+		if this.idx[i].DB != nil {
+			this.idx[i].DB.Close()
+		}
+		this.idx[i].mu.Unlock()
+		idx := make([]*SearchIndexer, 0, len(this.idx)-1)
+		idx = append(idx, this.idx[:i]...)
+		this.idx = append(idx, this.idx[i+1:]...)
+		this.n = -1
+		break
+	}
+	this.mu.Unlock()
+
+	dbPath := GetAbsolutePath(FTS_PATH, "fts_"+id+".sql")
+	if _, err := os.Stat(dbPath); err != nil {
+		return ErrNotFound
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+	}
+	return nil
 }
 
 func (this *SearchProcess) Peek() *SearchIndexer {
@@ -105,7 +141,7 @@ func (this *SearchProcess) Peek() *SearchIndexer {
 	} else {
 		this.n = this.n + 1
 	}
-	s := &this.idx[this.n]
+	s := this.idx[this.n]
 	this.mu.Unlock()
 	return s
 }
@@ -115,7 +151,7 @@ func (this *SearchProcess) Reset() {
 	for i := range this.idx {
 		this.idx[i].DB.Close()
 	}
-	this.idx = make([]SearchIndexer, 0)
+	this.idx = make([]*SearchIndexer, 0)
 	this.mu.Unlock()
 	this.n = -1
 }
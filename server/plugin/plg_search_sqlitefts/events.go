@@ -0,0 +1,166 @@
+package plg_search_sqlitefts
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+/*
+ * Changes made through filestash are applied to the index as they happen instead of waiting for
+ * the crawler to come across them. We only care about indexers that already exist, the others
+ * will see those changes when they explore the storage for the first time
+ */
+func onEvent(e Event) {
+	if SEARCH_ENABLE() == false || e.App == nil || e.App.Session["type"] == "" {
+		return
+	}
+	s := SProc.Get(e.App)
+	if s == nil {
+		return
+	}
+	// the index is made of the paths on the storage, not the ones the user sees
+	path, to := e.StoragePath(e.Path), e.StoragePath(e.To)
+
+	// the storage is looked at before taking the lock, the spider and the other events don't
+	// have to wait on a slow backend or a big document
+	var f *eventFile
+	if e.Type == EVENT_FILE_SAVE || e.Type == EVENT_FILE_TOUCH || e.Type == EVENT_FILE_MKDIR {
+		var err error
+		if f, err = s.eventFetch(path); err != nil {
+			Log.Debug("search::event type[%s] path[%s] err[%v]", e.Type, path, err)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.DB == nil {
+		return
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		Log.Warning("search::event begin (%v)", err)
+		return
+	}
+	switch e.Type {
+	case EVENT_FILE_SAVE, EVENT_FILE_TOUCH, EVENT_FILE_MKDIR:
+		err = s.eventUpsert(f, tx)
+	case EVENT_FILE_RM:
+		where, args := pathMatch(path)
+		_, err = tx.Exec("DELETE FROM file WHERE "+where, args...)
+	case EVENT_FILE_MV:
+		err = s.eventMv(path, to, tx)
+	default:
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		Log.Debug("search::event type[%s] path[%s] err[%v]", e.Type, path, err)
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		Log.Warning("search::event commit (%v)", err)
+	}
+}
+
+// eventFile is what we know about a file that changed before writing it in the index
+type eventFile struct {
+	path       string
+	parent     string
+	info       os.FileInfo
+	indexed    bool
+	content    []byte
+	contentErr error
+}
+
+func (this *SearchIndexer) eventFetch(path string) (*eventFile, error) {
+	f := &eventFile{path: path, parent: parentPath(path)}
+	files, err := this.Backend.Ls(f.parent)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		if files[i].Name() == filepath.Base(path) {
+			f.info = files[i]
+			break
+		}
+	}
+	if f.info == nil {
+		return nil, ErrNotFound
+	}
+	if f.info.IsDir() || f.info.Size() > int64(MAX_INDEXING_FSIZE()) {
+		return f, nil
+	}
+	for _, ext := range strings.Split(INDEXING_EXT(), ",") {
+		if strings.TrimSpace(ext) == strings.TrimPrefix(filepath.Ext(path), ".") {
+			f.indexed = true
+			f.content, f.contentErr = this.fileContent(path)
+			break
+		}
+	}
+	return f, nil
+}
+
+func (this *SearchIndexer) eventUpsert(f *eventFile, tx *sql.Tx) error {
+	if err := this.dbInsert(f.parent, f.info, tx); err != nil {
+		if isConstraintError(err) == false {
+			return err
+		} else if err = this.dbUpdate(f.parent, f.info, tx); err != nil {
+			return err
+		}
+	}
+	if f.indexed == false {
+		return nil
+	}
+	return this.updateFileContent(f.path, f.content, f.contentErr, tx)
+}
+
+func (this *SearchIndexer) eventMv(from string, to string, tx *sql.Tx) error {
+	where, args := pathMatch(to)
+	if _, err := tx.Exec("DELETE FROM file WHERE "+where, args...); err != nil {
+		return err
+	}
+	if strings.HasSuffix(from, "/") {
+		// rewrite the path of everything that was living under the renamed folder
+		offset := utf8.RuneCountInString(from) + 1
+		if _, err := tx.Exec(
+			"UPDATE file SET path = ? || substr(path, ?), parent = ? || substr(parent, ?) "+
+				"WHERE substr(path, 1, length(?)) = ? AND path != ?",
+			to, offset, to, offset, from, from, from,
+		); err != nil {
+			return err
+		}
+	}
+	name := filepath.Base(to)
+	_, err := tx.Exec(
+		"UPDATE file SET path = ?, parent = ?, filename = ?, filetype = ? WHERE path = ?",
+		to, parentPath(to), name, func() interface{} {
+			if strings.HasSuffix(to, "/") {
+				return nil
+			}
+			return strings.TrimPrefix(filepath.Ext(name), ".")
+		}(), from,
+	)
+	return err
+}
+
+/*
+ * pathMatch selects a file or a folder with everything it contains. Comparing prefixes instead of a
+ * range of path keeps the siblings out, eg: removing "/a/b.txt" mustn't take "/a/b.txt.bak" with it
+ */
+func pathMatch(path string) (string, []interface{}) {
+	if strings.HasSuffix(path, "/") == false {
+		return "path = ?", []interface{}{path}
+	}
+	return "(path = ? OR substr(path, 1, length(?)) = ?)", []interface{}{path, path, path}
+}
+
+func parentPath(path string) string {
+	return strings.TrimSuffix(filepath.Dir(strings.TrimSuffix(path, "/")), "/") + "/"
+}
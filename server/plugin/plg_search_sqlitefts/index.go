@@ -1,9 +1,10 @@
 package plg_search_sqlitefts
 
 import (
+	"database/sql"
 	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/plugin/plg_search_stateless"
 	"path/filepath"
-	"regexp"
 	"time"
 )
 
@@ -16,15 +17,24 @@ const (
 
 func init() {
 	sh := SearchHint{}
-	Hooks.Register.SearchEngine(SqliteSearch{Hint: &sh})
+	Hooks.Register.SearchEngine(SqliteSearch{Hint: &sh, Fallback: plg_search_stateless.StatelessSearch{}})
 	Hooks.Register.AuthorisationMiddleware(&sh)
+	Hooks.Register.OnEvent(onEvent)
 }
 
+/*
+ * The full text search relies on a pure go build of sqlite so it's available in every build. When
+ * an admin turns it off, we go back to the stateless search which only looks at filenames
+ */
 type SqliteSearch struct {
-	Hint *SearchHint
+	Hint     *SearchHint
+	Fallback ISearch
 }
 
 func (this SqliteSearch) Query(app App, path string, keyword string) ([]IFile, error) {
+	if SEARCH_ENABLE() == false {
+		return this.Fallback.Query(app, path, keyword)
+	}
 	files := []IFile{}
 
 	// extract our search indexer
@@ -36,15 +46,35 @@ func (this SqliteSearch) Query(app App, path string, keyword string) ([]IFile, e
 	if path == "" {
 		path = "/"
 	}
+	query, err := NewSearchQuery(&app, keyword)
+	if err != nil {
+		return files, err
+	}
 
-	rows, err := s.DB.Query(
-		"SELECT type, path, size, modTime FROM file WHERE path IN ("+
-			"   SELECT path FROM file_index WHERE file_index MATCH ? AND path > ? AND path < ?"+
-			"   ORDER BY rank LIMIT 2000"+
-			")",
-		regexp.MustCompile(`(\.|\-)`).ReplaceAllString(keyword, "\"$1\""),
-		path, path+"~",
-	)
+	where, args, match := searchQueryToSQL(query)
+	if where == "" {
+		where = "1"
+	}
+	var rows *sql.Rows
+	if match != "" {
+		rows, err = s.DB.Query(
+			"SELECT f.type, f.path, f.size, f.modTime, r.snippet FROM file f "+
+				"JOIN ("+
+				"   SELECT path, rank, snippet(file_index, -1, char(2), char(3), '...', 24) AS snippet "+
+				"   FROM file_index WHERE file_index MATCH ?"+
+				") r ON r.path = f.path "+
+				"WHERE f.path > ? AND f.path < ? AND "+where+" "+
+				"ORDER BY r.rank LIMIT 2000",
+			append([]interface{}{match, path, path + "~"}, args...)...,
+		)
+	} else {
+		rows, err = s.DB.Query(
+			"SELECT f.type, f.path, f.size, f.modTime, '' FROM file f "+
+				"WHERE f.path > ? AND f.path < ? AND "+where+" "+
+				"ORDER BY f.modTime DESC LIMIT 2000",
+			append([]interface{}{path, path + "~"}, args...)...,
+		)
+	}
 	if err != nil {
 		Log.Warning("search::query DBQuery (%s)", err.Error())
 		return files, ErrNotReachable
@@ -53,7 +83,8 @@ func (this SqliteSearch) Query(app App, path string, keyword string) ([]IFile, e
 	for rows.Next() {
 		f := File{}
 		var t string
-		if err = rows.Scan(&f.FType, &f.FPath, &f.FSize, &t); err != nil {
+		var snippet sql.NullString
+		if err = rows.Scan(&f.FType, &f.FPath, &f.FSize, &t, &snippet); err != nil {
 			Log.Warning("search::query scan (%s)", err.Error())
 			return files, ErrNotReachable
 		}
@@ -61,6 +92,7 @@ func (this SqliteSearch) Query(app App, path string, keyword string) ([]IFile, e
 			f.FTime = tm.Unix() * 1000
 		}
 		f.FName = filepath.Base(f.FPath)
+		f.Snippet, f.Matches = parseSnippet(snippet.String)
 		files = append(files, f)
 	}
 	return files, nil
@@ -68,46 +100,44 @@ func (this SqliteSearch) Query(app App, path string, keyword string) ([]IFile, e
 
 /*
  * We're listening to what the user is doing to hint the crawler over
- * what needs to be updated in priority, what file got updated and would need
- * to be reindexed, what should disappear from the index, ....
- * This way we can fine tune how full text search is behaving
+ * what needs to be updated in priority. Changes made to the storage are not
+ * handled here but once they're completed, see onEvent
  */
 
 type SearchHint struct{}
 
 func (this SearchHint) Ls(ctx *App, path string) error {
+	if SEARCH_ENABLE() == false {
+		return nil
+	}
 	go SProc.HintLs(ctx, path)
 	return nil
 }
 
 func (this SearchHint) Cat(ctx *App, path string) error {
+	if SEARCH_ENABLE() == false {
+		return nil
+	}
 	go SProc.HintLs(ctx, filepath.Dir(path)+"/")
 	return nil
 }
 
 func (this SearchHint) Mkdir(ctx *App, path string) error {
-	go SProc.HintLs(ctx, filepath.Dir(path)+"/")
 	return nil
 }
 
 func (this SearchHint) Rm(ctx *App, path string) error {
-	go SProc.HintRm(ctx, path)
 	return nil
 }
 
 func (this SearchHint) Mv(ctx *App, from string, to string) error {
-	go SProc.HintRm(ctx, filepath.Dir(from)+"/")
-	go SProc.HintLs(ctx, filepath.Dir(to)+"/")
 	return nil
 }
 
 func (this SearchHint) Save(ctx *App, path string) error {
-	go SProc.HintLs(ctx, filepath.Dir(path)+"/")
-	go SProc.HintFile(ctx, path)
 	return nil
 }
 
 func (this SearchHint) Touch(ctx *App, path string) error {
-	go SProc.HintLs(ctx, filepath.Dir(path)+"/")
 	return nil
 }
@@ -0,0 +1,129 @@
+package plg_search_sqlitefts
+
+import (
+	"strings"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+/*
+ * searchQueryToSQL translates a parsed search query into a condition on the file table (aliased
+ * as f). The free text terms found at the top level are given back separately as a fts5
+ * expression so the caller can join on the full text index and sort results by relevance
+ */
+func searchQueryToSQL(q *SearchQuery) (where string, args []interface{}, match string) {
+	nodes := []*SearchQuery{q}
+	if q.Op == SEARCH_OP_AND {
+		nodes = q.Children
+	}
+	matches := []string{}
+	conditions := []string{}
+	for _, n := range nodes {
+		if n.Op == SEARCH_OP_TERM && n.Field == "" {
+			matches = append(matches, ftsEscape(n.Value))
+			continue
+		}
+		cond, a := searchNodeToSQL(n)
+		conditions = append(conditions, cond)
+		args = append(args, a...)
+	}
+	return strings.Join(conditions, " AND "), args, strings.Join(matches, " AND ")
+}
+
+func searchNodeToSQL(n *SearchQuery) (string, []interface{}) {
+	switch n.Op {
+	case SEARCH_OP_AND, SEARCH_OP_OR:
+		if len(n.Children) == 0 {
+			return "1", nil
+		}
+		conditions := []string{}
+		args := []interface{}{}
+		for _, c := range n.Children {
+			cond, a := searchNodeToSQL(c)
+			conditions = append(conditions, cond)
+			args = append(args, a...)
+		}
+		return "(" + strings.Join(conditions, " "+strings.ToUpper(n.Op)+" ") + ")", args
+	case SEARCH_OP_NOT:
+		cond, args := searchNodeToSQL(n.Children[0])
+		return "NOT " + cond, args
+	}
+
+	switch n.Field {
+	case "":
+		return "f.path IN (SELECT path FROM file_index WHERE file_index MATCH ?)", []interface{}{ftsEscape(n.Value)}
+	case "type":
+		if n.Value == "directory" || n.Value == "folder" {
+			return "f.type = 'directory'", nil
+		} else if n.Value == "file" {
+			return "f.type = 'file'", nil
+		}
+		return "(f.type = 'file' AND lower(f.filetype) = ?)", []interface{}{n.Value}
+	case "name":
+		if n.Exact {
+			return "lower(f.filename) = lower(?)", []interface{}{n.Value}
+		}
+		r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+		return `f.filename LIKE ? ESCAPE '\'`, []interface{}{"%" + r.Replace(n.Value) + "%"}
+	case "path":
+		return "(f.path >= ? AND f.path < ?)", []interface{}{n.Value, n.Value + "~"}
+	case "size":
+		cmp := n.Cmp
+		if cmp == ":" {
+			cmp = "="
+		}
+		return "f.size " + cmp + " ?", []interface{}{n.Size}
+	case "modified":
+		switch n.Cmp {
+		case ">":
+			return "f.modTime >= ?", []interface{}{n.To}
+		case ">=":
+			return "f.modTime >= ?", []interface{}{n.From}
+		case "<":
+			return "f.modTime < ?", []interface{}{n.From}
+		case "<=":
+			return "f.modTime < ?", []interface{}{n.To}
+		}
+		return "(f.modTime >= ? AND f.modTime < ?)", []interface{}{n.From, n.To}
+	}
+	return "0", nil
+}
+
+// ftsEscape makes a term safe to use in a fts5 expression, keeping the ability to search on prefix
+func ftsEscape(term string) string {
+	prefix := ""
+	if strings.HasSuffix(term, "*") {
+		term = strings.TrimSuffix(term, "*")
+		prefix = "*"
+	}
+	return `"` + strings.ReplaceAll(term, `"`, `""`) + `"` + prefix
+}
+
+// parseSnippet removes the markers fts5 puts around the matching terms of a snippet and
+// gives back where those were, in characters
+func parseSnippet(str string) (string, [][]int) {
+	if str == "" {
+		return "", nil
+	}
+	var out strings.Builder
+	matches := [][]int{}
+	i, start := 0, -1
+	for _, r := range str {
+		switch r {
+		case '\x02':
+			start = i
+		case '\x03':
+			if start >= 0 {
+				matches = append(matches, []int{start, i})
+				start = -1
+			}
+		default:
+			out.WriteRune(r)
+			i++
+		}
+	}
+	if strings.TrimSpace(out.String()) == "" {
+		return "", nil
+	}
+	return out.String(), matches
+}
@@ -4,7 +4,6 @@ import (
 	"container/heap"
 	"database/sql"
 	"encoding/base64"
-	"github.com/mattn/go-sqlite3"
 	. "github.com/mickael-kerjean/filestash/server/common"
 	"github.com/mickael-kerjean/filestash/server/model/formater"
 	"hash/fnv"
@@ -19,8 +18,11 @@ import (
 
 type SearchIndexer struct {
 	Id             string
+	BackendType    string
 	FoldersUnknown HeapDoc
 	CurrentPhase   string
+	Paused         bool
+	LastError      string
 	Backend        IBackend
 	DBPath         string
 	DB             *sql.DB
@@ -37,7 +39,7 @@ func NewSearchIndexer(id string, b IBackend) SearchIndexer {
 	}
 	heap.Init(&s.FoldersUnknown)
 
-	db, err := sql.Open("sqlite3", s.DBPath+"?_journal_mode=wal")
+	db, err := sql.Open("sqlite", s.DBPath+"?_pragma=journal_mode(wal)&_time_format=sqlite")
 	if err != nil {
 		Log.Warning("search::init can't open database (%v)", err)
 		return s
@@ -75,13 +77,20 @@ func NewSearchIndexer(id string, b IBackend) SearchIndexer {
 	if queryDB("CREATE TRIGGER IF NOT EXISTS after_file_delete AFTER DELETE ON file BEGIN DELETE FROM file_index WHERE path = old.path; END;"); err != nil {
 		return s
 	}
-	if queryDB("CREATE TRIGGER IF NOT EXISTS after_file_update_path UPDATE OF path ON file BEGIN UPDATE file_index SET path = new.path, filepath = new.filepath, filetype = new.filetype WHERE path = old.path; END;"); err != nil {
+	if queryDB("DROP TRIGGER IF EXISTS after_file_update_path;"); err != nil {
+		return s
+	}
+	if queryDB("CREATE TRIGGER IF NOT EXISTS after_file_update_path_v2 UPDATE OF path ON file BEGIN UPDATE file_index SET path = new.path, filename = new.filename, filetype = new.filetype WHERE path = old.path; END;"); err != nil {
 		return s
 	}
 	return s
 }
 
 func (this *SearchIndexer) Execute() {
+	if this.Paused {
+		time.Sleep(1 * time.Second)
+		return
+	}
 	if this.CurrentPhase == "" {
 		time.Sleep(1 * time.Second)
 		this.CurrentPhase = PHASE_EXPLORE
@@ -93,6 +102,7 @@ func (this *SearchIndexer) Execute() {
 		tx, err := this.DB.Begin()
 		if err != nil {
 			Log.Warning("search::index cycle_begin (%+v)", err)
+			this.LastError = err.Error()
 			time.Sleep(5 * time.Second)
 		}
 		for {
@@ -136,6 +146,7 @@ func (this *SearchIndexer) Discover(tx *sql.Tx) bool {
 	}
 	files, err := this.Backend.Ls(doc.Path)
 	if err != nil {
+		this.LastError = err.Error()
 		this.CurrentPhase = ""
 		return true
 	}
@@ -178,7 +189,7 @@ func (this *SearchIndexer) Discover(tx *sql.Tx) bool {
 			p += "/"
 			if err = this.dbInsert(doc.Path, f, tx); err == nil {
 				performPush = true
-			} else if e, ok := err.(sqlite3.Error); ok && e.Code == sqlite3.ErrConstraint {
+			} else if isConstraintError(err) {
 				performPush = func(path string) bool {
 					var t string
 					var err error
@@ -215,7 +226,7 @@ func (this *SearchIndexer) Discover(tx *sql.Tx) bool {
 			}
 		} else {
 			if err = this.dbInsert(doc.Path, f, tx); err != nil {
-				if e, ok := err.(sqlite3.Error); ok && e.Code == sqlite3.ErrConstraint {
+				if isConstraintError(err) {
 					return false
 				}
 				Log.Warning("search::insert index_error (%v)", err)
@@ -253,6 +264,7 @@ func (this *SearchIndexer) Indexing(tx *sql.Tx) bool {
 		}
 		if err = this.updateFile(path, tx); err != nil {
 			Log.Warning("search::indexing index_update (%v)", err)
+			this.LastError = err.Error()
 			return false
 		}
 	}
@@ -265,57 +277,51 @@ func (this *SearchIndexer) Indexing(tx *sql.Tx) bool {
 }
 
 func (this *SearchIndexer) updateFile(path string, tx *sql.Tx) error {
-	if _, err := tx.Exec("UPDATE file SET indexTime = ? WHERE path = ?", time.Now(), path); err != nil {
-		return err
-	}
+	content, err := this.fileContent(path)
+	return this.updateFileContent(path, content, err, tx)
+}
 
+// fileContent gives the text to index for a file, nil when there's nothing worth indexing
+func (this *SearchIndexer) fileContent(path string) ([]byte, error) {
 	for i := 0; i < len(INDEXING_EXCLUSION); i++ {
 		if strings.Contains(path, INDEXING_EXCLUSION[i]) {
-			return nil
+			return nil, nil
 		}
 	}
 
 	reader, err := this.Backend.Cat(path)
 	if err != nil {
-		if _, a := tx.Exec("DELETE FROM file WHERE path = ?", path); a != nil {
-			return a
-		}
-		return err
+		return nil, err
 	}
 	defer reader.Close()
 
-	switch GetMimeType(path) {
-	case "text/plain":
-		reader, err = formater.TxtFormater(reader)
-	case "text/org":
-		reader, err = formater.TxtFormater(reader)
-	case "text/markdown":
-		reader, err = formater.TxtFormater(reader)
-	case "application/x-form":
-		reader, err = formater.TxtFormater(reader)
-	case "application/pdf":
-		reader, err = formater.PdfFormater(reader)
-	case "application/powerpoint":
-		reader, err = formater.OfficeFormater(reader)
-	case "application/vnd.ms-powerpoint":
-		reader, err = formater.OfficeFormater(reader)
-	case "application/word":
-		reader, err = formater.OfficeFormater(reader)
-	case "application/msword":
-		reader, err = formater.OfficeFormater(reader)
-	default:
-		return nil
-	}
-
+	text, err := formater.Extract(GetMimeType(path), reader)
 	if err != nil {
-		return nil
+		return nil, nil
 	}
-	var content []byte
-	if content, err = ioutil.ReadAll(reader); err != nil {
+	defer text.Close()
+	content, err := ioutil.ReadAll(text)
+	if err != nil {
 		Log.Warning("search::index content_read (%v)", err)
+		return nil, nil
+	}
+	return content, nil
+}
+
+// updateFileContent stores what fileContent gave us, a file we couldn't read is taken out of the index
+func (this *SearchIndexer) updateFileContent(path string, content []byte, contentErr error, tx *sql.Tx) error {
+	if _, err := tx.Exec("UPDATE file SET indexTime = ? WHERE path = ?", time.Now(), path); err != nil {
+		return err
+	}
+	if contentErr != nil {
+		if _, err := tx.Exec("DELETE FROM file WHERE path = ?", path); err != nil {
+			return err
+		}
+		return contentErr
+	} else if content == nil {
 		return nil
 	}
-	if _, err = tx.Exec("UPDATE file_index SET content = ? WHERE path = ?", content, path); err != nil {
+	if _, err := tx.Exec("UPDATE file_index SET content = ? WHERE path = ?", content, path); err != nil {
 		Log.Warning("search::index index_update (%v)", err)
 		return err
 	}
@@ -468,7 +474,7 @@ func (this *SearchIndexer) dbUpdate(parent string, f os.FileInfo, tx *sql.Tx) er
 		path += "/"
 	}
 	_, err := tx.Exec(
-		"UPDATE file SET size = ?, modTime = ? indexTime = NULL WHERE path = ?",
+		"UPDATE file SET size = ?, modTime = ?, indexTime = NULL WHERE path = ?",
 		f.Size(), f.ModTime(), path,
 	)
 	return err
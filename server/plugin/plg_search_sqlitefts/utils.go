@@ -3,6 +3,9 @@ package plg_search_sqlitefts
 import (
 	"strings"
 	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 const MAX_HEAP_SIZE = 100000
@@ -52,3 +55,12 @@ func (h *HeapDoc) Pop() interface{} {
 	*h = old[0 : n-1]
 	return x
 }
+
+// isConstraintError tells if an insert failed because the row was already there
+func isConstraintError(err error) bool {
+	e, ok := err.(*sqlite.Error)
+	if ok == false {
+		return false
+	}
+	return e.Code()&0xff == sqlite3.SQLITE_CONSTRAINT
+}
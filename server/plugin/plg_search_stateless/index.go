@@ -20,6 +20,10 @@ type StatelessSearch struct{}
 
 func (this StatelessSearch) Query(app App, path string, keyword string) ([]IFile, error) {
 	files := make([]IFile, 0)
+	query, err := NewSearchQuery(&app, keyword)
+	if err != nil {
+		return files, err
+	}
 	toVisit := []PathQuandidate{PathQuandidate{path, 0}}
 	MAX_SEARCH_TIME := SEARCH_TIMEOUT()
 
@@ -43,10 +47,16 @@ func (this StatelessSearch) Query(app App, path string, keyword string) ([]IFile
 		score1 := scoreBoostForFilesInDirectory(f)
 		for i := 0; i < len(f); i++ {
 			name := f[i].Name()
-			if isAMatch := IsSearchQueryMatchingFilename(
-				[]rune(strings.ToLower(name)),
-				[]rune(strings.ToLower(keyword)),
-			); isAMatch {
+			fullpath := filepath.Join(currentPath.Path, name)
+			if f[i].IsDir() {
+				fullpath += "/"
+			}
+			if isAMatch := query.Match(f[i], fullpath, func(term string) bool {
+				return IsSearchQueryMatchingFilename(
+					[]rune(strings.ToLower(name)),
+					[]rune(strings.ToLower(term)),
+				)
+			}); isAMatch {
 				files = append(files, File{
 					FName: name,
 					FType: func() string {
@@ -57,19 +67,13 @@ func (this StatelessSearch) Query(app App, path string, keyword string) ([]IFile
 					}(),
 					FSize: f[i].Size(),
 					FTime: f[i].ModTime().Unix() * 1000,
-					FPath: func() string {
-						p := filepath.Join(currentPath.Path, name)
-						if f[i].IsDir() {
-							p = p + "/"
-						}
-						return p
-					}(),
+					FPath: fullpath,
 				})
 			}
 
 			// follow directories
-			fullpath := currentPath.Path + name + "/"
-			relativePath := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(fullpath, path), "/"))
+			nextpath := currentPath.Path + name + "/"
+			relativePath := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(nextpath, path), "/"))
 			score2 := scoreBoostOnDepth(relativePath) * 2
 			if f[i].IsDir() {
 				score := scoreBoostForPath(relativePath)
@@ -87,7 +91,7 @@ func (this StatelessSearch) Query(app App, path string, keyword string) ([]IFile
 					}
 					t[k] = toVisit[k]
 				}
-				t[k] = PathQuandidate{fullpath, score}
+				t[k] = PathQuandidate{nextpath, score}
 				for k = k + 1; k < len(toVisit)+1; k++ {
 					t[k] = toVisit[k-1]
 				}
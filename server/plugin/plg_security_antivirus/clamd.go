@@ -0,0 +1,80 @@
+package plg_security_antivirus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const CLAMD_CHUNK_SIZE = 64 * 1024
+
+/*
+ * Minimal client for the INSTREAM command of clamd as documented in clamd(8):
+ * the content is sent as a sequence of chunks prefixed with their length as a 4 bytes
+ * unsigned integer in network byte order, terminated by a zero length chunk
+ */
+func clamdScan(address string, r io.Reader, timeout time.Duration) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	} else if strings.HasPrefix(address, "unix://") {
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix://")
+	} else if strings.HasPrefix(address, "tcp://") {
+		address = strings.TrimPrefix(address, "tcp://")
+	}
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, CLAMD_CHUNK_SIZE)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(size); werr != nil {
+				return "", werr
+			} else if _, werr = conn.Write(buf[:n]); werr != nil {
+				return "", werr
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return parseClamdResponse(strings.TrimRight(line, "\x00\n"))
+}
+
+// parseClamdResponse gives back the name of the virus that was found, an empty string if the file is clean
+func parseClamdResponse(line string) (string, error) {
+	line = strings.TrimPrefix(line, "stream: ")
+	if line == "OK" {
+		return "", nil
+	} else if strings.HasSuffix(line, " FOUND") {
+		return strings.TrimSuffix(line, " FOUND"), nil
+	} else if strings.HasSuffix(line, " ERROR") {
+		return "", fmt.Errorf("clamd: %s", strings.TrimSuffix(line, " ERROR"))
+	}
+	return "", fmt.Errorf("clamd: unexpected response '%s'", line)
+}
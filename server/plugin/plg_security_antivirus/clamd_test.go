@@ -0,0 +1,110 @@
+package plg_security_antivirus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd answers INSTREAM commands with the verdict given by the function, after having read
+// the whole stream the same way clamd does. An empty verdict is a clamd that never answers
+func fakeClamd(t *testing.T, verdict func(content []byte) string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stuck := make(chan struct{})
+	t.Cleanup(func() {
+		close(stuck)
+		l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString('\x00'); err != nil || cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var content bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					} else if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&content, r, int64(size)); err != nil {
+						return
+					}
+				}
+				if v := verdict(content.Bytes()); v != "" {
+					conn.Write([]byte("stream: " + v + "\x00"))
+					return
+				}
+				<-stuck
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func eicar(content []byte) string {
+	if bytes.Contains(content, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+		return "Win.Test.EICAR_HDB-1 FOUND"
+	}
+	return "OK"
+}
+
+func TestClamdScanClean(t *testing.T) {
+	addr := fakeClamd(t, eicar)
+	// bigger than a chunk to go through the framing more than once
+	content := strings.Repeat("hello world ", CLAMD_CHUNK_SIZE/4)
+	virus, err := clamdScan("tcp://"+addr, strings.NewReader(content), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	} else if virus != "" {
+		t.Fatalf("expected a clean verdict, got '%s'", virus)
+	}
+}
+
+func TestClamdScanInfected(t *testing.T) {
+	addr := fakeClamd(t, eicar)
+	content := `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+	virus, err := clamdScan(addr, strings.NewReader(content), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	} else if virus != "Win.Test.EICAR_HDB-1" {
+		t.Fatalf("expected the EICAR signature, got '%s'", virus)
+	}
+}
+
+func TestClamdScanTimeout(t *testing.T) {
+	addr := fakeClamd(t, func([]byte) string { return "" })
+	start := time.Now()
+	_, err := clamdScan(addr, strings.NewReader("hello world"), 200*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected an error when clamd doesn't answer")
+	} else if e, ok := err.(net.Error); ok == false || e.Timeout() == false {
+		t.Fatalf("expected a timeout, got '%s'", err.Error())
+	} else if time.Since(start) > 2*time.Second {
+		t.Fatalf("the timeout wasn't honoured: %s", time.Since(start))
+	}
+}
+
+func TestClamdScanError(t *testing.T) {
+	addr := fakeClamd(t, func([]byte) string { return "INSTREAM size limit exceeded. ERROR" })
+	if _, err := clamdScan(addr, strings.NewReader("hello world"), time.Second); err == nil {
+		t.Fatal("expected clamd errors to be reported")
+	}
+}
@@ -0,0 +1,108 @@
+package plg_security_antivirus
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+var (
+	AV_ENABLE        func() bool
+	AV_CLAMD         func() string
+	AV_ACTION        func() string
+	AV_SCAN_DOWNLOAD func() bool
+	AV_MAX_SIZE      func() int
+	AV_TIMEOUT       func() int
+)
+
+func init() {
+	AV_ENABLE = func() bool {
+		return Config.Get("features.antivirus.enable").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "enable"
+			f.Type = "enable"
+			f.Target = []string{"antivirus_clamd", "antivirus_action", "antivirus_scan_download", "antivirus_max_size", "antivirus_timeout"}
+			f.Description = "Enable/Disable antivirus scanning of uploaded files through clamd"
+			f.Placeholder = "Default: false"
+			f.Default = false
+			return f
+		}).Bool()
+	}
+	AV_ENABLE()
+	AV_CLAMD = func() string {
+		return Config.Get("features.antivirus.clamd").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "antivirus_clamd"
+			f.Name = "clamd"
+			f.Type = "text"
+			f.Description = "Location of the clamd daemon, either a unix socket (eg: /var/run/clamav/clamd.ctl) or a tcp address (eg: 127.0.0.1:3310)"
+			f.Placeholder = "Default: 127.0.0.1:3310"
+			f.Default = "127.0.0.1:3310"
+			return f
+		}).String()
+	}
+	AV_CLAMD()
+	AV_ACTION = func() string {
+		return Config.Get("features.antivirus.action").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "antivirus_action"
+			f.Name = "action"
+			f.Type = "select"
+			f.Opts = []string{"reject", "quarantine"}
+			f.Description = "What happens to infected uploads. In both cases the upload fails, quarantine keeps a copy of the file on the server under " + QuarantinePath
+			f.Placeholder = "Default: reject"
+			f.Default = "reject"
+			return f
+		}).String()
+	}
+	AV_ACTION()
+	AV_SCAN_DOWNLOAD = func() bool {
+		return Config.Get("features.antivirus.scan_download").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "antivirus_scan_download"
+			f.Name = "scan_download"
+			f.Type = "boolean"
+			f.Description = "Also scan files as they get downloaded, useful when content can land on the storage without going through filestash"
+			f.Placeholder = "Default: false"
+			f.Default = false
+			return f
+		}).Bool()
+	}
+	AV_SCAN_DOWNLOAD()
+	AV_MAX_SIZE = func() int {
+		return Config.Get("features.antivirus.max_size").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "antivirus_max_size"
+			f.Name = "max_size"
+			f.Type = "number"
+			f.Description = "Files bigger than this (in MB) can't be scanned and are refused, both on upload and on download. It should match the StreamMaxLength setting of clamd"
+			f.Placeholder = "Default: 25MB"
+			f.Default = 25
+			return f
+		}).Int()
+	}
+	AV_MAX_SIZE()
+	AV_TIMEOUT = func() int {
+		return Config.Get("features.antivirus.timeout").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "antivirus_timeout"
+			f.Name = "timeout"
+			f.Type = "number"
+			f.Description = "Time in seconds we wait on clamd before giving up on a scan"
+			f.Placeholder = "Default: 30s"
+			f.Default = 30
+			return f
+		}).Int()
+	}
+	AV_TIMEOUT()
+}
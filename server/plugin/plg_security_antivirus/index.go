@@ -0,0 +1,203 @@
+package plg_security_antivirus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+const QuarantinePath = "data/state/quarantine/"
+
+var (
+	ErrInfected        = NewError("Virus detected", 403)
+	ErrScanUnavailable = NewError("Antivirus is not available", 503)
+	ErrTooBigToScan    = NewError("File is too big to be scanned", 413)
+	verdictCache       AppCache
+)
+
+func init() {
+	os.MkdirAll(GetAbsolutePath(QuarantinePath), os.ModePerm)
+	verdictCache = NewAppCache(60, 10)
+
+	Hooks.Register.ProcessFileContentBeforeSave(func(reader io.Reader, ctx *App, path string) (io.Reader, error) {
+		if AV_ENABLE() == false {
+			return reader, nil
+		}
+		file, hash, err := spool(reader, maxSize())
+		if err == ErrTooBigToScan {
+			Log.Warning("plg_security_antivirus::save refused path[%s] size[>%d]", path, maxSize())
+			return nil, err
+		} else if err != nil {
+			Log.Debug("plg_security_antivirus::save spool '%s'", err.Error())
+			return nil, ErrFilesystemError
+		}
+		virus, err := scan(file, hash)
+		if err != nil {
+			file.Close()
+			Log.Error("plg_security_antivirus::save scan path[%s] err[%s]", path, err.Error())
+			return nil, ErrScanUnavailable
+		} else if virus != "" {
+			action := AV_ACTION()
+			if action == "quarantine" {
+				quarantine(file, hash, virus, ctx, path)
+			}
+			file.Close()
+			audit("upload", action, virus, ctx, path)
+			return nil, ErrInfected
+		}
+		return file, nil
+	})
+
+	Hooks.Register.ProcessFileContentBeforeSend(func(reader io.ReadCloser, ctx *App, res *http.ResponseWriter, req *http.Request) (io.ReadCloser, error) {
+		if AV_ENABLE() == false || AV_SCAN_DOWNLOAD() == false {
+			return reader, nil
+		} else if req.URL.Query().Get("thumbnail") == "true" {
+			return reader, nil
+		}
+		path := req.URL.Query().Get("path")
+		file, hash, err := spool(reader, maxSize())
+		if err == ErrTooBigToScan {
+			reader.Close()
+			Log.Warning("plg_security_antivirus::cat refused path[%s] size[>%d]", path, maxSize())
+			return nil, err
+		} else if err != nil {
+			reader.Close()
+			Log.Debug("plg_security_antivirus::cat spool '%s'", err.Error())
+			return nil, ErrFilesystemError
+		}
+		virus, err := scan(file, hash)
+		if err != nil {
+			file.Close()
+			Log.Error("plg_security_antivirus::cat scan path[%s] err[%s]", path, err.Error())
+			return nil, ErrScanUnavailable
+		} else if virus != "" {
+			file.Close()
+			audit("download", "reject", virus, ctx, path)
+			return nil, ErrInfected
+		}
+		return file, nil
+	})
+}
+
+// scan gives back the name of the virus found in the file, using previous verdicts when possible
+func scan(file *spooledFile, hash string) (string, error) {
+	if verdict, ok := verdictCache.Cache.Get(hash); ok {
+		return verdict.(string), nil
+	}
+	virus, err := clamdScan(AV_CLAMD(), file.file, time.Duration(AV_TIMEOUT())*time.Second)
+	if _, serr := file.file.Seek(0, io.SeekStart); serr != nil && err == nil {
+		err = serr
+	}
+	if err != nil {
+		return "", err
+	}
+	verdictCache.Cache.Set(hash, virus, 0)
+	return virus, nil
+}
+
+func quarantine(file *spooledFile, hash string, virus string, ctx *App, path string) {
+	name := fmt.Sprintf("%d_%s", time.Now().Unix(), hash[:16])
+	f, err := os.OpenFile(GetAbsolutePath(QuarantinePath, name+".dat"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		Log.Warning("plg_security_antivirus::quarantine create '%s'", err.Error())
+		return
+	}
+	_, err = io.Copy(f, file.file)
+	f.Close()
+	if err != nil {
+		Log.Warning("plg_security_antivirus::quarantine copy '%s'", err.Error())
+		return
+	}
+	meta, _ := json.Marshal(map[string]interface{}{
+		"path":    path,
+		"virus":   virus,
+		"sha256":  hash,
+		"backend": ctx.Session["type"],
+		"session": GenerateID(ctx),
+		"share":   ctx.Share.Id,
+		"date":    time.Now().Format(time.RFC3339),
+	})
+	os.WriteFile(GetAbsolutePath(QuarantinePath, name+".json"), meta, 0600)
+}
+
+func audit(action string, outcome string, virus string, ctx *App, path string) {
+	Log.Warning(
+		"plg_security_antivirus::detected action[%s] outcome[%s] virus[%s] path[%s] backend[%s] session[%s] share[%s]",
+		action, outcome, virus, path, ctx.Session["type"], GenerateID(ctx), ctx.Share.Id,
+	)
+}
+
+func maxSize() int64 {
+	return int64(AV_MAX_SIZE()) * 1024 * 1024
+}
+
+/*
+ * spooledFile is a local copy of the content we need to scan. It cleans up after itself when it is
+ * closed. Content we can't scan entirely is refused: letting it through unscanned would make the
+ * limit a way around the antivirus
+ */
+type spooledFile struct {
+	file   *os.File
+	source io.Reader
+	closed bool
+}
+
+func spool(r io.Reader, max int64) (*spooledFile, string, error) {
+	f, err := os.CreateTemp(GetAbsolutePath(TMP_PATH), "av_*.dat")
+	if err != nil {
+		return nil, "", err
+	}
+	os.Remove(f.Name()) // the file descriptor remains usable until closed
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hasher), io.LimitReader(r, max+1))
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	} else if size > max {
+		f.Close()
+		return nil, "", ErrTooBigToScan
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	return &spooledFile{file: f, source: r}, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (this *spooledFile) Read(p []byte) (int, error) {
+	if this.closed {
+		return 0, io.EOF
+	}
+	return this.file.Read(p)
+}
+
+// Seek makes range requests possible on what we've scanned, the content is all there on disk
+func (this *spooledFile) Seek(offset int64, whence int) (int64, error) {
+	if this.closed {
+		return 0, os.ErrClosed
+	}
+	return this.file.Seek(offset, whence)
+}
+
+func (this *spooledFile) Close() error {
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	if c, ok := this.source.(io.Closer); ok {
+		c.Close()
+	}
+	return this.file.Close()
+}
+
+// Verbatim tells the content is the one of the original reader, we've only had a look at it
+func (this *spooledFile) Verbatim() bool {
+	return true
+}
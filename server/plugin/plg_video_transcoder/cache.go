@@ -0,0 +1,23 @@
+package plg_video_transcoder
+
+import (
+	"os"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+/*
+ * Transcoded segments are kept on disk so seeking back or watching a video again doesn't run ffmpeg
+ * another time. The cache survives restarts, when it grows past its limit the segments that were
+ * watched the least recently are removed first
+ */
+var segmentCache = NewDiskCache(VideoCachePath+"segment/", func() int { return transcoder_cache_size() })
+
+// segmentCachePut moves a freshly transcoded segment in the cache
+func segmentCachePut(name string, tmp string) error {
+	if err := segmentCache.Put(name, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package plg_video_transcoder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"sync"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+type FFProbeData struct {
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   float64           `json:"duration,string"`
+		BitRate    int               `json:"bit_rate,string"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []FFProbeStream `json:"streams"`
+}
+
+type FFProbeStream struct {
+	Index       int    `json:"index"`
+	CodecType   string `json:"codec_type"`
+	CodecName   string `json:"codec_name"`
+	PixelFormat string `json:"pix_fmt"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	SampleRate  int    `json:"sample_rate,string"`
+	Channels    int    `json:"channels"`
+	Tags        struct {
+		Language string `json:"language"`
+		Title    string `json:"title"`
+		Rotate   string `json:"rotate"`
+	} `json:"tags"`
+	Disposition struct {
+		Default int `json:"default"`
+	} `json:"disposition"`
+}
+
+// Video gives the size of the first video stream, 0x0 when there is none
+func (this FFProbeData) Video() (int, int) {
+	for _, s := range this.Streams {
+		if s.CodecType == "video" && s.Height > 0 {
+			return s.Width, s.Height
+		}
+	}
+	return 0, 0
+}
+
+// StreamsOf gives the streams of a kind: "video", "audio", "subtitle", ...
+func (this FFProbeData) StreamsOf(codecType string) []FFProbeStream {
+	streams := []FFProbeStream{}
+	for _, s := range this.Streams {
+		if s.CodecType == codecType {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+/*
+ * ffprobe gives information about a video. The input is either the path of a file or a stream in
+ * which case only the beginning of the video is read, which is enough to find out about most
+ * formats without having to wait for the whole thing
+ */
+func ffprobe(videoPath string, stream io.Reader) (FFProbeData, error) {
+	var stdout bytes.Buffer
+	var probe FFProbeData
+
+	input := videoPath
+	if stream != nil {
+		input = "pipe:0"
+	}
+	cmd := exec.Command(
+		"ffprobe",
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_format", "-show_streams",
+		"-i", input,
+	)
+	cmd.Stdin = stream
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return probe, err
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return probe, err
+	}
+	return probe, nil
+}
+
+/*
+ * transcoding is CPU bound, without a limit on the number of ffmpeg processes running side by side
+ * a single viewer seeking through a video would be enough to make the server unresponsive
+ */
+var ffmpegLimit = struct {
+	sync.Mutex
+	running int
+	release chan struct{}
+}{release: make(chan struct{})}
+
+func ffmpegAcquire(ctx context.Context) error {
+	for {
+		ffmpegLimit.Lock()
+		if ffmpegLimit.running < transcoder_concurrency() {
+			ffmpegLimit.running += 1
+			ffmpegLimit.Unlock()
+			return nil
+		}
+		release := ffmpegLimit.release
+		ffmpegLimit.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-release:
+		}
+	}
+}
+
+func ffmpegRelease() {
+	ffmpegLimit.Lock()
+	ffmpegLimit.running -= 1
+	close(ffmpegLimit.release)
+	ffmpegLimit.release = make(chan struct{})
+	ffmpegLimit.Unlock()
+}
+
+func ffmpeg(ctx context.Context, args ...string) error {
+	return ffmpegPipe(ctx, nil, nil, args...)
+}
+
+func ffmpegPipe(ctx context.Context, stdin io.Reader, stdout io.Writer, args ...string) error {
+	if err := ffmpegAcquire(ctx); err != nil {
+		return err
+	}
+	defer ffmpegRelease()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == nil {
+			Log.Error("plg_video_transcoder::ffmpeg::run '%s' - %s", err.Error(), stderr.String())
+		}
+		return err
+	}
+	return nil
+}
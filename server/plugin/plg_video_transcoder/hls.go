@@ -0,0 +1,520 @@
+package plg_video_transcoder
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/ctrl"
+)
+
+type hlsRendition struct {
+	Name         string
+	Height       int
+	VideoBitrate int  // kbps
+	AudioBitrate int  // kbps
+	Audio        bool // alternate audio rendition made from a single audio stream
+	Stream       int
+}
+
+var HLS_RENDITIONS = []hlsRendition{
+	{Name: "360p", Height: 360, VideoBitrate: 800, AudioBitrate: 96},
+	{Name: "720p", Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+	{Name: "1080p", Height: 1080, VideoBitrate: 5000, AudioBitrate: 192},
+}
+
+var (
+	hlsValidID   = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+	hlsAudioName = regexp.MustCompile(`^audio([0-9]+)$`)
+)
+
+/*
+ * A source is the local copy of a video ffmpeg reads from when transcoding segments. The copy is
+ * made in the background so the playlist can be sent as soon as we know the duration of the video.
+ * Until the video has been probed, the source is a placeholder others wait on
+ */
+type hlsSource struct {
+	file      string
+	probe     FFProbeData
+	subtitles []hlsSubtitle
+	opened    chan struct{}
+	openErr   error
+	ready     chan struct{}
+	err       error
+}
+
+// with a single audio track, audio and video are muxed together in the same segments
+func (this *hlsSource) alternateAudio() bool {
+	return len(this.probe.StreamsOf("audio")) > 1
+}
+
+var hlsSources = struct {
+	sync.Mutex
+	m map[string]*hlsSource
+}{m: map[string]*hlsSource{}}
+
+// hlsSourceLookup gives a source we already know about once it is usable, nil otherwise
+func hlsSourceLookup(id string) *hlsSource {
+	hlsSources.Lock()
+	src := hlsSources.m[id]
+	hlsSources.Unlock()
+	if src == nil {
+		return nil
+	}
+	<-src.opened
+	if src.openErr != nil {
+		return nil
+	}
+	return src
+}
+
+func hls_playlist(reader io.ReadCloser, ctx *App, res *http.ResponseWriter, req *http.Request) (io.ReadCloser, error) {
+	query := req.URL.Query()
+	if query.Get("transcode") != "hls" {
+		return reader, nil
+	}
+	path := query.Get("path")
+	if strings.HasPrefix(GetMimeType(path), "video/") == false {
+		return reader, nil
+	}
+
+	p, files := hlsListing(ctx, path)
+	id := hlsSourceID(ctx, path, files)
+	src, err := hlsSourceOpen(ctx, id, p, files, reader)
+	if err != nil {
+		Log.Debug("plg_video_transcoder::playlist path[%s] err[%s]", path, err.Error())
+		return nil, NewError("Unable to read the video", 400)
+	}
+
+	width, height := src.probe.Video()
+	renditions := hlsRenditions(height)
+	response := "#EXTM3U\n"
+	response += "#EXT-X-VERSION:3\n"
+	attrs := ""
+	if src.alternateAudio() {
+		attrs += `,AUDIO="audio"`
+		audios := src.probe.StreamsOf("audio")
+		defaultAudio := 0
+		for i, s := range audios {
+			if s.Disposition.Default == 1 {
+				defaultAudio = i
+				break
+			}
+		}
+		for i, s := range audios {
+			response += fmt.Sprintf(
+				"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"%s\"%s,DEFAULT=%s,AUTOSELECT=YES,URI=\"/hls/%s/audio%d/index.m3u8\"\n",
+				hlsAttr(hlsTrackName(s.Tags.Title, s.Tags.Language, i)), hlsLanguage(s.Tags.Language),
+				hlsYesNo(i == defaultAudio), id, s.Index,
+			)
+		}
+	}
+	if len(src.subtitles) > 0 {
+		attrs += `,SUBTITLES="subs"`
+		for _, s := range src.subtitles {
+			response += fmt.Sprintf(
+				"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"%s\"%s,DEFAULT=NO,AUTOSELECT=NO,URI=\"/hls/%s/subtitle/%s/index.m3u8\"\n",
+				hlsAttr(s.Name), hlsLanguage(s.Language), id, s.Id,
+			)
+		}
+	}
+	for _, r := range renditions {
+		response += fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", (r.VideoBitrate+r.AudioBitrate)*1000)
+		if width > 0 && height > 0 {
+			response += fmt.Sprintf(",RESOLUTION=%dx%d", evenSize(width*r.Height/height), r.Height)
+		}
+		response += fmt.Sprintf("%s\n/hls/%s/%s/index.m3u8\n", attrs, id, r.Name)
+	}
+	(*res).Header().Set("Content-Type", "application/x-mpegURL")
+	return NewReadCloserFromBytes([]byte(response)), nil
+}
+
+func hls_media_playlist(ctx *App, res http.ResponseWriter, req *http.Request) {
+	src, _, err := hlsRequest(req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	} else if src == nil {
+		SendErrorResult(res, ErrNotFound)
+		return
+	}
+
+	var i int
+	duration := src.probe.Format.Duration
+	response := "#EXTM3U\n"
+	response += "#EXT-X-VERSION:3\n"
+	response += "#EXT-X-MEDIA-SEQUENCE:0\n"
+	response += "#EXT-X-PLAYLIST-TYPE:VOD\n"
+	response += fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", HLS_SEGMENT_LENGTH)
+	for i = 0; i < int(duration)/HLS_SEGMENT_LENGTH; i++ {
+		response += fmt.Sprintf("#EXTINF:%d.0000, nodesc\n", HLS_SEGMENT_LENGTH)
+		response += fmt.Sprintf("%d.ts\n", i)
+	}
+	if md := math.Mod(duration, HLS_SEGMENT_LENGTH); md > 0 {
+		response += fmt.Sprintf("#EXTINF:%.4f, nodesc\n", md)
+		response += fmt.Sprintf("%d.ts\n", i)
+	}
+	response += "#EXT-X-ENDLIST\n"
+	res.Header().Set("Content-Type", "application/x-mpegURL")
+	res.Write([]byte(response))
+}
+
+func hls_transcode(ctx *App, res http.ResponseWriter, req *http.Request) {
+	src, rendition, err := hlsRequest(req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	segmentNumber, err := strconv.Atoi(mux.Vars(req)["segment"])
+	if err != nil || segmentNumber < 0 {
+		Log.Info("[plugin hls] invalid segment request '%s'", mux.Vars(req)["segment"])
+		SendErrorResult(res, NewError("Invalid segment", 400))
+		return
+	}
+	name := fmt.Sprintf("%s_%s_%d.ts", mux.Vars(req)["id"], rendition.Name, segmentNumber)
+	if f, ok := segmentCache.Get(name); ok {
+		hlsServeSegment(res, req, f)
+		return
+	} else if src == nil {
+		Log.Info("[plugin hls]: invalid video")
+		SendErrorResult(res, ErrNotFound)
+		return
+	}
+
+	// the segment could be transcoding for someone else already
+	hlsInflight.Lock()
+	wait, found := hlsInflight.m[name]
+	if found == false {
+		wait = make(chan struct{})
+		hlsInflight.m[name] = wait
+	}
+	hlsInflight.Unlock()
+	if found == false {
+		err = hlsTranscodeSegment(req, src, rendition, segmentNumber, name)
+		hlsInflight.Lock()
+		delete(hlsInflight.m, name)
+		hlsInflight.Unlock()
+		close(wait)
+	} else {
+		select {
+		case <-wait:
+		case <-req.Context().Done():
+			return
+		}
+	}
+	if err != nil {
+		SendErrorResult(res, ErrCongestion)
+		return
+	}
+	f, ok := segmentCache.Get(name)
+	if ok == false {
+		SendErrorResult(res, ErrCongestion)
+		return
+	}
+	hlsServeSegment(res, req, f)
+}
+
+var hlsInflight = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: map[string]chan struct{}{}}
+
+func hlsTranscodeSegment(req *http.Request, src *hlsSource, rendition hlsRendition, segmentNumber int, name string) error {
+	select {
+	case <-src.ready:
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+	if src.err != nil {
+		return src.err
+	}
+
+	startTime := segmentNumber * HLS_SEGMENT_LENGTH
+	tmp := GetAbsolutePath(VideoCachePath, "source", name+".tmp"+QuickString(6))
+	defer os.Remove(tmp)
+	args := []string{
+		"-ss", fmt.Sprintf("%d.00", startTime),
+		"-i", src.file,
+		"-t", fmt.Sprintf("%d.00", HLS_SEGMENT_LENGTH),
+	}
+	if rendition.Audio {
+		args = append(args, "-map", fmt.Sprintf("0:%d", rendition.Stream), "-vn")
+	} else {
+		args = append(args, "-map", "0:v:0")
+		if src.alternateAudio() {
+			args = append(args, "-an")
+		} else {
+			args = append(args, "-map", "0:a:0?")
+		}
+		args = append(args,
+			"-vf", fmt.Sprintf("scale=-2:%d", rendition.Height),
+			"-vcodec", "libx264",
+			"-preset", "veryfast",
+			"-b:v", fmt.Sprintf("%dk", rendition.VideoBitrate),
+			"-maxrate", fmt.Sprintf("%dk", rendition.VideoBitrate),
+			"-bufsize", fmt.Sprintf("%dk", rendition.VideoBitrate*2),
+			"-pix_fmt", "yuv420p",
+			"-x264opts", strings.Join([]string{
+				"subme=0",
+				"me_range=4",
+				"rc_lookahead=10",
+				"me=dia",
+				"no_chroma_me",
+				"8x8dct=0",
+				"partitions=none",
+			}, ":"),
+			"-force_key_frames", "expr:gte(t,0)",
+			"-vsync", "2",
+		)
+	}
+	if rendition.Audio || src.alternateAudio() == false {
+		args = append(args,
+			"-acodec", "aac",
+			"-ab", fmt.Sprintf("%dk", rendition.AudioBitrate),
+			"-ac", "2",
+		)
+	}
+	// timestamps have to match the position in the video for the audio and subtitle renditions
+	// to be in sync
+	args = append(args,
+		"-muxdelay", "0",
+		"-muxpreload", "0",
+		"-output_ts_offset", fmt.Sprintf("%d.00", startTime),
+		"-f", "mpegts",
+		"-y", tmp,
+	)
+	err := ffmpeg(req.Context(), args...)
+	if err != nil {
+		return err
+	}
+	return segmentCachePut(name, tmp)
+}
+
+func hlsServeSegment(res http.ResponseWriter, req *http.Request, f *os.File) {
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	res.Header().Set("Content-Type", "video/mp2t")
+	res.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", CLEAR_CACHE_AFTER*3600))
+	http.ServeContent(res, req, "", info.ModTime(), f)
+}
+
+// hlsRequest gives the source and the rendition of a request. The source is nil when it is not
+// known, eg: after a restart, in which case only segments that were cached can be served
+func hlsRequest(req *http.Request) (*hlsSource, hlsRendition, error) {
+	vars := mux.Vars(req)
+	if hlsValidID.MatchString(vars["id"]) == false {
+		return nil, hlsRendition{}, NewError("Invalid video", 400)
+	}
+	var rendition hlsRendition
+	for _, r := range HLS_RENDITIONS {
+		if r.Name == vars["rendition"] {
+			rendition = r
+			break
+		}
+	}
+	src := hlsSourceLookup(vars["id"])
+
+	if m := hlsAudioName.FindStringSubmatch(vars["rendition"]); m != nil {
+		stream, _ := strconv.Atoi(m[1])
+		rendition = hlsRendition{Name: vars["rendition"], AudioBitrate: 128, Audio: true, Stream: stream}
+		if src == nil {
+			return nil, rendition, nil
+		}
+		for _, s := range src.probe.StreamsOf("audio") {
+			if s.Index == stream {
+				return src, rendition, nil
+			}
+		}
+		return nil, rendition, NewError("Invalid rendition", 400)
+	} else if src != nil {
+		// for videos smaller than our lowest quality, the rendition is made at the original size
+		_, height := src.probe.Video()
+		for _, r := range hlsRenditions(height) {
+			if r.Name == vars["rendition"] {
+				rendition = r
+			}
+		}
+	}
+	if rendition.Name == "" {
+		return nil, rendition, NewError("Invalid rendition", 400)
+	}
+	return src, rendition, nil
+}
+
+// hlsRenditions are the qualities that make sense for a video: we never upscale
+func hlsRenditions(height int) []hlsRendition {
+	if height <= 0 {
+		return HLS_RENDITIONS[:2]
+	}
+	renditions := []hlsRendition{}
+	for _, r := range HLS_RENDITIONS {
+		if r.Height <= height {
+			renditions = append(renditions, r)
+		}
+	}
+	if len(renditions) == 0 {
+		r := HLS_RENDITIONS[0]
+		r.Height = evenSize(height)
+		renditions = append(renditions, r)
+	}
+	return renditions
+}
+
+// hlsListing gives what's next to a video which tells us if it has changed and if it comes with subtitles
+func hlsListing(ctx *App, path string) (string, []os.FileInfo) {
+	p, err := ctrl.PathBuilder(ctx, path)
+	if err != nil {
+		return "", nil
+	}
+	files, _ := ctx.Backend.Ls(EnforceDirectory(filepath.Dir(p)))
+	return p, files
+}
+
+func hlsSourceOpen(ctx *App, id string, path string, files []os.FileInfo, reader io.ReadCloser) (*hlsSource, error) {
+	return hlsSourceGet(id, reader, func(src *hlsSource) []hlsSubtitle {
+		return append(hlsSubtitlesEmbedded(src), hlsSubtitlesSidecar(ctx, path, files, id)...)
+	})
+}
+
+/*
+ * hlsSourceID identifies a video for a user. As it ends up in the cache of transcoded segments, it
+ * changes whenever the video does
+ */
+func hlsSourceID(ctx *App, path string, files []os.FileInfo) string {
+	version := QuickString(10)
+	for _, f := range files {
+		if f.Name() == filepath.Base(path) && f.ModTime().IsZero() == false {
+			version = fmt.Sprintf("%d %d", f.ModTime().UnixNano(), f.Size())
+			break
+		}
+	}
+	return Hash(fmt.Sprintf("%s %s %s %s", GenerateID(ctx), path, version, SECRET_KEY), 20)
+}
+
+/*
+ * hlsSourceGet makes a local copy of the video. The video is probed while it is being copied so we
+ * don't have to wait for the copy to be completed unless the format requires it
+ */
+func hlsSourceGet(id string, reader io.ReadCloser, subtitles func(*hlsSource) []hlsSubtitle) (*hlsSource, error) {
+	// the placeholder makes whoever comes next wait for this copy instead of starting another one
+	hlsSources.Lock()
+	src, found := hlsSources.m[id]
+	if found == false {
+		src = &hlsSource{
+			file:   GetAbsolutePath(VideoCachePath, "source", id+"_"+QuickString(6)+".dat"),
+			opened: make(chan struct{}),
+			ready:  make(chan struct{}),
+		}
+		hlsSources.m[id] = src
+	}
+	hlsSources.Unlock()
+	if found {
+		reader.Close()
+		<-src.opened
+		if src.openErr != nil {
+			return nil, src.openErr
+		}
+		return src, nil
+	}
+
+	if src.openErr = hlsSourceCopy(src, reader); src.openErr != nil {
+		hlsSources.Lock()
+		delete(hlsSources.m, id)
+		hlsSources.Unlock()
+		close(src.opened)
+		return nil, src.openErr
+	}
+	src.subtitles = subtitles(src)
+	close(src.opened)
+
+	time.AfterFunc(CLEAR_CACHE_AFTER*time.Hour, func() {
+		hlsSources.Lock()
+		delete(hlsSources.m, id)
+		hlsSources.Unlock()
+		<-src.ready
+		os.Remove(src.file)
+		for _, s := range src.subtitles {
+			if s.file != "" {
+				os.Remove(s.file)
+			}
+		}
+	})
+	return src, nil
+}
+
+func hlsSourceCopy(src *hlsSource, reader io.ReadCloser) error {
+	f, err := os.OpenFile(src.file, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		reader.Close()
+		close(src.ready)
+		return err
+	}
+	// whatever ffprobe reads is copied over, the rest is copied in the background
+	src.probe, err = ffprobe("", io.TeeReader(reader, f))
+	go func() {
+		if _, err := io.Copy(f, reader); err != nil {
+			src.err = err
+		}
+		reader.Close()
+		f.Close()
+		close(src.ready)
+	}()
+	if err != nil || src.probe.Format.Duration <= 0 {
+		// eg: mp4 files with their metadata at the end
+		<-src.ready
+		if src.err != nil {
+			os.Remove(src.file)
+			return src.err
+		} else if src.probe, err = ffprobe(src.file, nil); err != nil {
+			os.Remove(src.file)
+			return err
+		}
+	}
+	return nil
+}
+
+func evenSize(n int) int {
+	return n - n%2
+}
+
+func hlsTrackName(title string, language string, i int) string {
+	if title != "" {
+		return title
+	} else if language != "" {
+		return language
+	}
+	return fmt.Sprintf("Track %d", i+1)
+}
+
+// hlsAttr makes a value safe to use as a quoted string attribute of a playlist
+func hlsAttr(s string) string {
+	return strings.NewReplacer(`"`, "'", "\n", " ", "\r", " ").Replace(s)
+}
+
+func hlsLanguage(language string) string {
+	if language == "" {
+		return ""
+	}
+	return fmt.Sprintf(",LANGUAGE=\"%s\"", hlsAttr(language))
+}
+
+func hlsYesNo(b bool) string {
+	if b {
+		return "YES"
+	}
+	return "NO"
+}
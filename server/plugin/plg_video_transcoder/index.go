@@ -1,20 +1,20 @@
 package plg_video_transcoder
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	. "github.com/mickael-kerjean/filestash/server/common"
 	. "github.com/mickael-kerjean/filestash/server/middleware"
-	"io"
-	"math"
 	"net/http"
 	"os"
 	"os/exec"
-	"strconv"
+	"runtime"
 	"strings"
-	"time"
+)
+
+var (
+	transcoder_cache_size  func() int
+	transcoder_concurrency func() int
 )
 
 const (
@@ -67,6 +67,42 @@ func init() {
 	}
 	blacklist_format()
 
+	transcoder_cache_size = func() int {
+		return Config.Get("features.video.transcoder_cache_size").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "transcoder_cache_size"
+			f.Name = "transcoder_cache_size"
+			f.Type = "number"
+			f.Description = "Size in MB of the disk cache where transcoded videos are kept. The least recently watched parts are removed first"
+			f.Placeholder = "Default: 4096MB"
+			f.Default = 4096
+			return f
+		}).Int()
+	}
+	transcoder_cache_size()
+
+	transcoder_concurrency = func() int {
+		n := Config.Get("features.video.transcoder_concurrency").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "transcoder_concurrency"
+			f.Name = "transcoder_concurrency"
+			f.Type = "number"
+			f.Description = "Maximum number of videos being transcoded at the same time"
+			f.Default = runtime.NumCPU()/2 + 1
+			f.Placeholder = fmt.Sprintf("Default: %d", f.Default)
+			return f
+		}).Int()
+		if n < 1 {
+			return 1
+		}
+		return n
+	}
+	transcoder_concurrency()
+
 	if plugin_enable() == false {
 		return
 	} else if ffmpegIsInstalled == false {
@@ -77,17 +113,40 @@ func init() {
 		return
 	}
 
-	cachePath := GetAbsolutePath(VideoCachePath)
-	os.RemoveAll(cachePath)
-	os.MkdirAll(cachePath, os.ModePerm)
+	// local copies of the videos don't survive a restart, transcoded segments do
+	os.RemoveAll(GetAbsolutePath(VideoCachePath, "source"))
+	os.MkdirAll(GetAbsolutePath(VideoCachePath, "source"), os.ModePerm)
+	os.MkdirAll(GetAbsolutePath(VideoCachePath, "segment"), os.ModePerm)
 
+	for _, mType := range AllMimeTypes() {
+		if strings.HasPrefix(mType, "video/") {
+			Hooks.Register.Thumbnailer(mType, thumbnailer{})
+			Hooks.Register.MetadataExtractor(mType, video_metadata)
+		}
+	}
+	Hooks.Register.ProcessFileContentBeforeSend(video_preview)
 	Hooks.Register.ProcessFileContentBeforeSend(hls_playlist)
 	Hooks.Register.HttpEndpoint(func(r *mux.Router, app *App) error {
-		r.PathPrefix("/hls/hls_{segment}.ts").Handler(NewMiddlewareChain(
+		r.HandleFunc("/hls/{id}/{rendition}/index.m3u8", NewMiddlewareChain(
+			hls_media_playlist,
+			[]Middleware{SecureHeaders},
+			*app,
+		)).Methods("GET")
+		r.HandleFunc("/hls/{id}/{rendition}/{segment}.ts", NewMiddlewareChain(
 			hls_transcode,
 			[]Middleware{SecureHeaders},
 			*app,
 		)).Methods("GET")
+		r.HandleFunc("/hls/{id}/subtitle/{subtitle}/index.m3u8", NewMiddlewareChain(
+			hls_subtitle_playlist,
+			[]Middleware{SecureHeaders},
+			*app,
+		)).Methods("GET")
+		r.HandleFunc("/hls/{id}/subtitle/{subtitle}/track.vtt", NewMiddlewareChain(
+			hls_subtitle,
+			[]Middleware{SecureHeaders},
+			*app,
+		)).Methods("GET")
 		return nil
 	})
 
@@ -111,143 +170,3 @@ func init() {
 		return nil
 	})
 }
-
-func hls_playlist(reader io.ReadCloser, ctx *App, res *http.ResponseWriter, req *http.Request) (io.ReadCloser, error) {
-	query := req.URL.Query()
-	if query.Get("transcode") != "hls" {
-		return reader, nil
-	}
-	path := query.Get("path")
-	if strings.HasPrefix(GetMimeType(path), "video/") == false {
-		return reader, nil
-	}
-
-	cacheName := "vid_" + GenerateID(ctx) + "_" + QuickHash(path, 10) + ".dat"
-	cachePath := GetAbsolutePath(
-		VideoCachePath,
-		cacheName,
-	)
-	f, err := os.OpenFile(cachePath, os.O_CREATE|os.O_RDWR, os.ModePerm)
-	if err != nil {
-		Log.Stdout("ERR %+v", err)
-		return reader, err
-	}
-	io.Copy(f, reader)
-	reader.Close()
-	f.Close()
-	time.AfterFunc(CLEAR_CACHE_AFTER*time.Hour, func() { os.Remove(cachePath) })
-
-	p, err := ffprobe(cachePath)
-	if err != nil {
-		return reader, err
-	}
-
-	var response string
-	var i int
-	response = "#EXTM3U\n"
-	response += "#EXT-X-VERSION:3\n"
-	response += "#EXT-X-MEDIA-SEQUENCE:0\n"
-	response += "#EXT-X-ALLOW-CACHE:YES\n"
-	response += fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", HLS_SEGMENT_LENGTH)
-	for i = 0; i < int(p.Format.Duration)/HLS_SEGMENT_LENGTH; i++ {
-		response += fmt.Sprintf("#EXTINF:%d.0000, nodesc\n", HLS_SEGMENT_LENGTH)
-		response += fmt.Sprintf("/hls/hls_%d.ts?path=%s\n", i, cacheName)
-	}
-	if md := math.Mod(p.Format.Duration, HLS_SEGMENT_LENGTH); md > 0 {
-		response += fmt.Sprintf("#EXTINF:%.4f, nodesc\n", md)
-		response += fmt.Sprintf("/hls/hls_%d.ts?path=%s\n", i, cacheName)
-	}
-	response += "#EXT-X-ENDLIST\n"
-	(*res).Header().Set("Content-Type", "application/x-mpegURL")
-	return NewReadCloserFromBytes([]byte(response)), nil
-}
-
-func hls_transcode(ctx *App, res http.ResponseWriter, req *http.Request) {
-	segmentNumber, err := strconv.Atoi(mux.Vars(req)["segment"])
-	if err != nil {
-		Log.Info("[plugin hls] invalid segment request '%s'", mux.Vars(req)["segment"])
-		res.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	startTime := segmentNumber * HLS_SEGMENT_LENGTH
-	cachePath := GetAbsolutePath(
-		VideoCachePath,
-		req.URL.Query().Get("path"),
-	)
-	if _, err := os.Stat(cachePath); os.IsNotExist(err) {
-		Log.Info("[plugin hls]: invalid video")
-		res.WriteHeader(http.StatusServiceUnavailable)
-		return
-	}
-
-	cmd := exec.Command("ffmpeg", []string{
-		"-timelimit", "30",
-		"-ss", fmt.Sprintf("%d.00", startTime),
-		"-i", cachePath,
-		"-t", fmt.Sprintf("%d.00", HLS_SEGMENT_LENGTH),
-		"-vf", fmt.Sprintf("scale=-2:%d", 720),
-		"-vcodec", "libx264",
-		"-preset", "veryfast",
-		"-acodec", "aac",
-		"-ab", "128k",
-		"-ac", "2",
-		"-pix_fmt", "yuv420p",
-		"-x264opts", strings.Join([]string{
-			"subme=0",
-			"me_range=4",
-			"rc_lookahead=10",
-			"me=dia",
-			"no_chroma_me",
-			"8x8dct=0",
-			"partitions=none",
-		}, ":"),
-		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d.000)", HLS_SEGMENT_LENGTH),
-		"-f", "ssegment",
-		"-segment_time", fmt.Sprintf("%d.00", HLS_SEGMENT_LENGTH),
-		"-segment_start_number", fmt.Sprintf("%d", segmentNumber),
-		"-initial_offset", fmt.Sprintf("%d.00", startTime),
-		"-vsync", "2",
-		"pipe:out%03d.ts",
-	}...)
-
-	var str bytes.Buffer
-	cmd.Stdout = res
-	cmd.Stderr = &str
-	err = cmd.Run()
-	if err != nil {
-		Log.Error("plg_video_transcoder::ffmpeg::run '%s' - %s", err.Error(), str.String())
-	}
-}
-
-type FFProbeData struct {
-	Format struct {
-		Duration float64 `json:"duration,string"`
-		BitRate  int     `json:"bit_rate,string"`
-	} `json: "format"`
-	Streams []struct {
-		CodecType   string `json:"codec_type"`
-		CodecName   string `json:"codec_name"`
-		PixelFormat string `json:"pix_fmt"`
-	} `json:"streams"`
-}
-
-func ffprobe(videoPath string) (FFProbeData, error) {
-	var stream bytes.Buffer
-	var probe FFProbeData
-
-	cmd := exec.Command(
-		"ffprobe", strings.Split(fmt.Sprintf(
-			"-v quiet -print_format json -show_format -show_streams %s",
-			videoPath,
-		), " ")...,
-	)
-	cmd.Stdout = &stream
-	if err := cmd.Run(); err != nil {
-		return probe, nil
-	}
-	cmd.Run()
-	if err := json.Unmarshal([]byte(stream.String()), &probe); err != nil {
-		return probe, err
-	}
-	return probe, nil
-}
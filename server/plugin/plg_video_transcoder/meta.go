@@ -0,0 +1,91 @@
+package plg_video_transcoder
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+// position of the recording as written by phones, eg: "+48.8577+002.2950+035.000/"
+var iso6709 = regexp.MustCompile(`^([+-][0-9.]+)([+-][0-9.]+)([+-][0-9.]+)?`)
+
+/*
+ * video_metadata is the extractor behind /api/files/meta for videos. Like for the thumbnails, a
+ * copy of the file is only made when ffprobe can't make sense of the beginning of it
+ */
+func video_metadata(reader io.Reader, m *MediaMetadata) error {
+	tmp := GetAbsolutePath(TMP_PATH, "video_"+QuickString(20)+".dat")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	probe, err := ffprobe("", io.TeeReader(reader, f))
+	if err != nil || len(probe.Streams) == 0 {
+		if _, err = io.Copy(f, reader); err != nil {
+			return err
+		} else if probe, err = ffprobe(tmp, nil); err != nil {
+			return err
+		}
+	}
+
+	m.Format = probe.Format.FormatName
+	m.Duration = probe.Format.Duration
+	m.BitRate = probe.Format.BitRate
+	m.Width, m.Height = probe.Video()
+	if streams := probe.StreamsOf("video"); len(streams) > 0 {
+		m.VideoCodec = streams[0].CodecName
+		switch streams[0].Tags.Rotate {
+		case "90":
+			m.Orientation = 6
+		case "180":
+			m.Orientation = 3
+		case "270":
+			m.Orientation = 8
+		}
+	}
+	if streams := probe.StreamsOf("audio"); len(streams) > 0 {
+		m.AudioCodec = streams[0].CodecName
+		m.SampleRate = streams[0].SampleRate
+		m.Channels = streams[0].Channels
+	}
+	for k, v := range probe.Format.Tags {
+		switch strings.ToLower(k) {
+		case "creation_time":
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil && t.Year() > 1970 {
+				m.CaptureDate = &t
+			}
+		case "location", "com.apple.quicktime.location.iso6709":
+			match := iso6709.FindStringSubmatch(v)
+			if match == nil {
+				continue
+			}
+			lat, errLat := strconv.ParseFloat(match[1], 64)
+			lon, errLon := strconv.ParseFloat(match[2], 64)
+			if errLat != nil || errLon != nil {
+				continue
+			}
+			m.Latitude, m.Longitude = &lat, &lon
+			if alt, err := strconv.ParseFloat(match[3], 64); err == nil {
+				m.Altitude = &alt
+			}
+		case "com.apple.quicktime.make", "make":
+			m.Make = v
+		case "com.apple.quicktime.model", "model":
+			m.Model = v
+		case "title", "artist", "album", "date", "genre", "comment":
+			if m.Tags == nil {
+				m.Tags = map[string]string{}
+			}
+			m.Tags[strings.ToLower(k)] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package plg_video_transcoder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+const (
+	SPRITE_TILE_WIDTH   = 160
+	SPRITE_COLUMNS      = 10
+	SPRITE_MAX_TILES    = 100
+	SPRITE_MIN_INTERVAL = 2.0
+)
+
+/*
+ * Seek previews are made of 2 things:
+ * - /api/files/cat?path=...&preview=sprite     => a WebVTT thumbnail track to give to the player
+ * - /api/files/cat?path=...&preview=sprite.jpg => the image the track points to, where frames taken
+ *                                                 at regular intervals are tiled together
+ * The url of the image depends on the request (eg: shared links) so the cached track has a
+ * placeholder instead
+ */
+const SPRITE_URL_PLACEHOLDER = "{{sprite}}"
+
+func video_preview(reader io.ReadCloser, ctx *App, res *http.ResponseWriter, req *http.Request) (io.ReadCloser, error) {
+	query := req.URL.Query()
+	preview := query.Get("preview")
+	if preview != "sprite" && preview != "sprite.jpg" {
+		return reader, nil
+	}
+	path := query.Get("path")
+	if strings.HasPrefix(GetMimeType(path), "video/") == false {
+		return reader, nil
+	}
+
+	p, files := hlsListing(ctx, path)
+	id := hlsSourceID(ctx, path, files)
+	vtt, img := id+"_sprite.vtt", id+"_sprite.jpg"
+	if spriteCached(vtt, img) == false {
+		src, err := hlsSourceOpen(ctx, id, p, files, reader)
+		if err != nil {
+			Log.Debug("plg_video_transcoder::sprite path[%s] err[%s]", path, err.Error())
+			return nil, NewError("Unable to read the video", 400)
+		} else if err = spriteGenerate(req.Context(), src, vtt, img); err != nil {
+			Log.Debug("plg_video_transcoder::sprite path[%s] err[%s]", path, err.Error())
+			return nil, ErrCongestion
+		}
+	} else {
+		reader.Close()
+	}
+
+	(*res).Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", CLEAR_CACHE_AFTER*3600))
+	if preview == "sprite.jpg" {
+		f, ok := segmentCache.Get(img)
+		if ok == false {
+			return nil, ErrNotFound
+		}
+		(*res).Header().Set("Content-Type", "image/jpeg")
+		return f, nil
+	}
+	f, ok := segmentCache.Get(vtt)
+	if ok == false {
+		return nil, ErrNotFound
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	query.Set("preview", "sprite.jpg")
+	(*res).Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	return NewReadCloserFromBytes([]byte(strings.ReplaceAll(
+		string(b),
+		SPRITE_URL_PLACEHOLDER,
+		"/api/files/cat?"+query.Encode(),
+	))), nil
+}
+
+func spriteCached(names ...string) bool {
+	for _, name := range names {
+		if _, err := os.Stat(segmentCache.Path(name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func spriteGenerate(ctx context.Context, src *hlsSource, vtt string, img string) error {
+	// many people scrubbing through the same video only need one sprite
+	hlsInflight.Lock()
+	wait, found := hlsInflight.m[img]
+	if found == false {
+		wait = make(chan struct{})
+		hlsInflight.m[img] = wait
+	}
+	hlsInflight.Unlock()
+	if found {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if spriteCached(vtt, img) == false {
+			return ErrNotFound
+		}
+		return nil
+	}
+	defer func() {
+		hlsInflight.Lock()
+		delete(hlsInflight.m, img)
+		hlsInflight.Unlock()
+		close(wait)
+	}()
+
+	select {
+	case <-src.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if src.err != nil {
+		return src.err
+	}
+	duration := src.probe.Format.Duration
+	width, height := src.probe.Video()
+	if width == 0 || height == 0 || duration <= 0 {
+		return ErrNotValid
+	}
+	interval := math.Max(SPRITE_MIN_INTERVAL, duration/SPRITE_MAX_TILES)
+	count := int(math.Ceil(duration / interval))
+	if count > SPRITE_MAX_TILES {
+		count = SPRITE_MAX_TILES
+	}
+	columns := SPRITE_COLUMNS
+	if count < columns {
+		columns = count
+	}
+	rows := (count + columns - 1) / columns
+	tileHeight := evenSize(SPRITE_TILE_WIDTH * height / width)
+
+	// only decoding key frames makes it fast enough, each tile shows the key frame right before
+	// its timestamp
+	tmp := GetAbsolutePath(VideoCachePath, "source", img+".tmp"+QuickString(6))
+	defer os.Remove(tmp)
+	err := ffmpeg(ctx,
+		"-skip_frame", "nokey",
+		"-i", src.file,
+		"-vf", fmt.Sprintf(
+			"fps=1/%.3f,scale=%d:%d,tile=%dx%d",
+			interval, SPRITE_TILE_WIDTH, tileHeight, columns, rows,
+		),
+		"-frames:v", "1",
+		"-q:v", "5",
+		"-f", "image2",
+		"-y", tmp,
+	)
+	if err != nil {
+		return err
+	} else if err = segmentCachePut(img, tmp); err != nil {
+		return err
+	}
+
+	track := "WEBVTT\n\n"
+	for i := 0; i < count; i++ {
+		track += fmt.Sprintf(
+			"%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			vttTime(float64(i)*interval), vttTime(math.Min(float64(i+1)*interval, duration)),
+			SPRITE_URL_PLACEHOLDER,
+			(i%columns)*SPRITE_TILE_WIDTH, (i/columns)*tileHeight, SPRITE_TILE_WIDTH, tileHeight,
+		)
+	}
+	if err = os.WriteFile(tmp, []byte(track), 0600); err != nil {
+		return err
+	}
+	return segmentCachePut(vtt, tmp)
+}
+
+func vttTime(t float64) string {
+	ms := int(t * 1000)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, (ms/60000)%60, (ms/1000)%60, ms%1000)
+}
@@ -0,0 +1,237 @@
+package plg_video_transcoder
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+// subtitles larger than that are most likely not subtitles
+const SUBTITLE_MAX_SIZE = 10 * 1024 * 1024
+
+var (
+	hlsSubtitleCodecs  = []string{"subrip", "srt", "ass", "ssa", "webvtt", "mov_text", "text"}
+	hlsSubtitleSidecar = []string{".srt", ".ass", ".ssa", ".vtt"}
+	hlsValidSubtitle   = regexp.MustCompile(`^[ef][0-9]+$`)
+)
+
+/*
+ * A subtitle track is either embedded in the video or a file sitting next to it, eg: for
+ * "movie.mkv" we pick "movie.srt", "movie.en.srt", "movie.fr.ass", ... Either way they are
+ * converted to WebVTT which is what HLS players understand
+ */
+type hlsSubtitle struct {
+	Id       string // "e3" for the stream 3 of the video, "f0" for the first file next to it
+	Name     string
+	Language string
+	stream   int
+	file     string
+}
+
+func hlsSubtitlesEmbedded(src *hlsSource) []hlsSubtitle {
+	subtitles := []hlsSubtitle{}
+	for i, s := range src.probe.StreamsOf("subtitle") {
+		// bitmap based subtitles like PGS or VobSub can't be made into text
+		if contains(hlsSubtitleCodecs, s.CodecName) == false {
+			continue
+		}
+		subtitles = append(subtitles, hlsSubtitle{
+			Id:       fmt.Sprintf("e%d", s.Index),
+			Name:     hlsTrackName(s.Tags.Title, s.Tags.Language, i),
+			Language: s.Tags.Language,
+			stream:   s.Index,
+		})
+	}
+	return subtitles
+}
+
+// hlsSubtitlesSidecar makes a local copy of the subtitle files found next to a video
+func hlsSubtitlesSidecar(ctx *App, path string, files []os.FileInfo, id string) []hlsSubtitle {
+	subtitles := []hlsSubtitle{}
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for _, f := range files {
+		ext := strings.ToLower(filepath.Ext(f.Name()))
+		if f.IsDir() || contains(hlsSubtitleSidecar, ext) == false {
+			continue
+		} else if f.Size() > SUBTITLE_MAX_SIZE {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		if name != base && strings.HasPrefix(name, base+".") == false {
+			continue
+		}
+		// eg: "movie.en.forced.srt" is in english
+		language := strings.Split(strings.TrimPrefix(strings.TrimPrefix(name, base), "."), ".")[0]
+
+		p := filepath.Join(filepath.Dir(path), f.Name())
+		allowed := true
+		for _, auth := range Hooks.Get.AuthorisationMiddleware() {
+			if err := auth.Cat(ctx, p); err != nil {
+				allowed = false
+				break
+			}
+		}
+		if allowed == false {
+			continue
+		}
+		subtitle := hlsSubtitle{
+			Id:       fmt.Sprintf("f%d", len(subtitles)),
+			Name:     f.Name(),
+			Language: language,
+			stream:   -1,
+			file:     GetAbsolutePath(VideoCachePath, "source", fmt.Sprintf("%s_f%d%s", id, len(subtitles), ext)),
+		}
+		if err := hlsSubtitleCopy(ctx, p, subtitle.file); err != nil {
+			Log.Debug("plg_video_transcoder::subtitle path[%s] err[%s]", p, err.Error())
+			continue
+		}
+		subtitles = append(subtitles, subtitle)
+	}
+	return subtitles
+}
+
+func hlsSubtitleCopy(ctx *App, path string, to string) error {
+	reader, err := ctx.Backend.Cat(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	f, err := os.OpenFile(to, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, io.LimitReader(reader, SUBTITLE_MAX_SIZE))
+	return err
+}
+
+// hls_subtitle_playlist has a single segment made of the entire subtitle track
+func hls_subtitle_playlist(ctx *App, res http.ResponseWriter, req *http.Request) {
+	src, _, err := hlsSubtitleRequest(req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	} else if src == nil {
+		SendErrorResult(res, ErrNotFound)
+		return
+	}
+	duration := src.probe.Format.Duration
+	response := "#EXTM3U\n"
+	response += "#EXT-X-VERSION:3\n"
+	response += "#EXT-X-MEDIA-SEQUENCE:0\n"
+	response += "#EXT-X-PLAYLIST-TYPE:VOD\n"
+	response += fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(duration)))
+	response += fmt.Sprintf("#EXTINF:%.4f, nodesc\n", duration)
+	response += "track.vtt\n"
+	response += "#EXT-X-ENDLIST\n"
+	res.Header().Set("Content-Type", "application/x-mpegURL")
+	res.Write([]byte(response))
+}
+
+func hls_subtitle(ctx *App, res http.ResponseWriter, req *http.Request) {
+	src, subtitle, err := hlsSubtitleRequest(req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	name := fmt.Sprintf("%s_%s.vtt", mux.Vars(req)["id"], mux.Vars(req)["subtitle"])
+	if f, ok := segmentCache.Get(name); ok {
+		hlsServeSubtitle(res, req, f)
+		return
+	} else if src == nil {
+		SendErrorResult(res, ErrNotFound)
+		return
+	}
+
+	input := subtitle.file
+	if subtitle.stream >= 0 {
+		select {
+		case <-src.ready:
+		case <-req.Context().Done():
+			return
+		}
+		if src.err != nil {
+			SendErrorResult(res, ErrNotFound)
+			return
+		}
+		input = src.file
+	}
+	tmp := GetAbsolutePath(VideoCachePath, "source", name+".tmp"+QuickString(6))
+	defer os.Remove(tmp)
+	args := []string{"-i", input}
+	if subtitle.stream >= 0 {
+		args = append(args, "-map", fmt.Sprintf("0:%d", subtitle.stream))
+	}
+	args = append(args, "-f", "webvtt", "-y", tmp)
+	if err = ffmpeg(req.Context(), args...); err != nil {
+		SendErrorResult(res, ErrCongestion)
+		return
+	} else if err = segmentCachePut(name, tmp); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	f, ok := segmentCache.Get(name)
+	if ok == false {
+		SendErrorResult(res, ErrCongestion)
+		return
+	}
+	hlsServeSubtitle(res, req, f)
+}
+
+/*
+ * hlsServeSubtitle maps the subtitle timestamps onto the ones of the segments. Those start at 0
+ * as they're made with no mux delay
+ */
+func hlsServeSubtitle(res http.ResponseWriter, req *http.Request, f *os.File) {
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	content := strings.TrimPrefix(string(b), "\ufeff")
+	if strings.Contains(content, "X-TIMESTAMP-MAP") == false {
+		if header, body, ok := strings.Cut(content, "\n"); ok {
+			content = strings.TrimRight(header, "\r") + "\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n" + body
+		}
+	}
+	res.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	res.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", CLEAR_CACHE_AFTER*3600))
+	res.Write([]byte(content))
+}
+
+func hlsSubtitleRequest(req *http.Request) (*hlsSource, hlsSubtitle, error) {
+	vars := mux.Vars(req)
+	if hlsValidID.MatchString(vars["id"]) == false {
+		return nil, hlsSubtitle{}, NewError("Invalid video", 400)
+	} else if hlsValidSubtitle.MatchString(vars["subtitle"]) == false {
+		return nil, hlsSubtitle{}, NewError("Invalid subtitle", 400)
+	}
+	src := hlsSourceLookup(vars["id"])
+	if src == nil {
+		return nil, hlsSubtitle{Id: vars["subtitle"]}, nil
+	}
+	for _, s := range src.subtitles {
+		if s.Id == vars["subtitle"] {
+			return src, s, nil
+		}
+	}
+	return nil, hlsSubtitle{}, ErrNotFound
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
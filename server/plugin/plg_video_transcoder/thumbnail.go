@@ -0,0 +1,57 @@
+package plg_video_transcoder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+const THUMB_SIZE = 250
+
+/*
+ * The thumbnail of a video is the most representative frame out of the first few seconds, which
+ * avoids ending up with the black frame many videos start with. Like for the HLS playlist, we
+ * first try with whatever is at the beginning of the video and only fallback to a complete copy
+ * of the file for formats that require it
+ */
+type thumbnailer struct{}
+
+func (this thumbnailer) Generate(reader io.ReadCloser, ctx *App, res *http.ResponseWriter, req *http.Request) (io.ReadCloser, error) {
+	tmp := GetAbsolutePath(TMP_PATH, "video_"+QuickString(20)+".dat")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	defer reader.Close()
+
+	args := []string{
+		"-vf", fmt.Sprintf("thumbnail=60,scale='min(%d,iw)':-2", THUMB_SIZE),
+		"-frames:v", "1",
+		"-f", "image2",
+		"-c:v", "mjpeg",
+		"-q:v", "5",
+		"pipe:1",
+	}
+	var output bytes.Buffer
+	err = ffmpegPipe(req.Context(), io.TeeReader(reader, f), &output, append([]string{"-i", "pipe:0"}, args...)...)
+	if err != nil || output.Len() == 0 {
+		if req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		} else if _, err = io.Copy(f, reader); err != nil {
+			return nil, err
+		}
+		output.Reset()
+		if err = ffmpegPipe(req.Context(), nil, &output, append([]string{"-i", tmp}, args...)...); err != nil {
+			return nil, err
+		}
+	}
+	(*res).Header().Set("Content-Type", "image/jpeg")
+	return NewReadCloserFromBytes(output.Bytes()), nil
+}
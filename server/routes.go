@@ -64,6 +64,16 @@ func Build(a App) *mux.Router {
 	files.HandleFunc("/touch", NewMiddlewareChain(FileTouch, middlewares, a)).Methods("POST")
 	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureOrigin, WithPublicAPI, SessionStart, LoggedInOnly}
 	files.HandleFunc("/search", NewMiddlewareChain(FileSearch, middlewares, a)).Methods("GET")
+	files.HandleFunc("/grep", NewMiddlewareChain(FileGrep, middlewares, a)).Methods("GET")
+	files.HandleFunc("/du", NewMiddlewareChain(FileDiskUsage, middlewares, a)).Methods("GET")
+	files.HandleFunc("/meta", NewMiddlewareChain(FileMeta, middlewares, a)).Methods("GET")
+	files.HandleFunc("/gallery", NewMiddlewareChain(GalleryTimeline, middlewares, a)).Methods("GET")
+	files.HandleFunc("/gallery", NewMiddlewareChain(GalleryRefresh, middlewares, a)).Methods("POST")
+	files.HandleFunc("/duplicates", NewMiddlewareChain(DuplicatesStart, middlewares, a)).Methods("POST")
+	files.HandleFunc("/duplicates/{id}", NewMiddlewareChain(DuplicatesStatus, middlewares, a)).Methods("GET")
+	files.HandleFunc("/duplicates/{id}", NewMiddlewareChain(DuplicatesCancel, middlewares, a)).Methods("DELETE")
+	middlewares = []Middleware{ApiHeaders, SecureHeaders, SecureOrigin, WithPublicAPI, SessionStart, LoggedInOnly, BodyParser}
+	files.HandleFunc("/duplicates/{id}/resolve", NewMiddlewareChain(DuplicatesResolve, middlewares, a)).Methods("POST")
 
 	// API for Shared link
 	share := r.PathPrefix("/api/share").Subrouter()